@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+// adminAuth guards the admin endpoints with the bearer token configured in 'WECHAT_ADMIN_TOKEN',
+// the endpoints are disabled if the token is not configured
+func adminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(adminToken) == 0 {
+			c.String(http.StatusForbidden, "admin api not configured")
+			c.Abort()
+			return
+		}
+
+		auth := c.GetHeader("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(adminToken)) != 1 {
+			c.String(http.StatusUnauthorized, "invalid admin token")
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
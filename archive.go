@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/haowang1013/wechat-server/wechat"
+	"github.com/minio/minio-go"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	mediaKeyPrefix = "media."
+)
+
+var (
+	archive *mediaArchive
+)
+
+// mediaSink stores the archived media, returns where the media can be found and the number of bytes stored,
+// size is -1 if it's unknown
+type mediaSink interface {
+	store(name, contentType string, size int64, r io.Reader) (string, int64, error)
+}
+
+/**
+* local file system sink
+ */
+type fileSink struct {
+	dir string
+}
+
+func (f *fileSink) store(name, contentType string, size int64, r io.Reader) (string, int64, error) {
+	// the name is built from the message, make sure it doesn't escape the directory
+	path := filepath.Join(f.dir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(f.dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", 0, fmt.Errorf("invalid media name: '%s'", name)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", 0, err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	n, err := io.Copy(file, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return path, n, nil
+}
+
+func newFileSink(dir string) mediaSink {
+	f := new(fileSink)
+	f.dir = dir
+	return f
+}
+
+/**
+* s3 compatible sink
+ */
+type s3Sink struct {
+	client *minio.Client
+	bucket string
+}
+
+func (s *s3Sink) store(name, contentType string, size int64, r io.Reader) (string, int64, error) {
+	n, err := s.client.PutObject(s.bucket, name, r, size, minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("s3://%s/%s", s.bucket, name), n, nil
+}
+
+func newS3Sink(endpoint, accessKey, secretKey, bucket string, secure bool) (mediaSink, error) {
+	client, err := minio.New(endpoint, accessKey, secretKey, secure)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		err = client.MakeBucket(bucket, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := new(s3Sink)
+	s.client = client
+	s.bucket = bucket
+	return s, nil
+}
+
+// archivedMedia records where a media sent by a user is archived
+type archivedMedia struct {
+	MediaID     string `json:"media_id"`
+	OpenID      string `json:"openid"`
+	MsgType     string `json:"msg_type"`
+	Variant     string `json:"variant"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Location    string `json:"location"`
+	ArchiveTime int64  `json:"archive_time"`
+}
+
+// mediaArchive downloads the media sent by users before it expires in 3 days, and stores it in the sink
+type mediaArchive struct {
+	sink    mediaSink
+	records kvCache
+	hdVoice bool
+}
+
+// archiveAsync archives the media in the background, since the reply has to be sent within 5 seconds
+func (a *mediaArchive) archiveAsync(m wechat.UserMessage, mediaID string) {
+	go func() {
+		ctx := context.Background()
+		a.archive(ctx, m, mediaID, "")
+		if a.hdVoice && m.MessageType() == "voice" {
+			a.archive(ctx, m, mediaID, "hd")
+		}
+	}()
+}
+
+func (a *mediaArchive) archive(ctx context.Context, m wechat.UserMessage, mediaID, variant string) (*archivedMedia, error) {
+	content, err := fetchMedia(ctx, mediaID, variant)
+	if err != nil {
+		logFor(ctx).Errorf("failed to fetch media '%s' from %s: %s", mediaID, m.From(), err)
+		return nil, err
+	}
+	defer content.Body.Close()
+
+	name := m.From() + "/" + mediaID
+	if len(variant) > 0 {
+		name += "." + variant
+	}
+	name += mediaExtension(content)
+
+	location, size, err := a.sink.store(name, content.ContentType, content.Size, content.Body)
+	if err != nil {
+		logFor(ctx).Errorf("failed to store media '%s' from %s: %s", mediaID, m.From(), err)
+		return nil, err
+	}
+
+	record := &archivedMedia{
+		MediaID:     mediaID,
+		OpenID:      m.From(),
+		MsgType:     m.MessageType(),
+		Variant:     variant,
+		ContentType: content.ContentType,
+		Size:        size,
+		Location:    location,
+		ArchiveTime: time.Now().Unix(),
+	}
+
+	key := mediaKeyPrefix + mediaID
+	if len(variant) > 0 {
+		key += "." + variant
+	}
+	setJson(a.records, key, record)
+
+	logFor(ctx).Infof("archived %s media '%s' from %s to %s", m.MessageType(), mediaID, m.From(), location)
+	return record, nil
+}
+
+func newMediaArchive(sink mediaSink, records kvCache, hdVoice bool) *mediaArchive {
+	a := new(mediaArchive)
+	a.sink = sink
+	a.records = records
+	a.hdVoice = hdVoice
+	return a
+}
+
+// fetchMedia downloads a media sent by a user, the 'hd' variant is the speex version of a voice media
+func fetchMedia(ctx context.Context, mediaID, variant string) (*wechat.MediaContent, error) {
+	token, err := server.AccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if variant == "hd" {
+		return wechat.GetHDVoice(ctx, token, mediaID)
+	}
+
+	content, err := wechat.GetTempMedia(ctx, token, mediaID)
+	if err != nil {
+		return nil, err
+	}
+
+	// videos have to be downloaded from the url
+	if content.Body == nil && len(content.VideoUrl) > 0 {
+		req, err := http.NewRequest(http.MethodGet, content.VideoUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := wechat.DefaultClient.HTTPClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to download video '%s': %s", mediaID, resp.Status)
+		}
+
+		content.ContentType = resp.Header.Get("Content-Type")
+		content.Size = resp.ContentLength
+		content.Body = resp.Body
+	}
+
+	if content.Body == nil {
+		return nil, fmt.Errorf("no content for media '%s'", mediaID)
+	}
+	return content, nil
+}
+
+func mediaExtension(content *wechat.MediaContent) string {
+	if ext := filepath.Ext(content.FileName); len(ext) > 0 {
+		return ext
+	}
+
+	exts, err := mime.ExtensionsByType(content.ContentType)
+	if err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
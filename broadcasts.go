@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/haowang1013/wechat-server/wechat"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultBroadcastQueryLimit = 20
+	maxBroadcastQueryLimit     = 100
+
+	// statuses of a broadcast, 'sending' until the MASSSENDJOBFINISH event is received
+	broadcastSending  = "SENDING"
+	broadcastFinished = "FINISHED"
+	broadcastDeleted  = "DELETED"
+)
+
+var (
+	broadcasts broadcastStore
+
+	broadcastSchemas = []string{
+		`CREATE TABLE IF NOT EXISTS broadcasts (
+			msg_id BIGINT PRIMARY KEY,
+			msg_data_id BIGINT NOT NULL DEFAULT 0,
+			target TEXT NOT NULL,
+			message TEXT NOT NULL,
+			status TEXT NOT NULL,
+			result TEXT NOT NULL DEFAULT '',
+			total_count INTEGER NOT NULL DEFAULT 0,
+			filter_count INTEGER NOT NULL DEFAULT 0,
+			sent_count INTEGER NOT NULL DEFAULT 0,
+			error_count INTEGER NOT NULL DEFAULT 0,
+			create_time BIGINT NOT NULL,
+			finish_time BIGINT NOT NULL DEFAULT 0
+		)`,
+		`CREATE INDEX IF NOT EXISTS broadcasts_create_time ON broadcasts (create_time)`,
+	}
+)
+
+// broadcastTarget is one of all followers, the followers with a tag, or a list of followers
+type broadcastTarget struct {
+	All     bool     `json:"all,omitempty"`
+	TagID   *int     `json:"tag_id,omitempty"`
+	OpenIDs []string `json:"openids,omitempty"`
+}
+
+func (t *broadcastTarget) validate() error {
+	n := 0
+	if t.All {
+		n++
+	}
+	if t.TagID != nil {
+		n++
+	}
+	if len(t.OpenIDs) > 0 {
+		n++
+	}
+	if n != 1 {
+		return errors.New("target must be exactly one of all, tag_id and openids")
+	}
+	return nil
+}
+
+type broadcastRequest struct {
+	Target  broadcastTarget    `json:"target"`
+	Message wechat.MassMessage `json:"message"`
+}
+
+// broadcast is the job record of a broadcast, result is the status reported by the MASSSENDJOBFINISH event
+type broadcast struct {
+	MsgID       int64              `json:"msg_id"`
+	MsgDataID   int64              `json:"msg_data_id"`
+	Target      broadcastTarget    `json:"target"`
+	Message     wechat.MassMessage `json:"message"`
+	Status      string             `json:"status"`
+	Result      string             `json:"result"`
+	TotalCount  int                `json:"total_count"`
+	FilterCount int                `json:"filter_count"`
+	SentCount   int                `json:"sent_count"`
+	ErrorCount  int                `json:"error_count"`
+	CreateTime  int64              `json:"create_time"`
+	FinishTime  int64              `json:"finish_time"`
+}
+
+// broadcastStore persists the broadcast jobs
+type broadcastStore interface {
+	create(b *broadcast) error
+	finish(e *wechat.MassSendJobFinishEvent, finishTime int64) (bool, error)
+	setStatus(msgID int64, status string) error
+	get(msgID int64) (*broadcast, bool, error)
+	list(offset, limit int) ([]*broadcast, error)
+}
+
+/**
+* sql broadcast store
+ */
+type sqlBroadcastStore struct {
+	sqlStore
+}
+
+func (s *sqlBroadcastStore) create(b *broadcast) error {
+	target, err := json.Marshal(b.Target)
+	if err != nil {
+		return err
+	}
+
+	message, err := json.Marshal(b.Message)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(s.rebind(`INSERT INTO broadcasts (msg_id, msg_data_id, target, message, status, create_time)
+		VALUES (?, ?, ?, ?, ?, ?)`),
+		b.MsgID, b.MsgDataID, string(target), string(message), b.Status, b.CreateTime)
+	return err
+}
+
+func (s *sqlBroadcastStore) finish(e *wechat.MassSendJobFinishEvent, finishTime int64) (bool, error) {
+	result, err := s.db.Exec(s.rebind(`UPDATE broadcasts SET status = ?, result = ?, total_count = ?, filter_count = ?,
+			sent_count = ?, error_count = ?, finish_time = ?
+		WHERE msg_id = ?`),
+		broadcastFinished, e.Status, e.TotalCount, e.FilterCount, e.SentCount, e.ErrorCount, finishTime, e.MsgID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlBroadcastStore) setStatus(msgID int64, status string) error {
+	_, err := s.db.Exec(s.rebind(`UPDATE broadcasts SET status = ? WHERE msg_id = ?`), status, msgID)
+	return err
+}
+
+func (s *sqlBroadcastStore) get(msgID int64) (*broadcast, bool, error) {
+	result, err := s.scan(s.db.Query(s.rebind(`SELECT msg_id, msg_data_id, target, message, status, result, total_count,
+			filter_count, sent_count, error_count, create_time, finish_time
+		FROM broadcasts WHERE msg_id = ?`), msgID))
+	if err != nil || len(result) == 0 {
+		return nil, false, err
+	}
+	return result[0], true, nil
+}
+
+func (s *sqlBroadcastStore) list(offset, limit int) ([]*broadcast, error) {
+	return s.scan(s.db.Query(s.rebind(`SELECT msg_id, msg_data_id, target, message, status, result, total_count,
+			filter_count, sent_count, error_count, create_time, finish_time
+		FROM broadcasts ORDER BY create_time DESC, msg_id DESC LIMIT ? OFFSET ?`), limit, offset))
+}
+
+func (s *sqlBroadcastStore) scan(rows *sql.Rows, err error) ([]*broadcast, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*broadcast
+	for rows.Next() {
+		var target, message string
+		b := new(broadcast)
+		err = rows.Scan(&b.MsgID, &b.MsgDataID, &target, &message, &b.Status, &b.Result, &b.TotalCount,
+			&b.FilterCount, &b.SentCount, &b.ErrorCount, &b.CreateTime, &b.FinishTime)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal([]byte(target), &b.Target)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal([]byte(message), &b.Message)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, b)
+	}
+	return result, rows.Err()
+}
+
+func newSqlBroadcastStore(db *sql.DB, driver string) (broadcastStore, error) {
+	err := createTables(db, broadcastSchemas)
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(sqlBroadcastStore)
+	s.db = db
+	s.driver = driver
+	return s, nil
+}
+
+// sendBroadcast sends the message to the target and records the job
+func sendBroadcast(ctx context.Context, store broadcastStore, req *broadcastRequest) (*broadcast, error) {
+	token, err := server.AccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *wechat.MassResult
+	switch {
+	case req.Target.All:
+		result, err = wechat.SendMassToAll(ctx, token, &req.Message)
+	case req.Target.TagID != nil:
+		result, err = wechat.SendMassToTag(ctx, token, *req.Target.TagID, &req.Message)
+	default:
+		result, err = wechat.SendMassToUsers(ctx, token, req.Target.OpenIDs, &req.Message)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b := &broadcast{
+		MsgID:      result.MsgID,
+		MsgDataID:  result.MsgDataID,
+		Target:     req.Target,
+		Message:    req.Message,
+		Status:     broadcastSending,
+		CreateTime: time.Now().Unix(),
+	}
+
+	// the broadcast has been sent at this point, losing the record only affects tracking
+	err = store.create(b)
+	if err != nil {
+		logFor(ctx).Errorf("failed to record broadcast %d: %s", b.MsgID, err)
+	}
+
+	logFor(ctx).Infof("broadcast %d sent", b.MsgID)
+	return b, nil
+}
+
+// finishBroadcast updates the job record when the MASSSENDJOBFINISH event is received
+func finishBroadcast(store broadcastStore, e *wechat.MassSendJobFinishEvent) {
+	log.Infof("broadcast %d finished with %s, %d sent, %d failed, %d filtered out of %d",
+		e.MsgID, e.Status, e.SentCount, e.ErrorCount, e.FilterCount, e.TotalCount)
+
+	ok, err := store.finish(e, time.Now().Unix())
+	if err != nil {
+		log.Errorf("failed to update broadcast %d: %s", e.MsgID, err)
+	} else if !ok {
+		log.Warningf("unknown broadcast %d", e.MsgID)
+	}
+}
+
+/**
+* admin endpoints
+ */
+func broadcastCreateHandler(c *gin.Context) {
+	req := new(broadcastRequest)
+	err := c.BindJSON(req)
+	if err != nil {
+		return
+	}
+
+	err = req.Target.validate()
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	b, err := sendBroadcast(c.Request.Context(), broadcasts, req)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, b)
+}
+
+func broadcastPreviewHandler(c *gin.Context) {
+	req := new(struct {
+		OpenID  string             `json:"openid"`
+		Message wechat.MassMessage `json:"message"`
+	})
+	err := c.BindJSON(req)
+	if err != nil {
+		return
+	}
+
+	if len(req.OpenID) == 0 {
+		c.String(http.StatusBadRequest, "openid is required")
+		return
+	}
+
+	token, err := server.AccessToken(c.Request.Context())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	err = wechat.PreviewMass(c.Request.Context(), token, req.OpenID, &req.Message)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.String(http.StatusOK, "preview sent to %s", req.OpenID)
+}
+
+func broadcastListHandler(c *gin.Context) {
+	offset, err := parseIntQuery(c, "offset", 0, 0, math.MaxInt32)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit, err := parseIntQuery(c, "limit", defaultBroadcastQueryLimit, 1, maxBroadcastQueryLimit)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := broadcasts.list(offset, limit)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if result == nil {
+		result = []*broadcast{}
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"broadcasts": result,
+		"offset":     offset,
+		"count":      len(result),
+	})
+}
+
+// broadcastGetHandler returns the job record, the status is refreshed from wechat if the job hasn't finished
+func broadcastGetHandler(id string, c *gin.Context) {
+	b, ok := loadBroadcast(id, c)
+	if !ok {
+		return
+	}
+
+	if b.Status == broadcastSending {
+		token, err := server.AccessToken(c.Request.Context())
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		b.Result, err = wechat.GetMassStatus(c.Request.Context(), token, b.MsgID)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+	c.IndentedJSON(http.StatusOK, b)
+}
+
+// broadcastDeleteHandler deletes the broadcast, or a single article of a news broadcast if article_idx is set
+func broadcastDeleteHandler(id string, c *gin.Context) {
+	b, ok := loadBroadcast(id, c)
+	if !ok {
+		return
+	}
+
+	articleIdx, err := parseIntQuery(c, "article_idx", 0, 0, math.MaxInt32)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	token, err := server.AccessToken(c.Request.Context())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	err = wechat.DeleteMass(c.Request.Context(), token, b.MsgID, articleIdx)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if articleIdx == 0 {
+		err = broadcasts.setStatus(b.MsgID, broadcastDeleted)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+	c.String(http.StatusOK, "broadcast %d deleted", b.MsgID)
+}
+
+func loadBroadcast(id string, c *gin.Context) (*broadcast, bool) {
+	msgID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		c.String(http.StatusBadRequest, "invalid broadcast id '%s'", id)
+		return nil, false
+	}
+
+	b, ok, err := broadcasts.get(msgID)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return nil, false
+	}
+
+	if !ok {
+		c.String(http.StatusNotFound, "broadcast not found")
+		return nil, false
+	}
+	return b, true
+}
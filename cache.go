@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"gopkg.in/redis.v4"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -12,6 +13,17 @@ type kvCache interface {
 	get(key string) (string, bool)
 	set(key, value string) error
 	exists(key string) bool
+
+	// setNX sets the key only if it doesn't exist, the key expires after the life time if it's not zero.
+	// Returns true if the key is set, which can be used as a lock shared by the replicas
+	setNX(key, value string, lifeTime time.Duration) bool
+
+	// del removes the key, e.g. to release a lock taken with setNX
+	del(key string) error
+
+	// incr adds one to the integer value of the key and returns the result, a missing key starts from zero
+	// and expires after the value life time, same as set
+	incr(key string) (int64, error)
 }
 
 type factory func() interface{}
@@ -22,8 +34,6 @@ func getJson(k kvCache, key string, f factory) (interface{}, bool) {
 		return nil, false
 	}
 
-	log.Debugf("%s: %s", key, s)
-
 	if s == "null" {
 		return nil, true
 	}
@@ -53,19 +63,25 @@ func logError(err error) {
 * memory cache
  */
 type memCache struct {
-	data map[string]string
-	m    sync.Mutex
+	data          map[string]string
+	expireTimes   map[string]time.Time
+	valueLifeTime time.Duration
+	m             sync.Mutex
 }
 
 func (k *memCache) init() {
 	if k.data == nil {
 		k.data = make(map[string]string)
 	}
+	if k.expireTimes == nil {
+		k.expireTimes = make(map[string]time.Time)
+	}
 }
 
 func (k *memCache) get(key string) (string, bool) {
 	k.m.Lock()
 	defer k.m.Unlock()
+	k.expire(key)
 	v, ok := k.data[key]
 	return v, ok
 }
@@ -74,19 +90,82 @@ func (k *memCache) set(key, value string) error {
 	k.m.Lock()
 	defer k.m.Unlock()
 	k.data[key] = value
+	if k.valueLifeTime > 0 {
+		k.expireTimes[key] = time.Now().Add(k.valueLifeTime)
+	} else {
+		delete(k.expireTimes, key)
+	}
 	return nil
 }
 
 func (k *memCache) exists(key string) bool {
 	k.m.Lock()
 	defer k.m.Unlock()
+	k.expire(key)
 	_, ok := k.data[key]
 	return ok
 }
 
-func newMemCache() kvCache {
+func (k *memCache) setNX(key, value string, lifeTime time.Duration) bool {
+	k.m.Lock()
+	defer k.m.Unlock()
+	k.expire(key)
+	if _, ok := k.data[key]; ok {
+		return false
+	}
+
+	k.data[key] = value
+	if lifeTime > 0 {
+		k.expireTimes[key] = time.Now().Add(lifeTime)
+	} else {
+		delete(k.expireTimes, key)
+	}
+	return true
+}
+
+func (k *memCache) del(key string) error {
+	k.m.Lock()
+	defer k.m.Unlock()
+	delete(k.data, key)
+	delete(k.expireTimes, key)
+	return nil
+}
+
+func (k *memCache) incr(key string) (int64, error) {
+	k.m.Lock()
+	defer k.m.Unlock()
+	k.expire(key)
+
+	var n int64
+	if v, ok := k.data[key]; ok {
+		var err error
+		n, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+	} else if k.valueLifeTime > 0 {
+		k.expireTimes[key] = time.Now().Add(k.valueLifeTime)
+	}
+
+	n++
+	k.data[key] = strconv.FormatInt(n, 10)
+	return n, nil
+}
+
+// expire removes the key if it has expired, must be called with the lock held
+func (k *memCache) expire(key string) {
+	t, ok := k.expireTimes[key]
+	if ok && time.Now().After(t) {
+		delete(k.data, key)
+		delete(k.expireTimes, key)
+	}
+}
+
+// newMemCache creates a cache in memory, the values expire after the life time if it's not zero, same as redis
+func newMemCache(valueLifeTime time.Duration) kvCache {
 	k := new(memCache)
 	k.init()
+	k.valueLifeTime = valueLifeTime
 	return k
 }
 
@@ -146,6 +225,35 @@ func (r *redisCache) exists(key string) bool {
 	return r.client.Exists(modKey).Val()
 }
 
+func (r *redisCache) setNX(key, value string, lifeTime time.Duration) bool {
+	modKey := r.getKey(key)
+	ok, err := r.client.SetNX(modKey, value, lifeTime).Result()
+	logError(err)
+	return ok
+}
+
+func (r *redisCache) del(key string) error {
+	modKey := r.getKey(key)
+	err := r.client.Del(modKey).Err()
+	logError(err)
+	return err
+}
+
+func (r *redisCache) incr(key string) (int64, error) {
+	modKey := r.getKey(key)
+	n, err := r.client.Incr(modKey).Result()
+	if err != nil {
+		logError(err)
+		return 0, err
+	}
+
+	if n == 1 && r.valueLifeTime > 0 {
+		err = r.client.Expire(modKey, r.valueLifeTime).Err()
+		logError(err)
+	}
+	return n, err
+}
+
 func newRedisCache(address, keyPrefix string, valueLifeTime time.Duration) kvCache {
 	r := new(redisCache)
 	r.init(address, keyPrefix, valueLifeTime)
@@ -0,0 +1,88 @@
+// Command wechat-mock runs the fake wechat api server standalone, for developing the server offline.
+//
+// Point the server to it with WECHAT_API_BASE_URL and WECHAT_OPEN_BASE_URL, e.g.
+//
+//	wechat-mock -addr :8081 -users users.json
+//	WECHAT_API_BASE_URL=http://localhost:8081 WECHAT_OPEN_BASE_URL=http://localhost:8081 wechat-server
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"github.com/haowang1013/wechat-server/wechat"
+	"github.com/haowang1013/wechat-server/wechat/wechattest"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+)
+
+func main() {
+	addr := flag.String("addr", ":8081", "address to listen on")
+	appID := flag.String("app-id", os.Getenv("WECHAT_APP_ID"), "app id of the official account")
+	appSecret := flag.String("app-secret", os.Getenv("WECHAT_APP_SECRET"), "app secret of the official account")
+	openAppID := flag.String("open-app-id", os.Getenv("WECHAT_OPEN_APP_ID"), "app id of the open platform website app, optional")
+	openAppSecret := flag.String("open-app-secret", os.Getenv("WECHAT_OPEN_APP_SECRET"), "app secret of the open platform website app")
+	usersPath := flag.String("users", "", "json file with an array of user info, a demo user is added if not set")
+	authorizeUser := flag.String("authorize-user", "", "open id of the user approving the authorization pages, defaults to the first user")
+	flag.Parse()
+
+	if len(*appID) == 0 || len(*appSecret) == 0 {
+		log.Fatal("app id and app secret are required, set them with -app-id and -app-secret")
+	}
+
+	s := wechattest.New(*appID, *appSecret)
+	if len(*openAppID) > 0 {
+		s.AddApp(*openAppID, *openAppSecret)
+	}
+
+	users, err := loadUsers(*usersPath)
+	if err != nil {
+		log.Fatalf("failed to load users from '%s': %s", *usersPath, err)
+	}
+
+	for _, u := range users {
+		s.AddUser(u)
+	}
+
+	if len(*authorizeUser) > 0 {
+		s.SetAuthorizeUser(*authorizeUser)
+	}
+
+	log.Printf("fake wechat api for app %s with %d users listening on %s", *appID, len(users), *addr)
+	log.Fatal(http.ListenAndServe(*addr, logRequests(s)))
+}
+
+func loadUsers(path string) ([]wechat.UserInfo, error) {
+	if len(path) == 0 {
+		return []wechat.UserInfo{
+			{
+				Subscribed: 1,
+				OpenID:     "mock-openid",
+				NickName:   "mock user",
+				Gender:     1,
+				City:       "Shanghai",
+				Country:    "China",
+				Province:   "Shanghai",
+				Language:   "zh_CN",
+				UnionID:    "mock-unionid",
+			},
+		}, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []wechat.UserInfo
+	err = json.Unmarshal(b, &users)
+	return users, err
+}
+
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s", r.Method, r.URL.Path)
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultDatabaseDriver = "sqlite3"
+	defaultDatabaseDSN    = "wechat.db"
+
+	postgresDatabaseDriver = "postgres"
+)
+
+// openDatabase opens the database shared by the persistent stores
+func openDatabase(driver, dsn string) (*sql.DB, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to %s database '%s': %s", driver, dsn, err)
+	}
+
+	// sqlite doesn't allow concurrent writes
+	if driver == "sqlite3" {
+		db.SetMaxOpenConns(1)
+	}
+	return db, nil
+}
+
+// checkDatabaseDriver makes sure the stores can work with the driver
+func checkDatabaseDriver(driver string) error {
+	if driver != defaultDatabaseDriver && driver != postgresDatabaseDriver {
+		return fmt.Errorf("database driver '%s' not supported, must be %s or %s", driver, defaultDatabaseDriver, postgresDatabaseDriver)
+	}
+	return nil
+}
+
+// sqlStore is embedded by the stores in a database, the queries are written with the ? placeholders of sqlite
+// and rebound for the driver. The schemas only use the types known by both sqlite and postgres
+type sqlStore struct {
+	db     *sql.DB
+	driver string
+}
+
+// rebind replaces the ? placeholders with the numbered ones of postgres
+func (s *sqlStore) rebind(query string) string {
+	if s.driver != postgresDatabaseDriver {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func createTables(db *sql.DB, schemas []string) error {
+	for _, schema := range schemas {
+		_, err := db.Exec(schema)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
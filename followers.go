@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/haowang1013/wechat-server/wechat"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFollowerQueryLimit = 100
+	maxFollowerQueryLimit     = 1000
+)
+
+var (
+	followers followerStore
+
+	followerSchemas = []string{
+		`CREATE TABLE IF NOT EXISTS followers (
+			openid TEXT PRIMARY KEY,
+			unionid TEXT NOT NULL DEFAULT '',
+			subscribed BOOLEAN NOT NULL,
+			subscribe_time BIGINT NOT NULL,
+			unsubscribe_time BIGINT NOT NULL DEFAULT 0,
+			info TEXT NOT NULL,
+			sync_time BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS followers_unionid ON followers (unionid)`,
+		`CREATE INDEX IF NOT EXISTS followers_subscribe_time ON followers (subscribe_time)`,
+		`CREATE TABLE IF NOT EXISTS follower_tags (
+			openid TEXT NOT NULL,
+			tagid INTEGER NOT NULL,
+			PRIMARY KEY (openid, tagid)
+		)`,
+		`CREATE INDEX IF NOT EXISTS follower_tags_tagid ON follower_tags (tagid)`,
+	}
+)
+
+type follower struct {
+	OpenID          string           `json:"openid"`
+	UnionID         string           `json:"unionid"`
+	Subscribed      bool             `json:"subscribed"`
+	SubscribeTime   int64            `json:"subscribe_time"`
+	UnsubscribeTime int64            `json:"unsubscribe_time"`
+	Info            *wechat.UserInfo `json:"info"`
+	SyncTime        int64            `json:"sync_time"`
+}
+
+func newFollower(u *wechat.UserInfo, syncTime int64) *follower {
+	f := new(follower)
+	f.OpenID = u.OpenID
+	f.UnionID = u.UnionID
+	f.Subscribed = u.Subscribed == 1
+	f.SubscribeTime = int64(u.SubscribeTime)
+	f.Info = u
+	f.SyncTime = syncTime
+	return f
+}
+
+// followerQuery filters the followers, zero values are ignored
+type followerQuery struct {
+	UnionID          string
+	TagID            int
+	HasTag           bool
+	SubscribedAfter  int64
+	SubscribedBefore int64
+	Offset           int
+	Limit            int
+}
+
+// followerStore persists the followers of the official account
+type followerStore interface {
+	save(f *follower) error
+	unsubscribe(openID string, unsubscribeTime int64) error
+	get(openID string) (*follower, bool, error)
+	query(q *followerQuery) ([]*follower, error)
+
+	// unsubscribeStale marks followers not seen since the sync time as unsubscribed
+	unsubscribeStale(syncTime int64) (int64, error)
+}
+
+/**
+* sql follower store
+ */
+type sqlFollowerStore struct {
+	sqlStore
+}
+
+func (s *sqlFollowerStore) save(f *follower) error {
+	info, err := json.Marshal(f.Info)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(s.rebind(`INSERT INTO followers (openid, unionid, subscribed, subscribe_time, unsubscribe_time, info, sync_time)
+		VALUES (?, ?, ?, ?, 0, ?, ?)
+		ON CONFLICT (openid) DO UPDATE SET
+			unionid = excluded.unionid,
+			subscribed = excluded.subscribed,
+			subscribe_time = excluded.subscribe_time,
+			info = excluded.info,
+			sync_time = excluded.sync_time`),
+		f.OpenID, f.UnionID, f.Subscribed, f.SubscribeTime, string(info), f.SyncTime)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(s.rebind(`DELETE FROM follower_tags WHERE openid = ?`), f.OpenID)
+	if err != nil {
+		return err
+	}
+
+	if f.Info != nil {
+		for _, tagID := range f.Info.TagIDList {
+			_, err = tx.Exec(s.rebind(`INSERT INTO follower_tags (openid, tagid) VALUES (?, ?)`), f.OpenID, tagID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlFollowerStore) unsubscribe(openID string, unsubscribeTime int64) error {
+	_, err := s.db.Exec(s.rebind(`UPDATE followers SET subscribed = ?, unsubscribe_time = ? WHERE openid = ?`), false, unsubscribeTime, openID)
+	return err
+}
+
+func (s *sqlFollowerStore) get(openID string) (*follower, bool, error) {
+	result, err := s.scan(s.db.Query(s.rebind(`SELECT openid, unionid, subscribed, subscribe_time, unsubscribe_time, info, sync_time
+		FROM followers WHERE openid = ?`), openID))
+	if err != nil || len(result) == 0 {
+		return nil, false, err
+	}
+	return result[0], true, nil
+}
+
+func (s *sqlFollowerStore) query(q *followerQuery) ([]*follower, error) {
+	var conditions []string
+	var args []interface{}
+
+	if len(q.UnionID) > 0 {
+		conditions = append(conditions, "unionid = ?")
+		args = append(args, q.UnionID)
+	}
+
+	if q.HasTag {
+		conditions = append(conditions, "openid IN (SELECT openid FROM follower_tags WHERE tagid = ?)")
+		args = append(args, q.TagID)
+	}
+
+	if q.SubscribedAfter > 0 {
+		conditions = append(conditions, "subscribe_time >= ?")
+		args = append(args, q.SubscribedAfter)
+	}
+
+	if q.SubscribedBefore > 0 {
+		conditions = append(conditions, "subscribe_time < ?")
+		args = append(args, q.SubscribedBefore)
+	}
+
+	query := `SELECT openid, unionid, subscribed, subscribe_time, unsubscribe_time, info, sync_time FROM followers`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY subscribe_time DESC, openid LIMIT ? OFFSET ?"
+	args = append(args, q.Limit, q.Offset)
+
+	return s.scan(s.db.Query(s.rebind(query), args...))
+}
+
+func (s *sqlFollowerStore) unsubscribeStale(syncTime int64) (int64, error) {
+	result, err := s.db.Exec(s.rebind(`UPDATE followers SET subscribed = ?, unsubscribe_time = ? WHERE subscribed = ? AND sync_time < ?`),
+		false, syncTime, true, syncTime)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *sqlFollowerStore) scan(rows *sql.Rows, err error) ([]*follower, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*follower
+	for rows.Next() {
+		var info string
+		f := new(follower)
+		err = rows.Scan(&f.OpenID, &f.UnionID, &f.Subscribed, &f.SubscribeTime, &f.UnsubscribeTime, &info, &f.SyncTime)
+		if err != nil {
+			return nil, err
+		}
+
+		f.Info = new(wechat.UserInfo)
+		err = json.Unmarshal([]byte(info), f.Info)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, f)
+	}
+	return result, rows.Err()
+}
+
+func newSqlFollowerStore(db *sql.DB, driver string) (followerStore, error) {
+	err := createTables(db, followerSchemas)
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(sqlFollowerStore)
+	s.db = db
+	s.driver = driver
+	return s, nil
+}
+
+/**
+* follower sync
+ */
+var (
+	followerSyncLock sync.Mutex
+)
+
+// startFollowerSync syncs the followers in the background, returns false if a sync is already running
+func startFollowerSync(store followerStore) bool {
+	if !followerSyncLock.TryLock() {
+		return false
+	}
+
+	go func() {
+		defer followerSyncLock.Unlock()
+		_, err := syncFollowers(context.Background(), store)
+		if err != nil {
+			log.Errorf("failed to sync followers: %s", err)
+		}
+	}()
+	return true
+}
+
+// syncFollowers walks through all the followers on wechat and saves their latest info,
+// followers not found are marked as unsubscribed
+func syncFollowers(ctx context.Context, store followerStore) (int, error) {
+	syncTime := time.Now().Unix()
+	count := 0
+	next := ""
+	for {
+		token, err := server.AccessToken(ctx)
+		if err != nil {
+			return count, err
+		}
+
+		list, err := wechat.GetFollowers(ctx, token, next)
+		if err != nil {
+			return count, err
+		}
+
+		openIDs := list.Data.OpenIDs
+		for len(openIDs) > 0 {
+			n := len(openIDs)
+			if n > wechat.MaxBatchUserInfo {
+				n = wechat.MaxBatchUserInfo
+			}
+
+			users, err := wechat.BatchGetUserInfo(ctx, token, openIDs[:n])
+			if err != nil {
+				return count, err
+			}
+
+			for i := range users {
+				err = store.save(newFollower(&users[i], syncTime))
+				if err != nil {
+					return count, err
+				}
+			}
+
+			count += len(users)
+			openIDs = openIDs[n:]
+		}
+
+		next = list.NextOpenID
+		if list.Count == 0 || len(next) == 0 {
+			break
+		}
+	}
+
+	stale, err := store.unsubscribeStale(syncTime)
+	if err != nil {
+		return count, err
+	}
+
+	logFor(ctx).Infof("synced %d followers, %d followers are no longer subscribed", count, stale)
+	return count, nil
+}
+
+// runFollowerSync syncs the followers periodically
+func runFollowerSync(store followerStore, interval time.Duration) {
+	for {
+		startFollowerSync(store)
+		time.Sleep(interval)
+	}
+}
+
+// updateFollowerAsync refreshes the follower in the background when the user subscribes
+func updateFollowerAsync(store followerStore, openID string) {
+	go func() {
+		ctx := context.Background()
+		token, err := server.AccessToken(ctx)
+		if err != nil {
+			return
+		}
+
+		u, err := wechat.GetUserInfo(ctx, token, openID)
+		if err != nil {
+			log.Errorf("failed to get user info of follower '%s': %s", openID, err)
+			return
+		}
+
+		err = store.save(newFollower(u, time.Now().Unix()))
+		if err != nil {
+			log.Errorf("failed to save follower '%s': %s", openID, err)
+		}
+	}()
+}
+
+/**
+* admin endpoints
+ */
+func followerQueryHandler(c *gin.Context) {
+	q := new(followerQuery)
+	q.UnionID = c.Query("unionid")
+
+	var err error
+	if s := c.Query("tag"); len(s) > 0 {
+		q.HasTag = true
+		q.TagID, err = strconv.Atoi(s)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid tag '%s'", s)
+			return
+		}
+	}
+
+	q.SubscribedAfter, err = parseTimeQuery(c, "subscribed_after")
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	q.SubscribedBefore, err = parseTimeQuery(c, "subscribed_before")
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	q.Offset, err = parseIntQuery(c, "offset", 0, 0, math.MaxInt32)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	q.Limit, err = parseIntQuery(c, "limit", defaultFollowerQueryLimit, 1, maxFollowerQueryLimit)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := followers.query(q)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if result == nil {
+		result = []*follower{}
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"followers": result,
+		"offset":    q.Offset,
+		"count":     len(result),
+	})
+}
+
+func followerGetHandler(openID string, c *gin.Context) {
+	f, ok, err := followers.get(openID)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if !ok {
+		c.String(http.StatusNotFound, "follower not found")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, f)
+}
+
+func followerSyncHandler(c *gin.Context) {
+	if !startFollowerSync(followers) {
+		c.String(http.StatusConflict, "follower sync is already running")
+		return
+	}
+	c.String(http.StatusAccepted, "follower sync started")
+}
+
+// parseTimeQuery accepts either a unix timestamp or a RFC3339 time
+func parseTimeQuery(c *gin.Context, name string) (int64, error) {
+	s := c.Query(name)
+	if len(s) == 0 {
+		return 0, nil
+	}
+
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return v, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s '%s', must be a unix timestamp or RFC3339 time", name, s)
+	}
+	return t.Unix(), nil
+}
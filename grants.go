@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/haowang1013/wechat-server/wechat"
+)
+
+const (
+	grantKeyPrefix = "grant."
+)
+
+// grantStore persists web grants in the kv cache, keyed by the user's open id
+type grantStore struct {
+	cache kvCache
+}
+
+func (g *grantStore) SaveGrant(grant *wechat.WebGrant) error {
+	return setJson(g.cache, grantKeyPrefix+grant.Token.OpenID, grant)
+}
+
+func (g *grantStore) LoadGrant(openID string) (*wechat.WebGrant, bool) {
+	value, ok := getJson(g.cache, grantKeyPrefix+openID, func() interface{} {
+		return new(wechat.WebGrant)
+	})
+
+	grant, _ := value.(*wechat.WebGrant)
+	return grant, ok && grant != nil
+}
+
+func newGrantStore(cache kvCache) *grantStore {
+	g := new(grantStore)
+	g.cache = cache
+	return g
+}
@@ -5,30 +5,58 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/haowang1013/wechat-server/wechat"
 	"net/http"
-	"net/url"
 	"strings"
+	"time"
 )
 
 type handler struct {
 }
 
 func (h *handler) HandleText(m *wechat.UserTextMessage, c *gin.Context) {
+	if transferToHuman(m, m.Content, c) {
+		return
+	}
 	m.ReplyText(c, fmt.Sprintf("You said '%s'", m.Content))
 }
 
 func (h *handler) HandleImage(m *wechat.UserImageMessage, c *gin.Context) {
+	if archive != nil {
+		archive.archiveAsync(m, m.MediaId)
+	}
+
+	if transferToHuman(m, "", c) {
+		return
+	}
 	m.ReplyText(c, fmt.Sprintf("Image uploaded to %s", m.PicUrl))
 }
 
 func (h *handler) HandleVoice(m *wechat.UserVoiceMessage, c *gin.Context) {
+	if archive != nil {
+		archive.archiveAsync(m, m.MediaId)
+	}
+
+	if transferToHuman(m, "", c) {
+		return
+	}
 	m.ReplyText(c, "Thank you for sending a voice message")
 }
 
 func (h *handler) HandleVideo(m *wechat.UserVideoMessage, c *gin.Context) {
+	if archive != nil {
+		archive.archiveAsync(m, m.MediaID)
+		archive.archiveAsync(m, m.ThumbMediaId)
+	}
+
+	if transferToHuman(m, "", c) {
+		return
+	}
 	m.ReplyText(c, "Thank you for sending a video message")
 }
 
 func (h *handler) HandleLink(m *wechat.UserLinkMessage, c *gin.Context) {
+	if transferToHuman(m, "", c) {
+		return
+	}
 	m.ReplyText(c, "Thank you for sending a link message")
 }
 
@@ -36,108 +64,274 @@ func (h *handler) HandleEvent(event wechat.UserEvent, c *gin.Context) {
 	et := event.EventType()
 	switch et {
 	case "subscribe":
-		log.Debugf("new follower: %s", event.From())
+		logFor(c.Request.Context()).Debugf("new follower: %s", event.From())
+		if followers != nil {
+			updateFollowerAsync(followers, event.From())
+		}
+		if se, ok := event.(*wechat.SceneEvent); ok && len(se.Scene()) > 0 {
+			logFor(c.Request.Context()).Infof("%s followed from scene '%s'", event.From(), se.Scene())
+			if handleScanLogin(se, c) {
+				return
+			}
+		}
 		event.ReplyText(c, "Welcome!")
+	case "SCAN":
+		se := event.(*wechat.SceneEvent)
+		logFor(c.Request.Context()).Infof("%s scanned scene '%s'", event.From(), se.Scene())
+		if !handleScanLogin(se, c) {
+			c.String(http.StatusOK, "")
+		}
 	case "unsubscribe":
-		log.Debugf("%s unsubscribed", event.From())
+		logFor(c.Request.Context()).Debugf("%s unsubscribed", event.From())
+		if followers != nil {
+			err := followers.unsubscribe(event.From(), time.Now().Unix())
+			logError(err)
+		}
+		c.String(http.StatusOK, "")
+	case "kf_create_session", "kf_close_session", "kf_switch_session":
+		handleKfSessionEvent(event.(*wechat.KfSessionEvent))
+		c.String(http.StatusOK, "")
+	case "MASSSENDJOBFINISH":
+		if broadcasts != nil {
+			finishBroadcast(broadcasts, event.(*wechat.MassSendJobFinishEvent))
+		}
 		c.String(http.StatusOK, "")
 	default:
-		log.Errorf("unknown event type: %s", et)
+		logFor(c.Request.Context()).Errorf("unknown event type: %s", et)
 		c.String(http.StatusOK, "")
 	}
 }
 
 func (h *handler) HandleWebLogin(u *wechat.UserInfo, uuid string, c *gin.Context) {
-	log.Debugf("%+v logged in with uuid '%s'", u, uuid)
-	value, ok := getJson(cache, uuid, func() interface{} {
-		return new(wechat.UserInfo)
-	})
+	h.HandleLogin(u, wechat.OfficialAccountLogin, uuid, c)
+}
 
+func (h *handler) HandleLogin(u *wechat.UserInfo, provider, uuid string, c *gin.Context) {
+	logFor(c.Request.Context()).Debugf("%+v logged in with uuid '%s'", u, uuid)
+	session, ok := getWebLoginSession(provider, uuid, c)
 	if !ok {
-		log.Errorf("invalid uuid from web login: '%s'", uuid)
-		c.String(http.StatusBadRequest, "Invalid UUID")
 		return
 	}
 
-	existing, _ := value.(*wechat.UserInfo)
-	if existing != nil && existing.OpenID != u.OpenID {
-		log.Errorf("user '%s' has logged in with uuid '%s', current user '%s' is rejected", existing.OpenID, uuid, u.OpenID)
+	// a reload of the callback page doesn't count as another scan
+	if session.User == nil {
+		observeLogin(session.Provider, loginScanned)
+	}
+
+	err := completeLogin(c.Request.Context(), uuid, session, u)
+	if err == errLoginTaken {
 		c.String(http.StatusBadRequest, "UUID expired")
 		return
 	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
 
-	setJson(cache, uuid, u)
 	c.HTML(http.StatusOK, "wechat_welcome.html", gin.H{
 		"message": "欢迎登陆",
 	})
 }
 
+func (h *handler) HandleLoginDenied(provider, uuid string, c *gin.Context) {
+	logFor(c.Request.Context()).Debugf("web login denied with uuid '%s'", uuid)
+	session, ok := getWebLoginSession(provider, uuid, c)
+	if !ok {
+		return
+	}
+
+	if session.User == nil {
+		_, span := startLinkedSpan(c.Request.Context(), "login.deny", session.TraceParent)
+		session.Denied = true
+		setJson(cache, uuid, session)
+		observeLogin(session.Provider, loginDenied)
+		span.End()
+	}
+	c.HTML(http.StatusOK, "wechat_welcome.html", gin.H{
+		"message": "登陆已取消",
+	})
+}
+
+// getWebLoginSession returns the session of the uuid if it's created for the provider of the callback,
+// so that e.g. a website login can't be completed with the user of the official account.
+// The login is counted as expired if the uuid is gone
+func getWebLoginSession(provider, uuid string, c *gin.Context) (*loginSession, bool) {
+	session, ok := getLoginSession(uuid)
+	if !ok {
+		observeLogin(provider, loginExpired)
+		logFor(c.Request.Context()).Errorf("invalid uuid from web login: '%s'", uuid)
+		c.String(http.StatusBadRequest, "Invalid UUID")
+		return nil, false
+	}
+
+	if session.Provider != provider {
+		logFor(c.Request.Context()).Errorf("uuid '%s' of %s login used by %s login", uuid, session.Provider, provider)
+		c.String(http.StatusBadRequest, "UUID not created for %s login", provider)
+		return nil, false
+	}
+	return session, true
+}
+
 func loginRequestHandler(c *gin.Context) {
-	uid := newUUID()
-	for ; cache.exists(uid); uid = newUUID() {
+	name := c.DefaultQuery("provider", officialAccountProvider)
+	if name == scanProvider {
+		scanLoginRequestHandler(c)
+		return
 	}
-	setJson(cache, uid, nil)
 
-	redirectUrl := makeSimpleUrl(
+	provider := loginProviders[name]
+	if provider == nil {
+		c.String(http.StatusBadRequest, "login provider '%s' not supported", name)
+		return
+	}
+
+	uid := newLoginUUID()
+	setJson(cache, uid, newLoginSession(c.Request.Context(), provider.name))
+	observeLogin(provider.name, loginCreated)
+
+	loginUrl := provider.loginUrl(c.Request.Host, uid)
+
+	queryUrl := makeSimpleUrl(
 		"http",
 		c.Request.Host,
-		webLoginUrl).String()
-
-	wechatUrl := makeUrl(
-		"https",
-		"open.weixin.qq.com",
-		"/connect/oauth2/authorize",
-		map[string]string{
-			"appid":         appID,
-			"redirect_uri":  redirectUrl,
-			"response_type": "code",
-			"scope":         "snsapi_userinfo",
-			"state":         uid,
-		},
-		"wechat_redirect").String()
-
-	qrUrl := makeUrl(
+		strings.Replace(loginQueryUrl, ":uuid", uid, 1)).String()
+
+	resp := map[string]string{
+		"uuid":         uid,
+		"app_id":       provider.appID,
+		"provider":     provider.name,
+		"query_url":    queryUrl,
+		"login_url":    loginUrl,
+		"redirect_url": provider.redirectUrl(c.Request.Host),
+	}
+
+	if provider.qrcode {
+		resp["qrcode_url"] = makeSimpleUrl(
+			"http",
+			c.Request.Host,
+			strings.Replace(qrcodeUrl, ":str", signQRPayload(loginUrl, loginSessionLifeTime), 1)).String()
+	}
+
+	c.IndentedJSON(http.StatusCreated, resp)
+}
+
+// scanLoginRequestHandler creates a login whose uuid is carried by a parametric qr code,
+// the login completes when the user scans it and the subscribe or SCAN event arrives
+func scanLoginRequestHandler(c *gin.Context) {
+	token, err := server.AccessToken(c.Request.Context())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	uid := newLoginUUID()
+	ticket, err := wechat.CreateTempQRCode(c.Request.Context(), token, uid, int(loginSessionLifeTime/time.Second))
+	if err != nil {
+		logFor(c.Request.Context()).Errorf("failed to create login qr code: %s", err)
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	setJson(cache, uid, newLoginSession(c.Request.Context(), scanProvider))
+	observeLogin(scanProvider, loginCreated)
+
+	queryUrl := makeSimpleUrl(
 		"http",
 		c.Request.Host,
-		strings.Replace(qrcodeUrl, ":str", url.QueryEscape(wechatUrl), 1),
-		map[string]string{
-			"unescape": "true",
-		},
-		"").String()
+		strings.Replace(loginQueryUrl, ":uuid", uid, 1)).String()
 
-	queryUrl := makeSimpleUrl(
+	qrUrl := makeSimpleUrl(
 		"http",
 		c.Request.Host,
-		strings.Replace(loginUrl, ":uuid", uid, 1)).String()
+		strings.Replace(qrcodeUrl, ":str", signQRPayload(ticket.Url, loginSessionLifeTime), 1)).String()
 
 	resp := map[string]string{
-		"uuid":       uid,
-		"app_id":     appID,
-		"query_url":  queryUrl,
-		"qrcode_url": qrUrl,
+		"uuid":              uid,
+		"app_id":            appID,
+		"provider":          scanProvider,
+		"query_url":         queryUrl,
+		"qrcode_url":        qrUrl,
+		"wechat_qrcode_url": wechat.QRCodeImageUrl(ticket.Ticket),
 	}
 
 	c.IndentedJSON(http.StatusCreated, resp)
 }
 
+// handleScanLogin completes the scan login if the scene is a pending login uuid, returns false otherwise
+func handleScanLogin(e *wechat.SceneEvent, c *gin.Context) bool {
+	uuid := e.Scene()
+	session, ok := getLoginSession(uuid)
+	if !ok || session.Provider != scanProvider {
+		return false
+	}
+	if session.User == nil {
+		observeLogin(scanProvider, loginScanned)
+	}
+
+	token, err := server.AccessToken(c.Request.Context())
+	if err != nil {
+		e.ReplyText(c, "登陆失败，请重试")
+		return true
+	}
+
+	user, err := wechat.GetUserInfo(c.Request.Context(), token, e.From())
+	if err != nil {
+		logFor(c.Request.Context()).Errorf("failed to get user info of '%s': %s", e.From(), err)
+		e.ReplyText(c, "登陆失败，请重试")
+		return true
+	}
+
+	logFor(c.Request.Context()).Debugf("%+v logged in with uuid '%s'", user, uuid)
+	err = completeLogin(c.Request.Context(), uuid, session, user)
+	if err == errLoginTaken {
+		e.ReplyText(c, "二维码已失效")
+		return true
+	}
+	if err != nil {
+		e.ReplyText(c, "登陆失败，请重试")
+		return true
+	}
+
+	e.ReplyText(c, "欢迎登陆")
+	return true
+}
+
 func loginQueryHandler(uuid string, c *gin.Context) {
-	user, ok := getJson(cache, uuid, func() interface{} {
-		return new(wechat.UserInfo)
-	})
+	session, ok := getLoginSession(uuid)
 	if !ok {
 		c.String(http.StatusNotFound, "uuid not found")
 		return
 	}
 
-	if user == nil {
+	if session.Denied {
+		c.String(http.StatusForbidden, "uuid login denied")
+		return
+	}
+
+	if session.User == nil {
 		c.String(http.StatusNotFound, "uuid not logged in")
 		return
 	}
 
-	resp := map[string]interface{}{
-		"user":   user,
-		"uuid":   uuid,
-		"app_id": appID,
+	c.IndentedJSON(http.StatusOK, loginResult(uuid, session))
+}
+
+// loginResult is the response of a completed login
+func loginResult(uuid string, session *loginSession) map[string]interface{} {
+	// scan login is done with the official account
+	sessionAppID := appID
+	if provider := loginProviders[session.Provider]; provider != nil {
+		sessionAppID = provider.appID
+	} else if session.Provider == miniProgramProvider {
+		sessionAppID = miniProgramAppID
+	}
+
+	account := linkAccount(session.Provider, session.User)
+	return map[string]interface{}{
+		"user":     session.User,
+		"uuid":     uuid,
+		"app_id":   sessionAppID,
+		"provider": session.Provider,
+		"union_id": account.UnionID,
+		"accounts": account.OpenIDs,
 	}
-	c.IndentedJSON(http.StatusOK, resp)
 }
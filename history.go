@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/haowang1013/wechat-server/wechat"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHistoryQueryLimit = 100
+	maxHistoryQueryLimit     = 1000
+
+	// the messages are exported in pages so the database isn't held while the response is written
+	historyExportPageSize = 1000
+
+	historyPurgeInterval = time.Hour
+)
+
+// the directions and the kinds of the messages in the history
+const (
+	historyIn  = "in"
+	historyOut = "out"
+
+	historyMessageKind = "message"
+	historyEventKind   = "event"
+	historyReplyKind   = "reply"
+	historyCustomKind  = "custom"
+)
+
+var (
+	history historyStore
+)
+
+// historyMessage is a message in the conversation between a follower and the official account,
+// the content is the text of the message or what identifies it, e.g. the media id
+type historyMessage struct {
+	ID         int64  `json:"id"`
+	OpenID     string `json:"openid"`
+	Direction  string `json:"direction"`
+	Kind       string `json:"kind"`
+	MsgType    string `json:"msg_type"`
+	Event      string `json:"event,omitempty"`
+	MsgID      int64  `json:"msg_id,omitempty"`
+	Content    string `json:"content"`
+	Raw        string `json:"raw,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+	CreateTime int64  `json:"create_time"`
+}
+
+// historyQuery filters the messages, zero values are ignored
+type historyQuery struct {
+	OpenID    string
+	Text      string
+	Direction string
+	Since     int64
+	Until     int64
+	Offset    int
+	Limit     int
+}
+
+// historyStore persists the conversations with the followers
+type historyStore interface {
+	add(m *historyMessage) error
+
+	// query returns the messages matching the query, the latest first
+	query(q *historyQuery) ([]*historyMessage, error)
+
+	// export calls fn with all the messages matching the query in the order they're sent, offset and limit are ignored
+	export(q *historyQuery, fn func(m *historyMessage) error) error
+
+	// purge removes the messages sent before the time
+	purge(before int64) (int64, error)
+}
+
+/**
+* sql history store
+ */
+type sqlHistoryStore struct {
+	sqlStore
+}
+
+func historySchemas(driver string) []string {
+	id := "INTEGER PRIMARY KEY AUTOINCREMENT"
+	if driver == postgresDatabaseDriver {
+		id = "BIGSERIAL PRIMARY KEY"
+	}
+
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS history (
+			id %s,
+			openid TEXT NOT NULL,
+			direction TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			msg_type TEXT NOT NULL,
+			event TEXT NOT NULL DEFAULT '',
+			msg_id BIGINT NOT NULL DEFAULT 0,
+			content TEXT NOT NULL,
+			raw TEXT NOT NULL,
+			request_id TEXT NOT NULL DEFAULT '',
+			create_time BIGINT NOT NULL
+		)`, id),
+		`CREATE INDEX IF NOT EXISTS history_openid_create_time ON history (openid, create_time)`,
+		`CREATE INDEX IF NOT EXISTS history_create_time ON history (create_time)`,
+	}
+}
+
+func (s *sqlHistoryStore) add(m *historyMessage) error {
+	_, err := s.db.Exec(s.rebind(`INSERT INTO history (openid, direction, kind, msg_type, event, msg_id, content, raw, request_id, create_time)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		m.OpenID, m.Direction, m.Kind, m.MsgType, m.Event, m.MsgID, m.Content, m.Raw, m.RequestID, m.CreateTime)
+	return err
+}
+
+func (s *sqlHistoryStore) conditions(q *historyQuery) ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if len(q.OpenID) > 0 {
+		conditions = append(conditions, "openid = ?")
+		args = append(args, q.OpenID)
+	}
+
+	if len(q.Text) > 0 {
+		conditions = append(conditions, `LOWER(content) LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(strings.ToLower(q.Text))+"%")
+	}
+
+	if len(q.Direction) > 0 {
+		conditions = append(conditions, "direction = ?")
+		args = append(args, q.Direction)
+	}
+
+	if q.Since > 0 {
+		conditions = append(conditions, "create_time >= ?")
+		args = append(args, q.Since)
+	}
+
+	if q.Until > 0 {
+		conditions = append(conditions, "create_time < ?")
+		args = append(args, q.Until)
+	}
+	return conditions, args
+}
+
+func (s *sqlHistoryStore) query(q *historyQuery) ([]*historyMessage, error) {
+	conditions, args := s.conditions(q)
+
+	query := `SELECT id, openid, direction, kind, msg_type, event, msg_id, content, raw, request_id, create_time FROM history`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY create_time DESC, id DESC LIMIT ? OFFSET ?"
+	args = append(args, q.Limit, q.Offset)
+
+	return s.scan(s.db.Query(s.rebind(query), args...))
+}
+
+func (s *sqlHistoryStore) export(q *historyQuery, fn func(m *historyMessage) error) error {
+	var lastID int64
+	for {
+		conditions, args := s.conditions(q)
+		conditions = append(conditions, "id > ?")
+		args = append(args, lastID, historyExportPageSize)
+
+		query := `SELECT id, openid, direction, kind, msg_type, event, msg_id, content, raw, request_id, create_time FROM history
+			WHERE ` + strings.Join(conditions, " AND ") + " ORDER BY id LIMIT ?"
+		page, err := s.scan(s.db.Query(s.rebind(query), args...))
+		if err != nil {
+			return err
+		}
+
+		for _, m := range page {
+			err = fn(m)
+			if err != nil {
+				return err
+			}
+			lastID = m.ID
+		}
+
+		if len(page) < historyExportPageSize {
+			return nil
+		}
+	}
+}
+
+func (s *sqlHistoryStore) purge(before int64) (int64, error) {
+	result, err := s.db.Exec(s.rebind(`DELETE FROM history WHERE create_time < ?`), before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *sqlHistoryStore) scan(rows *sql.Rows, err error) ([]*historyMessage, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*historyMessage
+	for rows.Next() {
+		m := new(historyMessage)
+		err = rows.Scan(&m.ID, &m.OpenID, &m.Direction, &m.Kind, &m.MsgType, &m.Event, &m.MsgID, &m.Content, &m.Raw, &m.RequestID, &m.CreateTime)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+	return result, rows.Err()
+}
+
+func newSqlHistoryStore(db *sql.DB, driver string) (historyStore, error) {
+	err := createTables(db, historySchemas(driver))
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(sqlHistoryStore)
+	s.db = db
+	s.driver = driver
+	return s, nil
+}
+
+// escapeLike escapes the wildcards of LIKE so the text is matched as it is
+func escapeLike(text string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(text)
+}
+
+/**
+* message recorder
+ */
+
+// historyRecorder records the messages of the wechat server and the customer service messages in the store
+type historyRecorder struct {
+	store historyStore
+}
+
+func (r *historyRecorder) RecordMessage(ctx context.Context, m wechat.UserMessage, raw []byte) {
+	h := newHistoryMessage(ctx, m.From(), historyIn, historyMessageKind, m.MessageType(), raw)
+	h.MsgID = m.MessageID()
+	h.Content = messageContent(m)
+	if e, ok := m.(wechat.UserEvent); ok {
+		h.Kind = historyEventKind
+		h.Event = e.EventType()
+	}
+	if t := m.Time(); t > 0 {
+		h.CreateTime = t
+	}
+	r.add(ctx, h)
+}
+
+func (r *historyRecorder) RecordReply(ctx context.Context, m wechat.UserMessage, reply []byte) {
+	var v struct {
+		MsgType   string
+		Content   string
+		KfAccount string `xml:"TransInfo>KfAccount"`
+	}
+	err := xml.Unmarshal(reply, &v)
+	if err != nil {
+		logFor(ctx).Warningf("failed to parse reply to %s: %s", m.From(), err)
+	}
+
+	h := newHistoryMessage(ctx, m.From(), historyOut, historyReplyKind, v.MsgType, reply)
+	h.Content = v.Content
+	if len(v.KfAccount) > 0 {
+		h.Content = v.KfAccount
+	}
+	r.add(ctx, h)
+}
+
+func (r *historyRecorder) RecordCustomMessage(ctx context.Context, m *wechat.CustomMessage) {
+	raw, _ := json.Marshal(m)
+	h := newHistoryMessage(ctx, m.ToUser, historyOut, historyCustomKind, m.MsgType, raw)
+	switch {
+	case len(m.Content) > 0:
+		h.Content = m.Content
+	case len(m.CardID) > 0:
+		h.Content = m.CardID
+	default:
+		h.Content = m.MediaID
+	}
+	r.add(ctx, h)
+}
+
+func (r *historyRecorder) add(ctx context.Context, h *historyMessage) {
+	err := r.store.add(h)
+	if err != nil {
+		logFor(ctx).Errorf("failed to record %s %s of %s: %s", h.Kind, h.MsgType, h.OpenID, err)
+	}
+}
+
+func newHistoryRecorder(store historyStore) *historyRecorder {
+	r := new(historyRecorder)
+	r.store = store
+	return r
+}
+
+func newHistoryMessage(ctx context.Context, openID, direction, kind, msgType string, raw []byte) *historyMessage {
+	h := new(historyMessage)
+	h.OpenID = openID
+	h.Direction = direction
+	h.Kind = kind
+	h.MsgType = msgType
+	h.Raw = string(raw)
+	h.RequestID = wechat.RequestID(ctx)
+	h.CreateTime = time.Now().Unix()
+	return h
+}
+
+// messageContent returns the text of the message, or what identifies the message if it has no text
+func messageContent(m wechat.UserMessage) string {
+	switch v := m.(type) {
+	case *wechat.UserTextMessage:
+		return v.Content
+
+	case *wechat.UserImageMessage:
+		return v.PicUrl
+
+	case *wechat.UserVoiceMessage:
+		return v.MediaId
+
+	case *wechat.UserVideoMessage:
+		return v.MediaID
+
+	case *wechat.UserLinkMessage:
+		return strings.TrimSpace(v.Title + " " + v.Url)
+
+	case *wechat.SceneEvent:
+		return v.EventKey
+
+	case *wechat.KfSessionEvent:
+		return v.Account()
+
+	default:
+		return ""
+	}
+}
+
+// runHistoryPurge removes the messages older than the retention periodically
+func runHistoryPurge(store historyStore, retention time.Duration) {
+	for {
+		n, err := store.purge(time.Now().Add(-retention).Unix())
+		if err != nil {
+			log.Errorf("failed to purge conversation history: %s", err)
+		} else if n > 0 {
+			log.Infof("purged %d messages older than %s from conversation history", n, retention)
+		}
+		time.Sleep(historyPurgeInterval)
+	}
+}
+
+/**
+* admin endpoints
+ */
+
+// parseHistoryQuery reads the filters shared by the history endpoints, returns false if the response is written
+func parseHistoryQuery(c *gin.Context) (*historyQuery, bool) {
+	q := new(historyQuery)
+	q.OpenID = c.Query("openid")
+	q.Text = c.Query("q")
+
+	q.Direction = c.Query("direction")
+	if len(q.Direction) > 0 && q.Direction != historyIn && q.Direction != historyOut {
+		c.String(http.StatusBadRequest, "invalid direction '%s', must be in or out", q.Direction)
+		return nil, false
+	}
+
+	var err error
+	q.Since, err = parseTimeQuery(c, "since")
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+
+	q.Until, err = parseTimeQuery(c, "until")
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+
+	q.Offset, err = parseIntQuery(c, "offset", 0, 0, math.MaxInt32)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+
+	q.Limit, err = parseIntQuery(c, "limit", defaultHistoryQueryLimit, 1, maxHistoryQueryLimit)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	return q, true
+}
+
+func historyQueryHandler(q *historyQuery, c *gin.Context) {
+	result, err := history.query(q)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if result == nil {
+		result = []*historyMessage{}
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"messages": result,
+		"offset":   q.Offset,
+		"count":    len(result),
+	})
+}
+
+// historyTimelineHandler returns the conversation with a follower, the latest messages first
+func historyTimelineHandler(openID string, c *gin.Context) {
+	q, ok := parseHistoryQuery(c)
+	if !ok {
+		return
+	}
+	q.OpenID = openID
+	historyQueryHandler(q, c)
+}
+
+// historySearchHandler returns the messages containing the text in q, optionally of a follower
+func historySearchHandler(c *gin.Context) {
+	q, ok := parseHistoryQuery(c)
+	if !ok {
+		return
+	}
+
+	if len(q.Text) == 0 {
+		c.String(http.StatusBadRequest, "missing query 'q'")
+		return
+	}
+	historyQueryHandler(q, c)
+}
+
+// historyExportHandler downloads the messages matching the filters in the order they're sent,
+// either as json lines or as csv
+func historyExportHandler(c *gin.Context) {
+	q, ok := parseHistoryQuery(c)
+	if !ok {
+		return
+	}
+
+	format := c.DefaultQuery("format", "jsonl")
+	var write func(m *historyMessage) error
+	var flush func() error
+	switch format {
+	case "jsonl":
+		c.Header("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(c.Writer)
+		write = func(m *historyMessage) error {
+			return encoder.Encode(m)
+		}
+		flush = func() error {
+			return nil
+		}
+
+	case "csv":
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		w := csv.NewWriter(c.Writer)
+		w.Write([]string{"id", "openid", "direction", "kind", "msg_type", "event", "msg_id", "content", "request_id", "create_time"})
+		write = func(m *historyMessage) error {
+			return w.Write([]string{
+				strconv.FormatInt(m.ID, 10),
+				m.OpenID,
+				m.Direction,
+				m.Kind,
+				m.MsgType,
+				m.Event,
+				strconv.FormatInt(m.MsgID, 10),
+				m.Content,
+				m.RequestID,
+				time.Unix(m.CreateTime, 0).UTC().Format(time.RFC3339),
+			})
+		}
+		flush = func() error {
+			w.Flush()
+			return w.Error()
+		}
+
+	default:
+		c.String(http.StatusBadRequest, "invalid format '%s', must be jsonl or csv", format)
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="history.%s"`, format))
+	c.Status(http.StatusOK)
+
+	// the response has started, so the errors can only be logged
+	err := history.export(q, write)
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		logFor(c.Request.Context()).Errorf("failed to export conversation history: %s", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// newHistoryTest creates a history store in a sqlite database, which is removed with the test
+func newHistoryTest(t *testing.T) historyStore {
+	db, err := openDatabase(defaultDatabaseDriver, filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("failed to open the database: %s", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	store, err := newSqlHistoryStore(db, defaultDatabaseDriver)
+	if err != nil {
+		t.Fatalf("failed to create the history store: %s", err)
+	}
+	return store
+}
+
+func addHistory(t *testing.T, store historyStore, openID, content string, createTime int64) {
+	err := store.add(&historyMessage{
+		OpenID:     openID,
+		Direction:  historyIn,
+		Kind:       historyMessageKind,
+		MsgType:    "text",
+		Content:    content,
+		CreateTime: createTime,
+	})
+	if err != nil {
+		t.Fatalf("failed to add '%s' to the history: %s", content, err)
+	}
+}
+
+func historyContents(t *testing.T, store historyStore, q *historyQuery) []string {
+	messages, err := store.query(q)
+	if err != nil {
+		t.Fatalf("failed to query the history: %s", err)
+	}
+
+	var contents []string
+	for _, m := range messages {
+		contents = append(contents, m.Content)
+	}
+	return contents
+}
+
+func TestHistorySearchWildcards(t *testing.T) {
+	store := newHistoryTest(t)
+	for i, content := range []string{"100% sure", "1000 sure", "snake_case", "snakecase", "snakeXcase", `back\slash`, "backslash"} {
+		addHistory(t, store, testAlice.OpenID, content, int64(i+1))
+	}
+
+	searches := map[string]string{
+		"0%":     "100% sure",
+		"%":      "100% sure",
+		"e_c":    "snake_case",
+		"_":      "snake_case",
+		`k\s`:    `back\slash`,
+		"SNAKE_": "snake_case",
+	}
+	for text, expected := range searches {
+		contents := historyContents(t, store, &historyQuery{Text: text, Limit: maxHistoryQueryLimit})
+		if len(contents) != 1 || contents[0] != expected {
+			t.Errorf("search of '%s' returned %q, expected only '%s'", text, contents, expected)
+		}
+	}
+}
+
+func TestHistoryExportPages(t *testing.T) {
+	store := newHistoryTest(t)
+
+	// bob's messages are in between, so that the pages of alice's messages aren't full
+	count := historyExportPageSize*2 + 1
+	for i := 0; i < count; i++ {
+		addHistory(t, store, testAlice.OpenID, fmt.Sprintf("alice %d", i), int64(i+1))
+		if i%2 == 0 {
+			addHistory(t, store, testBob.OpenID, fmt.Sprintf("bob %d", i), int64(i+1))
+		}
+	}
+
+	var exported []*historyMessage
+	err := store.export(&historyQuery{OpenID: testAlice.OpenID, Offset: 10, Limit: 10}, func(m *historyMessage) error {
+		exported = append(exported, m)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to export the history: %s", err)
+	}
+
+	if len(exported) != count {
+		t.Fatalf("%d messages exported, expected %d", len(exported), count)
+	}
+	for i, m := range exported {
+		if expected := fmt.Sprintf("alice %d", i); m.Content != expected {
+			t.Fatalf("message %d is '%s', expected '%s'", i, m.Content, expected)
+		}
+	}
+
+	// the export stops at the first error of fn
+	var calls int
+	stop := fmt.Errorf("stop")
+	err = store.export(&historyQuery{}, func(m *historyMessage) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("export returned %v after %d calls, expected to stop after the first call", err, calls)
+	}
+}
+
+func TestHistoryPurge(t *testing.T) {
+	store := newHistoryTest(t)
+	addHistory(t, store, testAlice.OpenID, "old", 100)
+	addHistory(t, store, testBob.OpenID, "older", 99)
+	addHistory(t, store, testAlice.OpenID, "cutoff", 200)
+	addHistory(t, store, testAlice.OpenID, "new", 300)
+
+	n, err := store.purge(200)
+	if err != nil {
+		t.Fatalf("failed to purge the history: %s", err)
+	}
+	if n != 2 {
+		t.Errorf("%d messages purged, expected 2", n)
+	}
+
+	contents := historyContents(t, store, &historyQuery{Limit: maxHistoryQueryLimit})
+	if len(contents) != 2 || contents[0] != "new" || contents[1] != "cutoff" {
+		t.Errorf("got %q after the purge, expected the messages from the cutoff on", contents)
+	}
+}
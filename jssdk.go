@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	// the js-safe domains configured for the official account, only pages on them can be signed
+	jssdkDomains []string
+)
+
+func initJSSDKDomains(domains string) {
+	jssdkDomains = nil
+	for _, domain := range strings.Split(domains, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if len(domain) > 0 {
+			jssdkDomains = append(jssdkDomains, domain)
+		}
+	}
+}
+
+func isJSSDKDomain(host string) bool {
+	host = strings.ToLower(host)
+	for _, domain := range jssdkDomains {
+		if host == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// jssdkConfigHandler returns the payload of wx.config for the page of the url
+func jssdkConfigHandler(c *gin.Context) {
+	pageUrl := c.Query("url")
+	if len(pageUrl) == 0 {
+		c.String(http.StatusBadRequest, "url is required")
+		return
+	}
+
+	u, err := url.Parse(pageUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		c.String(http.StatusBadRequest, "invalid url '%s'", pageUrl)
+		return
+	}
+
+	if !isJSSDKDomain(u.Hostname()) {
+		c.String(http.StatusForbidden, "domain '%s' is not allowed", u.Hostname())
+		return
+	}
+
+	config, err := server.JSSDKConfig(c.Request.Context(), pageUrl)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, config)
+}
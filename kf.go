@@ -0,0 +1,328 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/haowang1013/wechat-server/wechat"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	kfSessionKeyPrefix = "kfsession."
+
+	// the sessions are tracked from the events, it expires in case the close event is missed,
+	// and it's extended every time a message is transferred
+	kfSessionLifeTime = 4 * time.Hour
+)
+
+var (
+	// a text message containing one of the keywords as a word is escalated to the customer service
+	humanServiceKeywords = []string{"人工", "客服", "human"}
+)
+
+// kfSession records the customer service account a follower is talking to, so the messages of the follower
+// keep being transferred to the account until the session is closed
+type kfSession struct {
+	Account    string `json:"kf_account"`
+	CreateTime int64  `json:"create_time"`
+}
+
+func getKfSession(openID string) (*kfSession, bool) {
+	value, ok := getJson(kfCache, kfSessionKeyPrefix+openID, func() interface{} {
+		return new(kfSession)
+	})
+
+	session, _ := value.(*kfSession)
+	return session, ok && session != nil
+}
+
+// handleKfSessionEvent keeps track of the session when it's created, switched or closed by the customer service
+func handleKfSessionEvent(e *wechat.KfSessionEvent) {
+	key := kfSessionKeyPrefix + e.From()
+	switch e.EventType() {
+	case "kf_create_session", "kf_switch_session":
+		log.Infof("%s is talking to customer service account '%s'", e.From(), e.Account())
+		setJson(kfCache, key, &kfSession{
+			Account:    e.Account(),
+			CreateTime: time.Now().Unix(),
+		})
+	case "kf_close_session":
+		log.Infof("customer service account '%s' closed the session with %s", e.KfAccount, e.From())
+		setJson(kfCache, key, nil)
+	}
+}
+
+// transferToHuman transfers the message to the customer service if the follower is in a session, or asks for
+// a human with a text message. Returns false if the message should be handled by the bot
+func transferToHuman(m wechat.UserMessage, content string, c *gin.Context) bool {
+	if session, ok := getKfSession(m.From()); ok {
+		setJson(kfCache, kfSessionKeyPrefix+m.From(), session)
+		m.ReplyTransferCustomerService(c, session.Account)
+		return true
+	}
+
+	content = strings.ToLower(content)
+	for _, keyword := range humanServiceKeywords {
+		if containsWord(content, keyword) {
+			logFor(c.Request.Context()).Infof("%s asked for customer service", m.From())
+			m.ReplyTransferCustomerService(c, "")
+			return true
+		}
+	}
+	return false
+}
+
+// containsWord checks if the keyword appears in the content not as part of a longer word, e.g. 'human'
+// doesn't match 'inhuman'. Chinese isn't separated by spaces, so the chinese characters don't count as word characters
+func containsWord(content, keyword string) bool {
+	for start := 0; ; {
+		i := strings.Index(content[start:], keyword)
+		if i < 0 {
+			return false
+		}
+		i += start
+
+		before, _ := utf8.DecodeLastRuneInString(content[:i])
+		after, _ := utf8.DecodeRuneInString(content[i+len(keyword):])
+		if !isWordRune(before) && !isWordRune(after) {
+			return true
+		}
+		start = i + len(keyword)
+	}
+}
+
+func isWordRune(r rune) bool {
+	return (unicode.IsLetter(r) || unicode.IsDigit(r)) && !unicode.Is(unicode.Han, r)
+}
+
+/**
+* admin endpoints
+ */
+func kfAccountListHandler(c *gin.Context) {
+	token, err := server.AccessToken(c.Request.Context())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	accounts, err := wechat.GetKfAccounts(c.Request.Context(), token)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	online, err := wechat.GetOnlineKfAccounts(c.Request.Context(), token)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"accounts": accounts,
+		"online":   online,
+	})
+}
+
+// kfAccountSaveHandler adds the account if it's a POST, or updates its nickname otherwise
+func kfAccountSaveHandler(account string, c *gin.Context) {
+	req := new(struct {
+		Account  string `json:"kf_account"`
+		Nickname string `json:"nickname"`
+	})
+	err := c.BindJSON(req)
+	if err != nil {
+		return
+	}
+
+	if len(account) == 0 {
+		account = req.Account
+	}
+
+	if len(account) == 0 || len(req.Nickname) == 0 {
+		c.String(http.StatusBadRequest, "kf_account and nickname are required")
+		return
+	}
+
+	token, err := server.AccessToken(c.Request.Context())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if c.Request.Method == http.MethodPost {
+		err = wechat.AddKfAccount(c.Request.Context(), token, account, req.Nickname)
+	} else {
+		err = wechat.UpdateKfAccount(c.Request.Context(), token, account, req.Nickname)
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.String(http.StatusOK, "account '%s' saved", account)
+}
+
+func kfAccountDeleteHandler(account string, c *gin.Context) {
+	token, err := server.AccessToken(c.Request.Context())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	err = wechat.DeleteKfAccount(c.Request.Context(), token, account)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.String(http.StatusOK, "account '%s' deleted", account)
+}
+
+func kfAccountInviteHandler(account string, c *gin.Context) {
+	req := new(struct {
+		InviteWx string `json:"invite_wx"`
+	})
+	err := c.BindJSON(req)
+	if err != nil {
+		return
+	}
+
+	if len(req.InviteWx) == 0 {
+		c.String(http.StatusBadRequest, "invite_wx is required")
+		return
+	}
+
+	token, err := server.AccessToken(c.Request.Context())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	err = wechat.InviteKfWorker(c.Request.Context(), token, account, req.InviteWx)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.String(http.StatusOK, "%s invited to account '%s'", req.InviteWx, account)
+}
+
+// kfAccountAvatarHandler uploads the 'avatar' file of the multipart form as the avatar of the account
+func kfAccountAvatarHandler(account string, c *gin.Context) {
+	header, err := c.FormFile("avatar")
+	if err != nil {
+		c.String(http.StatusBadRequest, "avatar file is required")
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	defer file.Close()
+
+	token, err := server.AccessToken(c.Request.Context())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	err = wechat.UploadKfAvatar(c.Request.Context(), token, account, header.Filename, file, header.Size)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.String(http.StatusOK, "avatar of account '%s' uploaded", account)
+}
+
+// kfSessionListHandler returns the session of a follower with ?openid=, or the sessions of an account with ?kf_account=
+func kfSessionListHandler(c *gin.Context) {
+	openID := c.Query("openid")
+	account := c.Query("kf_account")
+	if len(openID) == 0 && len(account) == 0 {
+		c.String(http.StatusBadRequest, "either openid or kf_account is required")
+		return
+	}
+
+	token, err := server.AccessToken(c.Request.Context())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	var sessions []wechat.KfSession
+	if len(openID) > 0 {
+		session, err := wechat.GetKfSession(c.Request.Context(), token, openID)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		if len(session.Account) > 0 {
+			sessions = append(sessions, *session)
+		}
+	} else {
+		sessions, err = wechat.GetKfSessions(c.Request.Context(), token, account)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if sessions == nil {
+		sessions = []wechat.KfSession{}
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"sessions": sessions,
+	})
+}
+
+func kfWaitingListHandler(c *gin.Context) {
+	token, err := server.AccessToken(c.Request.Context())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	list, err := wechat.GetWaitingKfSessions(c.Request.Context(), token)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, list)
+}
+
+// kfSessionHandler creates or closes the session of a follower with an account
+func kfSessionHandler(create bool, c *gin.Context) {
+	req := new(struct {
+		Account string `json:"kf_account"`
+		OpenID  string `json:"openid"`
+	})
+	err := c.BindJSON(req)
+	if err != nil {
+		return
+	}
+
+	if len(req.Account) == 0 || len(req.OpenID) == 0 {
+		c.String(http.StatusBadRequest, "kf_account and openid are required")
+		return
+	}
+
+	token, err := server.AccessToken(c.Request.Context())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if create {
+		err = wechat.CreateKfSession(c.Request.Context(), token, req.Account, req.OpenID)
+	} else {
+		err = wechat.CloseKfSession(c.Request.Context(), token, req.Account, req.OpenID)
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.String(http.StatusOK, "session of %s with '%s' updated", req.OpenID, req.Account)
+}
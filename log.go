@@ -1,78 +1,185 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
 	"github.com/haowang1013/wechat-server/wechat"
-	"github.com/op/go-logging"
+	"github.com/sirupsen/logrus"
+	"net/http"
 	"os"
+	"time"
+)
+
+const (
+	// request ids from the clients longer than this are replaced
+	maxRequestIDLength = 64
 )
 
 var (
-	log = logging.MustGetLogger("")
+	log = newLog()
 )
 
-func init() {
-	format := logging.MustStringFormatter(
-		"%{color}%{time:15:04:05.000} %{shortfunc} ▶ %{level:.4s} %{id:03x}%{color:reset} %{message}",
-	)
+func newLog() *logrus.Logger {
+	l := logrus.New()
+	l.Out = os.Stdout
+	l.Level = logrus.DebugLevel
+	l.Formatter = &logrus.TextFormatter{FullTimestamp: true, TimestampFormat: "15:04:05.000"}
+	l.AddHook(new(redactHook))
+	return l
+}
+
+// setupLogging sets the level, e.g. info, and the format of the log, which is either text or json
+func setupLogging(level, format string) error {
+	if len(level) > 0 {
+		l, err := logrus.ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		log.SetLevel(l)
+	}
 
-	backend := logging.NewLogBackend(os.Stdout, "", 0)
-	formtter := logging.NewBackendFormatter(backend, format)
-	logging.SetBackend(formtter)
+	switch format {
+	case "", "text":
+	case "json":
+		log.SetFormatter(new(logrus.JSONFormatter))
+	default:
+		return fmt.Errorf("log format '%s' not supported", format)
+	}
+	return nil
 }
 
-type logger struct {
+// logFor returns the log with the request id and the trace of the context
+func logFor(ctx context.Context) *logrus.Entry {
+	return log.WithContext(ctx).WithFields(logrus.Fields(wechat.ContextFields(ctx, nil)))
 }
 
-func (l *logger) Log(t wechat.LogType, text string) {
-	switch t {
-	case wechat.Debug:
-		log.Debug(text)
+// redactHook removes the secrets from the urls in the messages and the fields, e.g. access_token
+type redactHook struct {
+}
 
-	case wechat.Notice:
-		log.Notice(text)
+func (h *redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
 
-	case wechat.Info:
-		log.Info(text)
+func (h *redactHook) Fire(e *logrus.Entry) error {
+	e.Message = wechat.Redact(e.Message)
+	for k, v := range e.Data {
+		switch value := v.(type) {
+		case string:
+			e.Data[k] = wechat.Redact(value)
+		case error:
+			e.Data[k] = wechat.Redact(value.Error())
+		}
+	}
+	return nil
+}
 
-	case wechat.Warning:
-		log.Warning(text)
+// requestID tags the request with the id in the X-Request-ID header or a new one, the id is carried by the context
+// of the request into the handlers and the wechat api calls, and returned in the response header
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(wechat.RequestIDHeader)
+		if len(id) == 0 || len(id) > maxRequestIDLength {
+			id = newUUID()
+		}
+
+		c.Header(wechat.RequestIDHeader, id)
+		c.Request = c.Request.WithContext(wechat.WithRequestID(c.Request.Context(), id))
+		c.Next()
+	}
+}
 
-	case wechat.Error:
-		log.Error(text)
+// accessLog logs the requests in place of the gin logger, so that the secrets in the urls are redacted
+func accessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		entry := logFor(c.Request.Context()).WithFields(logrus.Fields{
+			"method":    c.Request.Method,
+			"url":       c.Request.URL.RequestURI(),
+			"status":    c.Writer.Status(),
+			"duration":  time.Since(start).String(),
+			"client_ip": c.ClientIP(),
+		})
+		if len(c.Errors) > 0 {
+			entry = entry.WithField("error", c.Errors.String())
+		}
+		entry.Info("request handled")
+	}
+}
 
-	case wechat.Fatal:
-		log.Fatal(text)
+// logLevelHandler returns the level of the log, or sets it with the level in the body, e.g. {"level": "info"}
+func logLevelHandler(c *gin.Context) {
+	if c.Request.Method == http.MethodPut {
+		req := new(struct {
+			Level string `json:"level"`
+		})
+		err := c.BindJSON(req)
+		if err != nil {
+			return
+		}
+
+		level, err := logrus.ParseLevel(req.Level)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid level '%s'", req.Level)
+			return
+		}
+		log.SetLevel(level)
+		logFor(c.Request.Context()).Warningf("log level set to %s", level)
+	}
 
-	case wechat.Panic:
-		log.Panic(text)
+	c.IndentedJSON(http.StatusOK, map[string]string{
+		"level": log.GetLevel().String(),
+	})
+}
 
-	default:
-		panic("log type not supported")
-	}
+// logger logs the messages of the wechat package
+type logger struct {
+}
+
+func (l *logger) Log(t wechat.LogType, text string) {
+	log.Log(logLevel(t), text)
+	exitOnFatal(t)
 }
 
 func (l *logger) Logf(t wechat.LogType, format string, v ...interface{}) {
+	log.Logf(logLevel(t), format, v...)
+	exitOnFatal(t)
+}
+
+func (l *logger) LogFields(t wechat.LogType, text string, fields wechat.Fields) {
+	log.WithFields(logrus.Fields(fields)).Log(logLevel(t), text)
+	exitOnFatal(t)
+}
+
+// exitOnFatal exits like log.Fatal does, logging at the fatal level alone doesn't exit
+func exitOnFatal(t wechat.LogType) {
+	if t == wechat.Fatal {
+		log.Exit(1)
+	}
+}
+
+func logLevel(t wechat.LogType) logrus.Level {
 	switch t {
 	case wechat.Debug:
-		log.Debugf(format, v...)
-
-	case wechat.Notice:
-		log.Noticef(format, v...)
+		return logrus.DebugLevel
 
-	case wechat.Info:
-		log.Infof(format, v...)
+	case wechat.Notice, wechat.Info:
+		return logrus.InfoLevel
 
 	case wechat.Warning:
-		log.Warningf(format, v...)
+		return logrus.WarnLevel
 
 	case wechat.Error:
-		log.Errorf(format, v...)
+		return logrus.ErrorLevel
 
 	case wechat.Fatal:
-		log.Fatalf(format, v...)
+		return logrus.FatalLevel
 
 	case wechat.Panic:
-		log.Panicf(format, v...)
+		return logrus.PanicLevel
 
 	default:
 		panic("log type not supported")
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/haowang1013/wechat-server/wechat"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"net/url"
+	"time"
+)
+
+const (
+	officialAccountProvider = wechat.OfficialAccountLogin
+	websiteProvider         = wechat.WebsiteLogin
+	scanProvider            = "scan"
+
+	accountKeyPrefix = "account."
+
+	loginSessionLifeTime = time.Hour
+)
+
+var (
+	loginProviders = make(map[string]*loginProvider)
+
+	errLoginTaken = errors.New("uuid has been used by another user")
+)
+
+// loginProvider describes how a user is sent to wechat to authorize the login
+type loginProvider struct {
+	name         string
+	appID        string
+	authorizeUrl string
+	scope        string
+	callbackUrl  string
+	fragment     string
+	qrcode       bool
+}
+
+func (p *loginProvider) redirectUrl(host string) string {
+	return makeSimpleUrl("http", host, p.callbackUrl).String()
+}
+
+func (p *loginProvider) loginUrl(host, state string) string {
+	params := url.Values{}
+	params.Set("appid", p.appID)
+	params.Set("redirect_uri", p.redirectUrl(host))
+	params.Set("response_type", "code")
+	params.Set("scope", p.scope)
+	params.Set("state", state)
+	return wechat.DefaultClient.AuthorizeUrl(p.authorizeUrl, params, p.fragment)
+}
+
+// official account login is done within the wechat client, the url is presented as a qr code to scan
+func newOfficialAccountProvider(appID string) *loginProvider {
+	p := new(loginProvider)
+	p.name = officialAccountProvider
+	p.appID = appID
+	p.authorizeUrl = "/connect/oauth2/authorize"
+	p.scope = "snsapi_userinfo"
+	p.callbackUrl = webLoginUrl
+	p.fragment = "wechat_redirect"
+	p.qrcode = true
+	return p
+}
+
+// website login is done in a desktop browser, the wechat page shows its own qr code
+func newWebsiteProvider(appID string) *loginProvider {
+	p := new(loginProvider)
+	p.name = websiteProvider
+	p.appID = appID
+	p.authorizeUrl = "/connect/qrconnect"
+	p.scope = "snsapi_login"
+	p.callbackUrl = websiteLoginUrl
+	p.fragment = "wechat_redirect"
+	p.qrcode = false
+	return p
+}
+
+func addLoginProvider(p *loginProvider) {
+	loginProviders[p.name] = p
+}
+
+// loginSession is what's stored in the cache for each login uuid
+type loginSession struct {
+	Provider string           `json:"provider"`
+	User     *wechat.UserInfo `json:"user"`
+	Denied   bool             `json:"denied"`
+
+	// mini-program sessions keep the session key to decrypt the data of the user
+	SessionKey string `json:"session_key,omitempty"`
+
+	// the trace of the request which created the login, the spans completing the login are linked to it
+	TraceParent string `json:"trace_parent,omitempty"`
+}
+
+func newLoginSession(ctx context.Context, provider string) *loginSession {
+	s := new(loginSession)
+	s.Provider = provider
+	s.TraceParent = traceParent(ctx)
+	return s
+}
+
+func getLoginSession(uuid string) (*loginSession, bool) {
+	value, ok := getJson(cache, uuid, func() interface{} {
+		return new(loginSession)
+	})
+
+	session, _ := value.(*loginSession)
+	return session, ok && session != nil
+}
+
+func newLoginUUID() string {
+	uid := newUUID()
+	for ; cache.exists(uid); uid = newUUID() {
+	}
+	return uid
+}
+
+// completeLogin logs the user in with the session, a session can only be used by the first user logged in with it
+func completeLogin(ctx context.Context, uuid string, session *loginSession, u *wechat.UserInfo) error {
+	ctx, span := startLinkedSpan(ctx, "login.complete", session.TraceParent)
+	defer span.End()
+	span.SetAttributes(attribute.String("login.provider", session.Provider))
+
+	existing := session.User
+	if existing != nil && existing.OpenID != u.OpenID {
+		span.SetStatus(codes.Error, errLoginTaken.Error())
+		logFor(ctx).Errorf("user '%s' has logged in with uuid '%s', current user '%s' is rejected", existing.OpenID, uuid, u.OpenID)
+		return errLoginTaken
+	}
+
+	session.User = u
+	session.Denied = false
+	err := setJson(cache, uuid, session)
+	if err != nil {
+		return err
+	}
+
+	linkAccount(session.Provider, u)
+
+	// the same user confirming again, e.g. by reloading the callback page, doesn't count as another login
+	if existing == nil {
+		observeLogin(session.Provider, loginConfirmed)
+	}
+	return nil
+}
+
+// linkedAccount groups the open ids of the same user across login providers by union id
+type linkedAccount struct {
+	UnionID string            `json:"unionid"`
+	OpenIDs map[string]string `json:"openids"`
+}
+
+func linkAccount(provider string, u *wechat.UserInfo) *linkedAccount {
+	account := new(linkedAccount)
+	account.UnionID = u.UnionID
+	account.OpenIDs = make(map[string]string)
+
+	// without a union id there's nothing to link the user with
+	if len(u.UnionID) == 0 {
+		account.OpenIDs[provider] = u.OpenID
+		return account
+	}
+
+	value, ok := getJson(accountCache, accountKeyPrefix+u.UnionID, func() interface{} {
+		return new(linkedAccount)
+	})
+	if existing, _ := value.(*linkedAccount); ok && existing != nil && existing.OpenIDs != nil {
+		account = existing
+	}
+
+	if account.OpenIDs[provider] != u.OpenID {
+		account.OpenIDs[provider] = u.OpenID
+		setJson(accountCache, accountKeyPrefix+u.UnionID, account)
+	}
+
+	return account
+}
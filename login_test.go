@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alicebob/miniredis"
+	"github.com/gin-gonic/gin"
+	"github.com/haowang1013/wechat-server/wechat"
+	"github.com/haowang1013/wechat-server/wechat/wechattest"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const (
+	testAppID     = "wx-test-app"
+	testAppSecret = "test-app-secret"
+	testAppToken  = "test-app-token"
+
+	testLoginLifeTime = 200 * time.Millisecond
+)
+
+var (
+	testAlice = wechat.UserInfo{
+		Subscribed: 1,
+		OpenID:     "openid-alice",
+		NickName:   "alice",
+		UnionID:    "unionid-alice",
+	}
+
+	testBob = wechat.UserInfo{
+		Subscribed: 1,
+		OpenID:     "openid-bob",
+		NickName:   "bob",
+		UnionID:    "unionid-bob",
+	}
+)
+
+// cacheBackend creates the caches of a test, and moves their clock forward to expire the values
+type cacheBackend interface {
+	newCache(keyPrefix string, valueLifeTime time.Duration) kvCache
+	elapse(d time.Duration)
+	close()
+}
+
+type memBackend struct{}
+
+func (b *memBackend) newCache(keyPrefix string, valueLifeTime time.Duration) kvCache {
+	return newMemCache(valueLifeTime)
+}
+
+func (b *memBackend) elapse(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (b *memBackend) close() {
+}
+
+type redisBackend struct {
+	server *miniredis.Miniredis
+}
+
+func (b *redisBackend) newCache(keyPrefix string, valueLifeTime time.Duration) kvCache {
+	return newRedisCache(b.server.Addr(), keyPrefix, valueLifeTime)
+}
+
+func (b *redisBackend) elapse(d time.Duration) {
+	b.server.FastForward(d)
+}
+
+func (b *redisBackend) close() {
+	b.server.Close()
+}
+
+// loginTest runs the server against a fake wechat api, with the caches created by the backend
+type loginTest struct {
+	t       *testing.T
+	fake    *wechattest.Server
+	backend cacheBackend
+	router  *gin.Engine
+	client  *http.Client
+}
+
+func newLoginTest(t *testing.T, backend cacheBackend) *loginTest {
+	gin.SetMode(gin.TestMode)
+
+	lt := new(loginTest)
+	lt.t = t
+	lt.backend = backend
+	lt.fake = wechattest.NewServer(testAppID, testAppSecret)
+	lt.fake.AddUser(testAlice)
+	lt.fake.AddUser(testBob)
+
+	// the authorization page redirects back to the server, which is served by the router instead
+	lt.client = &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	wechat.SetBaseUrls(lt.fake.URL, lt.fake.URL)
+	appID = testAppID
+	appSecret = testAppSecret
+	appToken = testAppToken
+	openAppID = ""
+	openAppSecret = ""
+
+	cache = backend.newCache("wechat-login", testLoginLifeTime)
+	grantCache = backend.newCache("wechat-grant", 0)
+	accountCache = backend.newCache("wechat-account", 0)
+	kfCache = backend.newCache("wechat-kf", kfSessionLifeTime)
+	tokenCache = backend.newCache("wechat-token", 0)
+
+	setupServer()
+	lt.router = newRouter()
+	return lt
+}
+
+func (lt *loginTest) close() {
+	lt.fake.Close()
+	lt.backend.close()
+	wechat.SetBaseUrls("", "")
+}
+
+func (lt *loginTest) do(method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	lt.router.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+// startLogin creates a login and returns its uuid and the url of the authorization page
+func (lt *loginTest) startLogin() (string, string) {
+	w := lt.do("POST", "/login")
+	if w.Code != http.StatusCreated {
+		lt.t.Fatalf("POST /login returned %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp map[string]string
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil {
+		lt.t.Fatalf("invalid response of POST /login: %s", err)
+	}
+
+	if len(resp["uuid"]) == 0 || len(resp["login_url"]) == 0 {
+		lt.t.Fatalf("missing uuid or login url in %+v", resp)
+	}
+	return resp["uuid"], resp["login_url"]
+}
+
+// authorize opens the authorization page as the user, an empty open id denies the login,
+// and follows the redirect back to the server
+func (lt *loginTest) authorize(loginUrl, openID string) *httptest.ResponseRecorder {
+	lt.fake.SetAuthorizeUser(openID)
+	resp, err := lt.client.Get(loginUrl)
+	if err != nil {
+		lt.t.Fatalf("failed to open the authorization page: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		lt.t.Fatalf("authorization page returned %d", resp.StatusCode)
+	}
+
+	redirect, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		lt.t.Fatalf("invalid redirect of the authorization page: %s", err)
+	}
+
+	if redirect.Path != webLoginUrl {
+		lt.t.Fatalf("authorization page redirected to %s instead of %s", redirect.Path, webLoginUrl)
+	}
+	return lt.do("GET", redirect.RequestURI())
+}
+
+// expectUser checks the login of the uuid is completed by the user
+func (lt *loginTest) expectUser(uuid string, u wechat.UserInfo) {
+	w := lt.do("GET", "/login/"+uuid)
+	if w.Code != http.StatusOK {
+		lt.t.Fatalf("GET /login/%s returned %d: %s", uuid, w.Code, w.Body.String())
+	}
+
+	resp := new(struct {
+		User     wechat.UserInfo   `json:"user"`
+		UUID     string            `json:"uuid"`
+		AppID    string            `json:"app_id"`
+		Provider string            `json:"provider"`
+		UnionID  string            `json:"union_id"`
+		Accounts map[string]string `json:"accounts"`
+	})
+	err := json.Unmarshal(w.Body.Bytes(), resp)
+	if err != nil {
+		lt.t.Fatalf("invalid response of GET /login/%s: %s", uuid, err)
+	}
+
+	if resp.User.OpenID != u.OpenID || resp.User.NickName != u.NickName {
+		lt.t.Errorf("login completed by %s (%s), expected %s (%s)", resp.User.OpenID, resp.User.NickName, u.OpenID, u.NickName)
+	}
+
+	if resp.UUID != uuid || resp.AppID != testAppID || resp.Provider != officialAccountProvider {
+		lt.t.Errorf("unexpected login result: uuid=%s, app_id=%s, provider=%s", resp.UUID, resp.AppID, resp.Provider)
+	}
+
+	if resp.UnionID != u.UnionID || resp.Accounts[officialAccountProvider] != u.OpenID {
+		lt.t.Errorf("unexpected linked account: union_id=%s, accounts=%v", resp.UnionID, resp.Accounts)
+	}
+}
+
+func (lt *loginTest) expectStatus(w *httptest.ResponseRecorder, code int, what string) {
+	if w.Code != code {
+		lt.t.Errorf("%s returned %d, expected %d: %s", what, w.Code, code, w.Body.String())
+	}
+}
+
+// runLoginTest runs the test against both the memory cache and redis
+func runLoginTest(t *testing.T, f func(lt *loginTest)) {
+	t.Run("mem", func(t *testing.T) {
+		lt := newLoginTest(t, new(memBackend))
+		defer lt.close()
+		f(lt)
+	})
+
+	t.Run("redis", func(t *testing.T) {
+		s, err := miniredis.Run()
+		if err != nil {
+			t.Fatalf("failed to start miniredis: %s", err)
+		}
+
+		lt := newLoginTest(t, &redisBackend{s})
+		defer lt.close()
+		f(lt)
+	})
+}
+
+func TestWebLogin(t *testing.T) {
+	runLoginTest(t, func(lt *loginTest) {
+		uuid, loginUrl := lt.startLogin()
+		lt.expectStatus(lt.do("GET", "/login/"+uuid), http.StatusNotFound, "query before login")
+
+		lt.expectStatus(lt.authorize(loginUrl, testAlice.OpenID), http.StatusOK, "web login")
+		lt.expectUser(uuid, testAlice)
+	})
+}
+
+func TestWebLoginRejectsSecondUser(t *testing.T) {
+	runLoginTest(t, func(lt *loginTest) {
+		uuid, loginUrl := lt.startLogin()
+		lt.expectStatus(lt.authorize(loginUrl, testAlice.OpenID), http.StatusOK, "web login of the first user")
+		lt.expectStatus(lt.authorize(loginUrl, testBob.OpenID), http.StatusBadRequest, "web login of the second user")
+		lt.expectUser(uuid, testAlice)
+
+		// the same user can login with the uuid again
+		lt.expectStatus(lt.authorize(loginUrl, testAlice.OpenID), http.StatusOK, "web login of the first user again")
+		lt.expectUser(uuid, testAlice)
+	})
+}
+
+func TestWebLoginExpiry(t *testing.T) {
+	runLoginTest(t, func(lt *loginTest) {
+		uuid, loginUrl := lt.startLogin()
+		lt.backend.elapse(2 * testLoginLifeTime)
+		lt.expectStatus(lt.authorize(loginUrl, testAlice.OpenID), http.StatusBadRequest, "web login after expiry")
+		lt.expectStatus(lt.do("GET", "/login/"+uuid), http.StatusNotFound, "query after expiry")
+
+		// a completed login expires as well
+		uuid, loginUrl = lt.startLogin()
+		lt.expectStatus(lt.authorize(loginUrl, testAlice.OpenID), http.StatusOK, "web login")
+		lt.expectUser(uuid, testAlice)
+		lt.backend.elapse(2 * testLoginLifeTime)
+		lt.expectStatus(lt.do("GET", "/login/"+uuid), http.StatusNotFound, "query of a completed login after expiry")
+	})
+}
+
+func TestWebLoginDenied(t *testing.T) {
+	runLoginTest(t, func(lt *loginTest) {
+		uuid, loginUrl := lt.startLogin()
+		lt.expectStatus(lt.authorize(loginUrl, ""), http.StatusOK, "denied web login")
+		lt.expectStatus(lt.do("GET", "/login/"+uuid), http.StatusForbidden, "query after denial")
+
+		// the user can change the mind and login with the same uuid
+		lt.expectStatus(lt.authorize(loginUrl, testAlice.OpenID), http.StatusOK, "web login after denial")
+		lt.expectUser(uuid, testAlice)
+	})
+}
+
+func TestWebLoginUnknownUUID(t *testing.T) {
+	runLoginTest(t, func(lt *loginTest) {
+		lt.expectStatus(lt.do("GET", "/login/unknown-uuid"), http.StatusNotFound, "query of unknown uuid")
+		code := lt.fake.NewCode(testAlice.OpenID)
+		lt.expectStatus(lt.do("GET", webLoginUrl+"?state=unknown-uuid&code="+code), http.StatusBadRequest, "web login with unknown uuid")
+	})
+}
+
+func TestWebLoginProviderMismatch(t *testing.T) {
+	runLoginTest(t, func(lt *loginTest) {
+		for _, provider := range []string{websiteProvider, miniProgramProvider} {
+			uuid := newLoginUUID()
+			setJson(cache, uuid, newLoginSession(context.Background(), provider))
+
+			code := lt.fake.NewCode(testAlice.OpenID)
+			lt.expectStatus(lt.do("GET", webLoginUrl+"?state="+uuid+"&code="+code), http.StatusBadRequest, provider+" login via web login")
+			lt.expectStatus(lt.do("GET", webLoginUrl+"?state="+uuid), http.StatusBadRequest, provider+" login denied via web login")
+
+			session, _ := getLoginSession(uuid)
+			if session.User != nil || session.Denied {
+				lt.t.Errorf("%s login changed via web login: %+v", provider, session)
+			}
+		}
+	})
+}
+
+func TestWebLoginTrace(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	runLoginTest(t, func(lt *loginTest) {
+		exporter.Reset()
+		_, loginUrl := lt.startLogin()
+		lt.expectStatus(lt.authorize(loginUrl, testAlice.OpenID), http.StatusOK, "web login")
+
+		spans := make(map[string]tracetest.SpanStub)
+		for _, s := range exporter.GetSpans() {
+			spans[s.Name] = s
+		}
+
+		expectSpan := func(name string) tracetest.SpanStub {
+			s, ok := spans[name]
+			if !ok {
+				lt.t.Fatalf("span '%s' not found", name)
+			}
+			return s
+		}
+
+		create := expectSpan("POST /login")
+		callback := expectSpan("GET " + webLoginUrl)
+		webLogin := expectSpan("wechat.web_login")
+		tokenCall := expectSpan("wechat.api /sns/oauth2/access_token")
+		userCall := expectSpan("wechat.api /sns/userinfo")
+		complete := expectSpan("login.complete")
+
+		if webLogin.Parent.SpanID() != callback.SpanContext.SpanID() {
+			lt.t.Errorf("wechat.web_login isn't a child of the callback request")
+		}
+
+		for _, s := range []tracetest.SpanStub{tokenCall, userCall, complete} {
+			if s.Parent.SpanID() != webLogin.SpanContext.SpanID() {
+				lt.t.Errorf("%s isn't a child of wechat.web_login", s.Name)
+			}
+		}
+
+		if len(complete.Links) != 1 || complete.Links[0].SpanContext.SpanID() != create.SpanContext.SpanID() {
+			lt.t.Errorf("login.complete isn't linked to the request which created the login: %+v", complete.Links)
+		}
+	})
+}
@@ -1,34 +1,94 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/haowang1013/wechat-server/wechat"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 )
 
 const (
-	port        = 8080
-	wechatUrl   = "/wechat"
-	webLoginUrl = "/wechat/weblogin"
-	qrcodeUrl   = "/qrcode/:str"
-	loginUrl    = "/login/:uuid"
+	port            = 8080
+	wechatUrl       = "/wechat"
+	webLoginUrl     = "/wechat/weblogin"
+	websiteLoginUrl = "/wechat/websitelogin"
+	qrcodeUrl       = "/qrcode/:str"
+	loginQueryUrl   = "/login/:uuid"
+	jssdkConfigUrl  = "/jssdk/config"
+
+	// how long the requests in flight and the remaining spans are waited for when the server stops
+	shutdownTimeout = 10 * time.Second
 )
 
 var (
-	appID        string
-	appSecret    string
-	appToken     string
-	redisAddress string
+	appID           string
+	appSecret       string
+	appToken        string
+	openAppID       string
+	openAppSecret   string
+	redisAddress    string
+	qrcodeLogoPath  string
+	qrcodeSecretKey string
+	qrcodeAllowed   string
+	adminToken      string
+	jssdkDomainList string
+
+	miniProgramAppID     string
+	miniProgramAppSecret string
+
+	apiBaseUrl  string
+	openBaseUrl string
+
+	apiTimeout    time.Duration
+	apiProxy      string
+	apiMaxRetries int
+	apiRateLimit  float64
+	apiRateLimits map[string]float64
+	apiQuotas     map[string]float64
+
+	encodingAESKey string
+
+	logLevelName string
+	logFormat    string
+	otlpEndpoint string
+
+	mediaArchiveDir       string
+	mediaArchiveS3        string
+	mediaArchiveAccessKey string
+	mediaArchiveSecretKey string
+	mediaArchiveBucket    string
+	mediaArchiveSecure    bool
+	mediaArchiveHDVoice   bool
+
+	databaseDriver       string
+	databaseDSN          string
+	followerSyncInterval time.Duration
+
+	historyDatabaseDriver string
+	historyDatabaseDSN    string
+	historyRetention      time.Duration
 
 	server *wechat.Server
 
-	cache kvCache
+	cache        kvCache
+	grantCache   kvCache
+	accountCache kvCache
+	mediaCache   kvCache
+	lockCache    kvCache
+	tokenCache   kvCache
+	kfCache      kvCache
+	quotaCache   kvCache
 )
 
-func init() {
+// loadConfig reads the config from the env variables, it's not done in init so the subcommands don't need them
+func loadConfig() {
 	appID = os.Getenv("WECHAT_APP_ID")
 	if len(appID) == 0 {
 		panic("Failed to get app id from env variable 'WECHAT_APP_ID'")
@@ -44,26 +104,352 @@ func init() {
 		panic("Failed to get app token from env variable 'WECHAT_APP_TOKEN'")
 	}
 
+	// the open platform website app is optional, website login is disabled without it
+	openAppID = os.Getenv("WECHAT_OPEN_APP_ID")
+	openAppSecret = os.Getenv("WECHAT_OPEN_APP_SECRET")
+
+	// the mini-program is optional, mini-program login is disabled without it
+	miniProgramAppID = os.Getenv("WECHAT_MINIPROGRAM_APP_ID")
+	miniProgramAppSecret = os.Getenv("WECHAT_MINIPROGRAM_APP_SECRET")
+
+	// the wechat api can be pointed to a fake server, e.g. cmd/wechat-mock
+	apiBaseUrl = os.Getenv("WECHAT_API_BASE_URL")
+	openBaseUrl = os.Getenv("WECHAT_OPEN_BASE_URL")
+
+	// the wechat api calls time out and retry with the defaults of the wechat package unless configured
+	apiProxy = os.Getenv("WECHAT_HTTP_PROXY")
+	if s := os.Getenv("WECHAT_HTTP_TIMEOUT"); len(s) > 0 {
+		var err error
+		apiTimeout, err = time.ParseDuration(s)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to parse wechat http timeout '%s': %s", s, err))
+		}
+	}
+
+	apiMaxRetries = -1
+	if s := os.Getenv("WECHAT_HTTP_MAX_RETRIES"); len(s) > 0 {
+		var err error
+		apiMaxRetries, err = strconv.Atoi(s)
+		if err != nil || apiMaxRetries < 0 {
+			panic(fmt.Sprintf("Failed to parse wechat http max retries '%s'", s))
+		}
+	}
+
+	// the wechat api calls are not rate limited unless configured, the limits are calls per second
+	if s := os.Getenv("WECHAT_RATE_LIMIT"); len(s) > 0 {
+		var err error
+		apiRateLimit, err = strconv.ParseFloat(s, 64)
+		if err != nil || apiRateLimit < 0 {
+			panic(fmt.Sprintf("Failed to parse wechat rate limit '%s'", s))
+		}
+	}
+
+	var err error
+	apiRateLimits, err = parseApiValues(os.Getenv("WECHAT_API_RATE_LIMITS"))
+	if err != nil {
+		panic(fmt.Sprintf("Failed to parse wechat api rate limits: %s", err))
+	}
+
+	// the daily quotas default to the ones of an ordinary official account
+	apiQuotas, err = parseApiValues(os.Getenv("WECHAT_API_QUOTAS"))
+	if err != nil {
+		panic(fmt.Sprintf("Failed to parse wechat api quotas: %s", err))
+	}
+
+	// the messages are sent in plain text unless the safe mode is enabled with the EncodingAESKey
+	encodingAESKey = os.Getenv("WECHAT_ENCODING_AES_KEY")
+
 	redisAddress = os.Getenv("REDIS_SERVER_ADDRESS")
+	qrcodeLogoPath = os.Getenv("WECHAT_QRCODE_LOGO")
+	qrcodeSecretKey = os.Getenv("WECHAT_QRCODE_SECRET")
+	qrcodeAllowed = os.Getenv("WECHAT_QRCODE_ALLOWLIST")
+	adminToken = os.Getenv("WECHAT_ADMIN_TOKEN")
+	jssdkDomainList = os.Getenv("WECHAT_JSSDK_DOMAINS")
+
+	// media sent by users is archived to either a local directory or a s3 compatible endpoint, if configured
+	mediaArchiveDir = os.Getenv("MEDIA_ARCHIVE_DIR")
+	mediaArchiveS3 = os.Getenv("MEDIA_ARCHIVE_S3_ENDPOINT")
+	mediaArchiveAccessKey = os.Getenv("MEDIA_ARCHIVE_S3_ACCESS_KEY")
+	mediaArchiveSecretKey = os.Getenv("MEDIA_ARCHIVE_S3_SECRET_KEY")
+	mediaArchiveBucket = os.Getenv("MEDIA_ARCHIVE_S3_BUCKET")
+	mediaArchiveSecure = os.Getenv("MEDIA_ARCHIVE_S3_SECURE") == "true"
+	mediaArchiveHDVoice = os.Getenv("MEDIA_ARCHIVE_HD_VOICE") == "true"
+
+	// the log level and format can also be changed at runtime via the admin api
+	logLevelName = os.Getenv("LOG_LEVEL")
+	logFormat = os.Getenv("LOG_FORMAT")
+
+	// spans are only exported if the otlp endpoint is configured, the other OTEL_ variables are read by the exporter
+	otlpEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if len(otlpEndpoint) == 0 {
+		otlpEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	}
+
+	databaseDriver = os.Getenv("DATABASE_DRIVER")
+	if len(databaseDriver) == 0 {
+		databaseDriver = defaultDatabaseDriver
+	}
+	if err := checkDatabaseDriver(databaseDriver); err != nil {
+		panic(err)
+	}
+
+	databaseDSN = os.Getenv("DATABASE_DSN")
+	if len(databaseDSN) == 0 {
+		databaseDSN = defaultDatabaseDSN
+	}
+
+	// followers are only synced on demand if the interval is not configured
+	if s := os.Getenv("FOLLOWER_SYNC_INTERVAL"); len(s) > 0 {
+		var err error
+		followerSyncInterval, err = time.ParseDuration(s)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to parse follower sync interval '%s': %s", s, err))
+		}
+	}
+
+	// the history is kept in the shared database unless a dsn of its own is configured
+	historyDatabaseDriver = os.Getenv("HISTORY_DATABASE_DRIVER")
+	historyDatabaseDSN = os.Getenv("HISTORY_DATABASE_DSN")
+	if len(historyDatabaseDSN) == 0 && len(historyDatabaseDriver) > 0 {
+		panic("History database driver is configured without HISTORY_DATABASE_DSN")
+	}
+	if len(historyDatabaseDriver) == 0 {
+		historyDatabaseDriver = defaultDatabaseDriver
+	}
+	if err := checkDatabaseDriver(historyDatabaseDriver); err != nil {
+		panic(err)
+	}
+
+	// the history is kept forever if the retention is not configured
+	if s := os.Getenv("HISTORY_RETENTION"); len(s) > 0 {
+		var err error
+		historyRetention, err = time.ParseDuration(s)
+		if err != nil || historyRetention <= 0 {
+			panic(fmt.Sprintf("Failed to parse history retention '%s'", s))
+		}
+	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		os.Exit(runSimulator(os.Args[2:]))
+	}
+
+	loadConfig()
+
+	err := setupLogging(logLevelName, logFormat)
+	if err != nil {
+		panic(fmt.Sprintf("failed to setup logging: %s", err))
+	}
+
+	var shutdownTracing func(context.Context) error
+	if len(otlpEndpoint) > 0 {
+		shutdownTracing, err = setupTracing(context.Background())
+		if err != nil {
+			panic(fmt.Sprintf("failed to setup tracing: %s", err))
+		}
+		log.Infof("exporting traces to %s", otlpEndpoint)
+	}
+
 	if len(redisAddress) == 0 {
 		log.Warning("redis server address not configured via environment variable 'REDIS_SERVER_ADDRESS', using in-memory cache")
-		cache = newMemCache()
 	} else {
 		log.Infof("using redis server at: %s", redisAddress)
-		cache = newRedisCache(redisAddress, "wechat-login", time.Hour)
 	}
+	cache = newCache("login", loginSessionLifeTime)
+	grantCache = newCache("grant", wechat.WebRefreshTokenLifeTime)
+	accountCache = newCache("account", 0)
+	mediaCache = newCache("media", 0)
+	lockCache = newCache("lock", 0)
+	tokenCache = newCache("token", 0)
+	kfCache = newCache("kf", kfSessionLifeTime)
+	quotaCache = newCache("quota", quotaLifeTime)
+
+	if len(mediaArchiveS3) > 0 {
+		sink, err := newS3Sink(mediaArchiveS3, mediaArchiveAccessKey, mediaArchiveSecretKey, mediaArchiveBucket, mediaArchiveSecure)
+		if err != nil {
+			panic(fmt.Sprintf("failed to connect to media archive '%s': %s", mediaArchiveS3, err))
+		}
+		log.Infof("archiving media to bucket '%s' at: %s", mediaArchiveBucket, mediaArchiveS3)
+		archive = newMediaArchive(sink, mediaCache, mediaArchiveHDVoice)
+	} else if len(mediaArchiveDir) > 0 {
+		log.Infof("archiving media to directory: %s", mediaArchiveDir)
+		archive = newMediaArchive(newFileSink(mediaArchiveDir), mediaCache, mediaArchiveHDVoice)
+	}
+
+	db, err := openDatabase(databaseDriver, databaseDSN)
+	if err != nil {
+		panic(err)
+	}
+	log.Infof("using %s database: %s", databaseDriver, databaseDSN)
+
+	followers, err = newSqlFollowerStore(db, databaseDriver)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create follower store: %s", err))
+	}
+
+	broadcasts, err = newSqlBroadcastStore(db, databaseDriver)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create broadcast store: %s", err))
+	}
+
+	jobs, err := newSqlJobStore(db, databaseDriver)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create job store: %s", err))
+	}
+	scheduler = newJobScheduler(jobs, lockCache, defaultJobPollInterval)
+
+	historyDB, historyDriver := db, databaseDriver
+	if len(historyDatabaseDSN) > 0 {
+		historyDB, err = openDatabase(historyDatabaseDriver, historyDatabaseDSN)
+		if err != nil {
+			panic(err)
+		}
+		historyDriver = historyDatabaseDriver
+		log.Infof("keeping conversation history in %s database: %s", historyDriver, historyDatabaseDSN)
+	}
+
+	history, err = newSqlHistoryStore(historyDB, historyDriver)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create history store: %s", err))
+	}
+
+	err = initQRCodeSigning(qrcodeSecretKey, qrcodeAllowed)
+	if err != nil {
+		panic(err)
+	}
+	initJSSDKDomains(jssdkDomainList)
+	if len(qrcodeLogoPath) > 0 {
+		err := loadQRCodeLogo(qrcodeLogoPath)
+		if err != nil {
+			panic(fmt.Sprintf("failed to load qr code logo '%s': %s", qrcodeLogoPath, err))
+		}
+	}
+
+	if len(apiBaseUrl) > 0 || len(openBaseUrl) > 0 {
+		wechat.SetBaseUrls(apiBaseUrl, openBaseUrl)
+		log.Warningf("using wechat api at %s, authorization pages at %s", wechat.DefaultClient.BaseUrl, wechat.DefaultClient.OpenUrl)
+	}
+
+	if apiTimeout > 0 {
+		wechat.DefaultClient.HTTPClient.Timeout = apiTimeout
+	}
+
+	if apiMaxRetries >= 0 {
+		wechat.DefaultClient.MaxRetries = apiMaxRetries
+	}
+
+	if len(apiProxy) > 0 {
+		err := wechat.DefaultClient.SetProxy(apiProxy)
+		if err != nil {
+			panic(fmt.Sprintf("failed to set wechat http proxy: %s", err))
+		}
+		log.Infof("calling wechat api via proxy: %s", apiProxy)
+	}
+
+	setupApiLimits(quotaCache)
+	wechat.DefaultClient.Observer = new(metricsObserver)
+	wechat.DefaultClient.Logger = new(logger)
+	wechat.DefaultClient.Recorder = newHistoryRecorder(history)
+	setupServer()
+
 	gin.SetMode(gin.ReleaseMode)
+	router := newRouter()
 
-	router := gin.Default()
-	router.LoadHTMLGlob("templates/*")
+	if followerSyncInterval > 0 {
+		go runFollowerSync(followers, followerSyncInterval)
+	}
+
+	go scheduler.run()
+
+	if historyRetention > 0 {
+		go runHistoryPurge(history, historyRetention)
+	}
+
+	log.Debugf("listen on port %d", port)
+	err = serve(router, fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Errorf("server stopped: %s", err)
+	}
+
+	if shutdownTracing != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			log.Errorf("failed to flush traces: %s", err)
+		}
+	}
+}
+
+// serve runs the router until SIGTERM or SIGINT is received, then waits for the requests in flight to finish
+func serve(router *gin.Engine, addr string) error {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: router,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(stop)
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-stop:
+		log.Infof("received %s, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
+
+// newCache creates the named cache in redis if it's configured, or in memory otherwise
+func newCache(name string, valueLifeTime time.Duration) kvCache {
+	if len(redisAddress) == 0 {
+		return instrumentCache(newMemCache(valueLifeTime), name, "mem")
+	}
+	return instrumentCache(newRedisCache(redisAddress, "wechat-"+name, valueLifeTime), name, "redis")
+}
 
-	// create the server and setup router
-	server := wechat.NewServer(appID, appSecret, appToken)
+// setupServer creates the wechat server and the login providers
+func setupServer() {
+	server = wechat.NewServer(appID, appSecret, appToken)
 	server.SetHandler(new(handler))
 	server.SetLogger(new(logger))
+	server.SetObserver(new(metricsObserver))
+	server.SetGrantStore(newGrantStore(grantCache))
+	server.SetAccessTokenStore(newAccessTokenStore(tokenCache))
+	wechat.DefaultClient.AccessTokens = server
+	if history != nil {
+		server.SetRecorder(newHistoryRecorder(history))
+	}
+	if len(encodingAESKey) > 0 {
+		err := server.SetEncodingAESKey(encodingAESKey)
+		if err != nil {
+			panic(fmt.Sprintf("failed to set EncodingAESKey: %s", err))
+		}
+		log.Info("safe mode enabled, encrypted messages are accepted")
+	}
+
+	addLoginProvider(newOfficialAccountProvider(appID))
+	if len(openAppID) > 0 && len(openAppSecret) > 0 {
+		log.Infof("website login enabled with open platform app: %s", openAppID)
+		server.SetWebsiteApp(openAppID, openAppSecret)
+		addLoginProvider(newWebsiteProvider(openAppID))
+	}
+}
+
+// newRouter creates the router with all the endpoints, setupServer must be called first
+func newRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(tracing(), requestID(), accessLog(), gin.Recovery())
+	router.LoadHTMLGlob("templates/*")
 
 	server.SetupRouter(router, wechatUrl)
 
@@ -72,6 +458,13 @@ func main() {
 		server.HandleWebLogin(c)
 	})
 
+	router.GET(websiteLoginUrl, func(c *gin.Context) {
+		server.HandleWebsiteLogin(c)
+	})
+
+	// prometheus metrics endpoint
+	router.GET(metricsUrl, gin.WrapH(promhttp.Handler()))
+
 	// qr code endpoint
 	router.GET(qrcodeUrl, func(c *gin.Context) {
 		str := c.Param("str")
@@ -79,26 +472,173 @@ func main() {
 		generateQRCode(str, c, unescape == "true")
 	})
 
+	router.GET(jssdkConfigUrl, func(c *gin.Context) {
+		jssdkConfigHandler(c)
+	})
+
 	// client facing login endpoint
 	router.POST("/login", func(c *gin.Context) {
 		loginRequestHandler(c)
 	})
 
-	router.GET(loginUrl, func(c *gin.Context) {
+	router.GET(loginQueryUrl, func(c *gin.Context) {
 		uuid := c.Param("uuid")
 		loginQueryHandler(uuid, c)
 	})
 
+	// mini-program login endpoints
+	if len(miniProgramAppID) > 0 && len(miniProgramAppSecret) > 0 {
+		log.Infof("mini-program login enabled with app: %s", miniProgramAppID)
+		router.POST("/miniprogram/login", func(c *gin.Context) {
+			miniProgramLoginHandler(c)
+		})
+
+		router.POST("/miniprogram/phone", func(c *gin.Context) {
+			miniProgramPhoneHandler(c)
+		})
+	}
+
+	admin := router.Group("/admin", adminAuth())
+
+	// parametric qr code endpoint
+	admin.POST("/qrcode", func(c *gin.Context) {
+		sceneQRCodeHandler(c)
+	})
+
+	// follower directory endpoints
+	admin.GET("/followers", func(c *gin.Context) {
+		followerQueryHandler(c)
+	})
+
+	admin.GET("/followers/:openid", func(c *gin.Context) {
+		followerGetHandler(c.Param("openid"), c)
+	})
+
+	admin.POST("/followers/sync", func(c *gin.Context) {
+		followerSyncHandler(c)
+	})
+
+	// broadcast endpoints
+	admin.POST("/broadcasts", func(c *gin.Context) {
+		broadcastCreateHandler(c)
+	})
+
+	admin.POST("/broadcasts/preview", func(c *gin.Context) {
+		broadcastPreviewHandler(c)
+	})
+
+	admin.GET("/broadcasts", func(c *gin.Context) {
+		broadcastListHandler(c)
+	})
+
+	admin.GET("/broadcasts/:id", func(c *gin.Context) {
+		broadcastGetHandler(c.Param("id"), c)
+	})
+
+	admin.DELETE("/broadcasts/:id", func(c *gin.Context) {
+		broadcastDeleteHandler(c.Param("id"), c)
+	})
+
+	// scheduled job endpoints
+	admin.POST("/jobs", func(c *gin.Context) {
+		jobCreateHandler(c)
+	})
+
+	admin.GET("/jobs", func(c *gin.Context) {
+		jobListHandler(c)
+	})
+
+	admin.GET("/jobs/:id", func(c *gin.Context) {
+		jobGetHandler(c.Param("id"), c)
+	})
+
+	admin.DELETE("/jobs/:id", func(c *gin.Context) {
+		jobDeleteHandler(c.Param("id"), c)
+	})
+
+	// customer service endpoints
+	admin.GET("/kf/accounts", func(c *gin.Context) {
+		kfAccountListHandler(c)
+	})
+
+	admin.POST("/kf/accounts", func(c *gin.Context) {
+		kfAccountSaveHandler("", c)
+	})
+
+	admin.PUT("/kf/accounts/:account", func(c *gin.Context) {
+		kfAccountSaveHandler(c.Param("account"), c)
+	})
+
+	admin.DELETE("/kf/accounts/:account", func(c *gin.Context) {
+		kfAccountDeleteHandler(c.Param("account"), c)
+	})
+
+	admin.POST("/kf/accounts/:account/invite", func(c *gin.Context) {
+		kfAccountInviteHandler(c.Param("account"), c)
+	})
+
+	admin.POST("/kf/accounts/:account/avatar", func(c *gin.Context) {
+		kfAccountAvatarHandler(c.Param("account"), c)
+	})
+
+	admin.GET("/kf/sessions", func(c *gin.Context) {
+		kfSessionListHandler(c)
+	})
+
+	admin.POST("/kf/sessions", func(c *gin.Context) {
+		kfSessionHandler(true, c)
+	})
+
+	admin.POST("/kf/sessions/close", func(c *gin.Context) {
+		kfSessionHandler(false, c)
+	})
+
+	admin.GET("/kf/waiting", func(c *gin.Context) {
+		kfWaitingListHandler(c)
+	})
+
+	// log level endpoint
+	admin.GET("/log/level", func(c *gin.Context) {
+		logLevelHandler(c)
+	})
+
+	admin.PUT("/log/level", func(c *gin.Context) {
+		logLevelHandler(c)
+	})
+
+	// conversation history endpoints
+	admin.GET("/history", func(c *gin.Context) {
+		historySearchHandler(c)
+	})
+
+	admin.GET("/history/export", func(c *gin.Context) {
+		historyExportHandler(c)
+	})
+
+	admin.GET("/history/:openid", func(c *gin.Context) {
+		historyTimelineHandler(c.Param("openid"), c)
+	})
+
+	// wechat api quota endpoints
+	admin.GET("/quota", func(c *gin.Context) {
+		quotaHandler(c)
+	})
+
+	admin.POST("/quota/clear", func(c *gin.Context) {
+		quotaClearHandler(c)
+	})
+
 	router.GET("/", func(c *gin.Context) {
 		resp := map[string]string{
-			"wechat_url":   makeSimpleUrl("http", c.Request.Host, wechatUrl).String(),
-			"weblogin_url": makeSimpleUrl("http", c.Request.Host, webLoginUrl).String(),
-			"qrcode_url":   makeSimpleUrl("http", c.Request.Host, qrcodeUrl).String(),
-			"login_url":    makeSimpleUrl("http", c.Request.Host, loginUrl).String(),
+			"wechat_url":       makeSimpleUrl("http", c.Request.Host, wechatUrl).String(),
+			"weblogin_url":     makeSimpleUrl("http", c.Request.Host, webLoginUrl).String(),
+			"websitelogin_url": makeSimpleUrl("http", c.Request.Host, websiteLoginUrl).String(),
+			"qrcode_url":       makeSimpleUrl("http", c.Request.Host, qrcodeUrl).String(),
+			"login_url":        makeSimpleUrl("http", c.Request.Host, loginQueryUrl).String(),
+			"jssdk_config_url": makeSimpleUrl("http", c.Request.Host, jssdkConfigUrl).String(),
 		}
 		c.IndentedJSON(http.StatusOK, resp)
 	})
 
-	log.Debugf("listen on port %d", port)
-	router.Run(fmt.Sprintf(":%d", port))
+	return router
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/haowang1013/wechat-server/wechat"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"strconv"
+	"time"
+)
+
+const (
+	metricsUrl = "/metrics"
+
+	// wechat gives up on the reply after 5 seconds and retries the message
+	messageBudget = 5 * time.Second
+)
+
+// the stages of a login, a login is created by the client, scanned when the user authorizes it for the first time,
+// or denied if the user refuses, then confirmed once the user is logged in. It's expired if the uuid is gone
+// by the time wechat calls back, the logins without any callback are the created ones not in the other stages
+const (
+	loginCreated   = "created"
+	loginScanned   = "scanned"
+	loginConfirmed = "confirmed"
+	loginDenied    = "denied"
+	loginExpired   = "expired"
+)
+
+var (
+	messagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wechat_messages_total",
+		Help: "Messages and events received from wechat.",
+	}, []string{"msg_type", "event"})
+
+	messageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wechat_message_handler_duration_seconds",
+		Help:    "Time taken to reply to the messages from wechat.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2, 3, 4, 5, 10},
+	}, []string{"msg_type"})
+
+	messagesOverBudget = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wechat_message_handler_over_budget_total",
+		Help: "Messages whose replies took longer than the 5 seconds wechat waits for.",
+	}, []string{"msg_type"})
+
+	signatureFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wechat_signature_failures_total",
+		Help: "Requests to the wechat endpoint with an invalid signature.",
+	})
+
+	apiCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wechat_api_calls_total",
+		Help: "Attempts of the wechat api calls by the errcode, or 'error' if the call failed without one.",
+	}, []string{"api", "errcode"})
+
+	apiDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wechat_api_call_duration_seconds",
+		Help:    "Latency of the attempts of the wechat api calls.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"api"})
+
+	tokenRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wechat_token_refreshes_total",
+		Help: "Tokens obtained from wechat, e.g. the access token.",
+	}, []string{"token"})
+
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wechat_cache_requests_total",
+		Help: "Lookups of the caches by the result, either hit or miss.",
+	}, []string{"cache", "backend", "result"})
+
+	loginsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wechat_logins_total",
+		Help: "Logins by the provider and the stage they reached.",
+	}, []string{"provider", "stage"})
+)
+
+// metricsObserver collects the metrics of the wechat server and the api calls
+type metricsObserver struct {
+}
+
+func (m *metricsObserver) ObserveMessage(msgType, event string, duration time.Duration) {
+	messagesTotal.WithLabelValues(msgType, event).Inc()
+	messageDuration.WithLabelValues(msgType).Observe(duration.Seconds())
+	if duration > messageBudget {
+		messagesOverBudget.WithLabelValues(msgType).Inc()
+	}
+}
+
+func (m *metricsObserver) ObserveSignatureFailure() {
+	signatureFailures.Inc()
+}
+
+func (m *metricsObserver) ObserveApiCall(api string, duration time.Duration, err error) {
+	apiCalls.WithLabelValues(api, errCodeLabel(err)).Inc()
+	apiDuration.WithLabelValues(api).Observe(duration.Seconds())
+}
+
+func (m *metricsObserver) ObserveTokenRefresh(token string) {
+	tokenRefreshes.WithLabelValues(token).Inc()
+}
+
+func errCodeLabel(err error) string {
+	if err == nil {
+		return "0"
+	}
+
+	var we *wechat.WeChatError
+	if errors.As(err, &we) {
+		return strconv.Itoa(we.Code)
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return "canceled"
+	}
+	return "error"
+}
+
+func observeLogin(provider, stage string) {
+	loginsTotal.WithLabelValues(provider, stage).Inc()
+}
+
+/**
+* instrumented cache
+ */
+type instrumentedCache struct {
+	kvCache
+	name    string
+	backend string
+}
+
+func (k *instrumentedCache) get(key string) (string, bool) {
+	v, ok := k.kvCache.get(key)
+	k.observe(ok)
+	return v, ok
+}
+
+func (k *instrumentedCache) exists(key string) bool {
+	ok := k.kvCache.exists(key)
+	k.observe(ok)
+	return ok
+}
+
+func (k *instrumentedCache) observe(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheRequests.WithLabelValues(k.name, k.backend, result).Inc()
+}
+
+// instrumentCache counts the hits and misses of the lookups of the cache
+func instrumentCache(cache kvCache, name, backend string) kvCache {
+	k := new(instrumentedCache)
+	k.kvCache = cache
+	k.name = name
+	k.backend = backend
+	return k
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/haowang1013/wechat-server/wechat"
+	"net/http"
+)
+
+const (
+	miniProgramProvider = "miniprogram"
+)
+
+type miniProgramLoginRequest struct {
+	Code string `json:"code"`
+
+	// optional user info from wx.getUserInfo
+	RawData       string `json:"raw_data"`
+	Signature     string `json:"signature"`
+	EncryptedData string `json:"encrypted_data"`
+	IV            string `json:"iv"`
+}
+
+// miniProgramLoginHandler logs the mini-program user in with the code from wx.login, the response is the same
+// as the login query, and the uuid identifies the session in the following requests
+func miniProgramLoginHandler(c *gin.Context) {
+	req := new(miniProgramLoginRequest)
+	err := c.BindJSON(req)
+	if err != nil {
+		return
+	}
+
+	if len(req.Code) == 0 {
+		c.String(http.StatusBadRequest, "code is required")
+		return
+	}
+
+	mp, err := wechat.Code2Session(c.Request.Context(), miniProgramAppID, miniProgramAppSecret, req.Code)
+	if err != nil {
+		logFor(c.Request.Context()).Errorf("failed to get mini-program session: %s", err)
+		c.String(http.StatusUnauthorized, "invalid code")
+		return
+	}
+
+	u := new(wechat.UserInfo)
+	if len(req.EncryptedData) > 0 {
+		if len(req.RawData) > 0 && !wechat.CheckRawDataSignature(req.RawData, mp.SessionKey, req.Signature) {
+			c.String(http.StatusBadRequest, "invalid signature")
+			return
+		}
+
+		info, err := wechat.DecryptUserInfo(miniProgramAppID, mp.SessionKey, req.EncryptedData, req.IV)
+		if err != nil {
+			c.String(http.StatusBadRequest, "failed to decrypt user info: %s", err)
+			return
+		}
+
+		if info.OpenID != mp.OpenID {
+			c.String(http.StatusBadRequest, "user info doesn't belong to the session")
+			return
+		}
+		u = info.UserInfo()
+	}
+
+	u.OpenID = mp.OpenID
+	if len(u.UnionID) == 0 {
+		u.UnionID = mp.UnionID
+	}
+
+	uuid := newLoginUUID()
+	session := newLoginSession(c.Request.Context(), miniProgramProvider)
+	session.SessionKey = mp.SessionKey
+	observeLogin(miniProgramProvider, loginCreated)
+	err = completeLogin(c.Request.Context(), uuid, session, u)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, loginResult(uuid, session))
+}
+
+// miniProgramPhoneHandler decrypts the phone number of the user logged in with the uuid
+func miniProgramPhoneHandler(c *gin.Context) {
+	req := new(struct {
+		UUID          string `json:"uuid"`
+		EncryptedData string `json:"encrypted_data"`
+		IV            string `json:"iv"`
+	})
+	err := c.BindJSON(req)
+	if err != nil {
+		return
+	}
+
+	session, ok := getLoginSession(req.UUID)
+	if !ok || session.Provider != miniProgramProvider || session.User == nil || len(session.SessionKey) == 0 {
+		c.String(http.StatusNotFound, "uuid not found")
+		return
+	}
+
+	phone, err := wechat.DecryptPhoneNumber(miniProgramAppID, session.SessionKey, req.EncryptedData, req.IV)
+	if err != nil {
+		c.String(http.StatusBadRequest, "failed to decrypt phone number: %s", err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, map[string]interface{}{
+		"uuid":              req.UUID,
+		"openid":            session.User.OpenID,
+		"phone_number":      phone.PhoneNumber,
+		"pure_phone_number": phone.PurePhoneNumber,
+		"country_code":      phone.CountryCode,
+	})
+}
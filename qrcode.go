@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	qrcodeDefaultSize   = 256
+	qrcodeMinSize       = 64
+	qrcodeMaxSize       = 2048
+	qrcodeDefaultMargin = 4
+	qrcodeMaxMargin     = 16
+	qrcodeMaxAge        = 24 * 60 * 60
+
+	// the logo covers at most 1/5 of the width, which the high recovery levels can afford
+	qrcodeLogoRatio = 5
+)
+
+var (
+	qrcodeLevels = map[string]qrcode.RecoveryLevel{
+		"low":     qrcode.Low,
+		"medium":  qrcode.Medium,
+		"high":    qrcode.High,
+		"highest": qrcode.Highest,
+	}
+
+	qrcodeLogo     image.Image
+	qrcodeLogoHash string
+)
+
+type qrcodeOptions struct {
+	size       int
+	level      string
+	format     string
+	foreground color.RGBA
+	background color.RGBA
+	margin     int
+	logo       bool
+}
+
+// key identifies the rendered image of the options, used to build the etag
+func (o *qrcodeOptions) key() string {
+	return fmt.Sprintf("%d:%s:%s:%v:%v:%d:%t", o.size, o.level, o.format, o.foreground, o.background, o.margin, o.logo)
+}
+
+func parseQRCodeOptions(c *gin.Context) (*qrcodeOptions, error) {
+	var err error
+	o := new(qrcodeOptions)
+
+	o.size, err = parseIntQuery(c, "size", qrcodeDefaultSize, qrcodeMinSize, qrcodeMaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	o.margin, err = parseIntQuery(c, "margin", qrcodeDefaultMargin, 0, qrcodeMaxMargin)
+	if err != nil {
+		return nil, err
+	}
+
+	o.logo = c.DefaultQuery("logo", "false") == "true"
+	if o.logo && qrcodeLogo == nil {
+		return nil, errors.New("logo not configured")
+	}
+
+	defaultLevel := "medium"
+	if o.logo {
+		defaultLevel = "highest"
+	}
+	o.level = c.DefaultQuery("level", defaultLevel)
+	if _, ok := qrcodeLevels[o.level]; !ok {
+		return nil, fmt.Errorf("invalid level '%s', must be one of low, medium, high, highest", o.level)
+	}
+	if o.logo && o.level != "high" && o.level != "highest" {
+		return nil, errors.New("logo requires level high or highest")
+	}
+
+	o.format = c.DefaultQuery("format", "png")
+	if o.format != "png" && o.format != "svg" {
+		return nil, fmt.Errorf("invalid format '%s', must be png or svg", o.format)
+	}
+
+	o.foreground, err = parseColorQuery(c, "fg", color.RGBA{0, 0, 0, 255})
+	if err != nil {
+		return nil, err
+	}
+
+	o.background, err = parseColorQuery(c, "bg", color.RGBA{255, 255, 255, 255})
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+func parseIntQuery(c *gin.Context, name string, defaultValue, min, max int) (int, error) {
+	s := c.Query(name)
+	if len(s) == 0 {
+		return defaultValue, nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("invalid %s '%s', must be an integer between %d and %d", name, s, min, max)
+	}
+	return v, nil
+}
+
+// parseColorQuery accepts colors in the form of RRGGBB or RGB, with an optional leading '#'
+func parseColorQuery(c *gin.Context, name string, defaultValue color.RGBA) (color.RGBA, error) {
+	s := strings.TrimPrefix(c.Query(name), "#")
+	if len(s) == 0 {
+		return defaultValue, nil
+	}
+
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 3 {
+		return defaultValue, fmt.Errorf("invalid %s '%s', must be a hex color like 000000", name, c.Query(name))
+	}
+	return color.RGBA{b[0], b[1], b[2], 255}, nil
+}
+
+func loadQRCodeLogo(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+
+	var buff bytes.Buffer
+	err = png.Encode(&buff, img)
+	if err != nil {
+		return err
+	}
+
+	hash := sha1.Sum(buff.Bytes())
+	qrcodeLogo = img
+	qrcodeLogoHash = hex.EncodeToString(hash[:])
+	return nil
+}
+
+func generateQRCode(str string, c *gin.Context, unescape bool) {
+	str, expireTime, err := resolveQRContent(str, unescape)
+	if err != nil {
+		logFor(c.Request.Context()).Warningf("qr code request rejected: %s", err)
+		c.String(http.StatusForbidden, err.Error())
+		return
+	}
+
+	o, err := parseQRCodeOptions(c)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	hash := sha1.Sum([]byte(str + "|" + o.key() + "|" + qrcodeLogoHash))
+	etag := fmt.Sprintf("\"%s\"", hex.EncodeToString(hash[:]))
+	if expireTime.IsZero() {
+		c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", qrcodeMaxAge))
+	} else {
+		// the token is only meant for the user who started the login, and stops working when it expires
+		maxAge := int64(time.Until(expireTime) / time.Second)
+		if maxAge < 0 {
+			maxAge = 0
+		}
+		c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	}
+	c.Header("ETag", etag)
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	bitmap, err := encodeQRCode(str, o)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// every module needs at least one pixel, otherwise some of them are dropped and the code can't be scanned
+	if modules := len(bitmap) + 2*o.margin; o.size < modules {
+		c.String(http.StatusBadRequest, "size %d is too small for the qr code, must be at least %d", o.size, modules)
+		return
+	}
+
+	data, contentType, err := renderQRCode(bitmap, o)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.Data(http.StatusOK, contentType, data)
+}
+
+func encodeQRCode(str string, o *qrcodeOptions) ([][]bool, error) {
+	q, err := qrcode.New(str, qrcodeLevels[o.level])
+	if err != nil {
+		return nil, err
+	}
+
+	// the margin is drawn by ourselves so that it can be customized
+	q.DisableBorder = true
+	return q.Bitmap(), nil
+}
+
+func renderQRCode(bitmap [][]bool, o *qrcodeOptions) ([]byte, string, error) {
+	if o.format == "svg" {
+		data, err := renderQRCodeSVG(bitmap, o)
+		return data, "image/svg+xml", err
+	}
+
+	data, err := renderQRCodePNG(bitmap, o)
+	return data, "image/png", err
+}
+
+func renderQRCodePNG(bitmap [][]bool, o *qrcodeOptions) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, o.size, o.size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(o.background), image.Point{}, draw.Src)
+
+	fg := image.NewUniform(o.foreground)
+	total := len(bitmap) + 2*o.margin
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+
+			r := image.Rect(
+				(x+o.margin)*o.size/total,
+				(y+o.margin)*o.size/total,
+				(x+o.margin+1)*o.size/total,
+				(y+o.margin+1)*o.size/total)
+			draw.Draw(img, r, fg, image.Point{}, draw.Src)
+		}
+	}
+
+	if o.logo {
+		drawQRCodeLogo(img, o)
+	}
+
+	var buff bytes.Buffer
+	err := png.Encode(&buff, img)
+	if err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// drawQRCodeLogo scales the logo into the center of the image, on top of a padding in the background color
+func drawQRCodeLogo(img *image.RGBA, o *qrcodeOptions) {
+	logoSize := o.size / qrcodeLogoRatio
+	padding := logoSize / 10
+	offset := (o.size - logoSize) / 2
+
+	box := image.Rect(offset-padding, offset-padding, offset+logoSize+padding, offset+logoSize+padding)
+	draw.Draw(img, box, image.NewUniform(o.background), image.Point{}, draw.Src)
+
+	// nearest neighbour scaling is good enough for a logo of this size
+	src := qrcodeLogo.Bounds()
+	scaled := image.NewRGBA(image.Rect(0, 0, logoSize, logoSize))
+	for y := 0; y < logoSize; y++ {
+		for x := 0; x < logoSize; x++ {
+			sx := src.Min.X + x*src.Dx()/logoSize
+			sy := src.Min.Y + y*src.Dy()/logoSize
+			scaled.Set(x, y, qrcodeLogo.At(sx, sy))
+		}
+	}
+
+	draw.Draw(img, scaled.Bounds().Add(image.Pt(offset, offset)), scaled, image.Point{}, draw.Over)
+}
+
+func renderQRCodeSVG(bitmap [][]bool, o *qrcodeOptions) ([]byte, error) {
+	total := len(bitmap) + 2*o.margin
+
+	var buff bytes.Buffer
+	fmt.Fprintf(&buff, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, o.size, o.size, total, total)
+	fmt.Fprintf(&buff, `<rect width="%d" height="%d" fill="%s"/>`, total, total, svgColor(o.background))
+	fmt.Fprintf(&buff, `<path fill="%s" d="`, svgColor(o.foreground))
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&buff, "M%d %dh1v1h-1z", x+o.margin, y+o.margin)
+			}
+		}
+	}
+	buff.WriteString(`"/>`)
+
+	if o.logo {
+		var logo bytes.Buffer
+		err := png.Encode(&logo, qrcodeLogo)
+		if err != nil {
+			return nil, err
+		}
+
+		logoSize := float64(total) / qrcodeLogoRatio
+		padding := logoSize / 10
+		offset := (float64(total) - logoSize) / 2
+		fmt.Fprintf(&buff, `<rect x="%g" y="%g" width="%g" height="%g" fill="%s"/>`,
+			offset-padding, offset-padding, logoSize+2*padding, logoSize+2*padding, svgColor(o.background))
+		fmt.Fprintf(&buff, `<image x="%g" y="%g" width="%g" height="%g" href="data:image/png;base64,%s"/>`,
+			offset, offset, logoSize, logoSize, base64.StdEncoding.EncodeToString(logo.Bytes()))
+	}
+
+	buff.WriteString("</svg>")
+	return buff.Bytes(), nil
+}
+
+func svgColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	qrcodeSecret    []byte
+	qrcodeAllowlist []*url.URL
+
+	errQRTokenInvalid = errors.New("qr code token invalid")
+	errQRTokenExpired = errors.New("qr code token expired")
+	errQRCodeRejected = errors.New("qr code content not allowed")
+)
+
+// qrPayload is the signed content of a qr code token
+type qrPayload struct {
+	Data       string `json:"d"`
+	ExpireTime int64  `json:"e"`
+}
+
+// initQRCodeSigning sets the key used to sign qr code tokens, a random key is generated if it's empty,
+// in which case the tokens don't survive a restart and can't be shared by multiple servers.
+// The allowlist is a comma separated list of urls, each with a scheme and a host
+func initQRCodeSigning(secret string, allowlist string) error {
+	if len(secret) > 0 {
+		qrcodeSecret = []byte(secret)
+	} else {
+		log.Warning("qr code secret not configured via environment variable 'WECHAT_QRCODE_SECRET', using a random one")
+		qrcodeSecret = make([]byte, 32)
+		_, err := rand.Read(qrcodeSecret)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	qrcodeAllowlist = nil
+	for _, entry := range strings.Split(allowlist, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		u, err := url.Parse(entry)
+		if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+			return fmt.Errorf("invalid qr code allowlist entry '%s', must be a url with a scheme and a host", entry)
+		}
+		qrcodeAllowlist = append(qrcodeAllowlist, u)
+	}
+	return nil
+}
+
+// signQRPayload mints a token which can be rendered by the qr code endpoint until it expires
+func signQRPayload(data string, lifeTime time.Duration) string {
+	p := qrPayload{
+		Data:       data,
+		ExpireTime: time.Now().Add(lifeTime).Unix(),
+	}
+
+	// marshalling a struct of a string and an int never fails
+	buff, _ := json.Marshal(&p)
+	payload := base64.RawURLEncoding.EncodeToString(buff)
+	return payload + "." + qrSignature(payload)
+}
+
+// verifyQRToken returns the data of the token and when it expires
+func verifyQRToken(token string) (string, time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", time.Time{}, errQRTokenInvalid
+	}
+
+	if !hmac.Equal([]byte(parts[1]), []byte(qrSignature(parts[0]))) {
+		return "", time.Time{}, errQRTokenInvalid
+	}
+
+	buff, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", time.Time{}, errQRTokenInvalid
+	}
+
+	p := new(qrPayload)
+	err = json.Unmarshal(buff, p)
+	if err != nil {
+		return "", time.Time{}, errQRTokenInvalid
+	}
+
+	if time.Now().Unix() > p.ExpireTime {
+		return "", time.Time{}, errQRTokenExpired
+	}
+	return p.Data, time.Unix(p.ExpireTime, 0), nil
+}
+
+func qrSignature(payload string) string {
+	mac := hmac.New(sha256.New, qrcodeSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// resolveQRContent returns what the qr code should encode, which is either the data of a signed token,
+// or a raw url matching one of the allowed urls. The expire time is only set for the tokens.
+func resolveQRContent(str string, unescape bool) (string, time.Time, error) {
+	data, expireTime, err := verifyQRToken(str)
+	if err != errQRTokenInvalid {
+		return data, expireTime, err
+	}
+
+	if unescape {
+		str, _ = url.QueryUnescape(str)
+	}
+
+	u, err := url.Parse(str)
+	if err != nil {
+		return "", time.Time{}, errQRCodeRejected
+	}
+
+	for _, allowed := range qrcodeAllowlist {
+		if qrUrlAllowed(u, allowed) {
+			return str, time.Time{}, nil
+		}
+	}
+	return "", time.Time{}, errQRCodeRejected
+}
+
+// qrUrlAllowed tells if the url has the same scheme and host as the allowed url, and is under its path.
+// The host is compared as a whole, so that e.g. https://example.com doesn't allow https://example.com.evil.com
+func qrUrlAllowed(u, allowed *url.URL) bool {
+	if !strings.EqualFold(u.Scheme, allowed.Scheme) || !strings.EqualFold(u.Host, allowed.Host) || u.User != nil {
+		return false
+	}
+
+	prefix := strings.TrimSuffix(allowed.Path, "/")
+	if len(prefix) == 0 {
+		return true
+	}
+
+	// the dot segments are resolved like the browsers do, so that e.g. /app/../evil isn't under /app
+	p := path.Clean("/" + u.Path)
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/haowang1013/wechat-server/wechat"
+	"golang.org/x/time/rate"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	quotaKeyPrefix = "quota."
+
+	// the counters of a day are kept a bit longer than the day
+	quotaLifeTime = 48 * time.Hour
+)
+
+// quotaStore counts the wechat api calls in the kv cache, keyed by the day and the api path
+type quotaStore struct {
+	cache kvCache
+}
+
+func (q *quotaStore) key(api, day string) string {
+	return quotaKeyPrefix + day + "." + api
+}
+
+func (q *quotaStore) IncrCalls(api, day string) (int64, error) {
+	return q.cache.incr(q.key(api, day))
+}
+
+func (q *quotaStore) Calls(api, day string) (int64, error) {
+	s, ok := q.cache.get(q.key(api, day))
+	if !ok {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func (q *quotaStore) ResetCalls(api, day string) error {
+	return q.cache.set(q.key(api, day), "0")
+}
+
+func newQuotaStore(cache kvCache) *quotaStore {
+	q := new(quotaStore)
+	q.cache = cache
+	return q
+}
+
+// parseApiValues parses the comma separated list of api paths and values, e.g. '/cgi-bin/token=1000,/sns/userinfo=20'
+func parseApiValues(s string) (map[string]float64, error) {
+	values := make(map[string]float64)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		i := strings.LastIndex(item, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid item '%s', should be path=value", item)
+		}
+
+		v, err := strconv.ParseFloat(item[i+1:], 64)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid value of '%s'", item[:i])
+		}
+		values[item[:i]] = v
+	}
+	return values, nil
+}
+
+func newRateLimiter(callsPerSecond float64) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(callsPerSecond), int(math.Max(1, math.Ceil(callsPerSecond))))
+}
+
+// setupApiLimits counts the wechat api calls in the cache and limits their rate as configured
+func setupApiLimits(quotaCache kvCache) {
+	tracker := wechat.NewQuotaTracker(newQuotaStore(quotaCache), new(logger))
+	for api, quota := range apiQuotas {
+		tracker.Quotas[api] = int64(quota)
+	}
+	wechat.DefaultClient.Quota = tracker
+
+	if apiRateLimit > 0 {
+		log.Infof("limiting wechat api calls to %g per second", apiRateLimit)
+		wechat.DefaultClient.Limiter = newRateLimiter(apiRateLimit)
+	}
+
+	if len(apiRateLimits) > 0 {
+		wechat.DefaultClient.Limiters = make(map[string]*rate.Limiter)
+		for api, limit := range apiRateLimits {
+			log.Infof("limiting calls of %s to %g per second", api, limit)
+			wechat.DefaultClient.Limiters[api] = newRateLimiter(limit)
+		}
+	}
+}
+
+// quotaHandler returns the calls of today against the daily quotas
+func quotaHandler(c *gin.Context) {
+	usage, err := wechat.DefaultClient.Quota.Usage()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, map[string]interface{}{
+		"apis": usage,
+	})
+}
+
+// quotaClearHandler resets the daily quotas of the official account with clear_quota, along with the counters
+func quotaClearHandler(c *gin.Context) {
+	token, err := server.AccessToken(c.Request.Context())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	err = wechat.ClearQuota(c.Request.Context(), token, appID)
+	if err != nil {
+		logFor(c.Request.Context()).Errorf("failed to clear quota: %s", err)
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	logFor(c.Request.Context()).Warning("daily quotas of the wechat api cleared")
+	err = wechat.DefaultClient.Quota.Reset()
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.String(http.StatusOK, "quota cleared")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/haowang1013/wechat-server/wechat"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sceneQRCodeDefaultExpireSeconds = 7 * 24 * 60 * 60
+
+	// permanent qr codes are rendered from tokens which practically never expire
+	permanentQRLifeTime = 100 * 365 * 24 * time.Hour
+)
+
+// sceneQRCodeHandler mints a parametric qr code with wechat and returns the urls to render it
+func sceneQRCodeHandler(c *gin.Context) {
+	scene := c.Query("scene")
+	if len(scene) == 0 || len(scene) > wechat.QRCodeMaxSceneLength {
+		c.String(http.StatusBadRequest, "scene must be between 1 and %d characters", wechat.QRCodeMaxSceneLength)
+		return
+	}
+
+	permanent := c.DefaultQuery("permanent", "false") == "true"
+	expireSeconds := sceneQRCodeDefaultExpireSeconds
+	if s := c.Query("expire"); len(s) > 0 {
+		v, err := strconv.Atoi(s)
+		if err != nil || v <= 0 || v > wechat.QRCodeMaxExpireSeconds {
+			c.String(http.StatusBadRequest, "expire must be between 1 and %d seconds", wechat.QRCodeMaxExpireSeconds)
+			return
+		}
+		expireSeconds = v
+	}
+
+	token, err := server.AccessToken(c.Request.Context())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	var ticket *wechat.QRCodeTicket
+	lifeTime := permanentQRLifeTime
+	if permanent {
+		ticket, err = wechat.CreatePermanentQRCode(c.Request.Context(), token, scene)
+	} else {
+		ticket, err = wechat.CreateTempQRCode(c.Request.Context(), token, scene, expireSeconds)
+	}
+	if err != nil {
+		logFor(c.Request.Context()).Errorf("failed to create qr code for scene '%s': %s", scene, err)
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if !permanent {
+		lifeTime = time.Duration(ticket.ExpireSeconds) * time.Second
+	}
+
+	qrUrl := makeSimpleUrl(
+		"http",
+		c.Request.Host,
+		strings.Replace(qrcodeUrl, ":str", signQRPayload(ticket.Url, lifeTime), 1)).String()
+
+	resp := map[string]interface{}{
+		"scene":             scene,
+		"permanent":         permanent,
+		"ticket":            ticket.Ticket,
+		"expire_seconds":    ticket.ExpireSeconds,
+		"url":               ticket.Url,
+		"qrcode_url":        qrUrl,
+		"wechat_qrcode_url": wechat.QRCodeImageUrl(ticket.Ticket),
+	}
+	c.IndentedJSON(http.StatusCreated, resp)
+}
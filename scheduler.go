@@ -0,0 +1,710 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/haowang1013/wechat-server/wechat"
+	"github.com/robfig/cron"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// kinds of scheduled jobs
+	templateJob  = "template"
+	customJob    = "custom"
+	broadcastJob = "broadcast"
+
+	defaultJobPollInterval = 10 * time.Second
+	defaultJobRetryDelay   = 30 * time.Second
+	defaultJobMaxRetries   = 3
+	maxJobMaxRetries       = 10
+
+	// the lock of an occurrence is held by a replica while scheduling or running it, it expires in case the replica
+	// dies during the run, so it must be longer than any run
+	jobLockLifeTime = 10 * time.Minute
+
+	jobRunSuccess = "success"
+	jobRunFailed  = "failed"
+)
+
+var (
+	scheduler *jobScheduler
+
+	jobSchemas = []string{
+		`CREATE TABLE IF NOT EXISTS scheduled_jobs (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL DEFAULT '',
+			kind TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			run_at BIGINT NOT NULL DEFAULT 0,
+			cron TEXT NOT NULL DEFAULT '',
+			max_retries INTEGER NOT NULL,
+			enabled BOOLEAN NOT NULL,
+			next_run BIGINT NOT NULL,
+			last_run BIGINT NOT NULL DEFAULT 0,
+			create_time BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS scheduled_jobs_next_run ON scheduled_jobs (enabled, next_run)`,
+		`CREATE TABLE IF NOT EXISTS job_runs (
+			job_id TEXT NOT NULL,
+			scheduled_time BIGINT NOT NULL,
+			attempt INTEGER NOT NULL,
+			start_time BIGINT NOT NULL,
+			end_time BIGINT NOT NULL,
+			status TEXT NOT NULL,
+			result TEXT NOT NULL DEFAULT '',
+			error TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (job_id, scheduled_time, attempt)
+		)`,
+		`CREATE TABLE IF NOT EXISTS pending_job_runs (
+			job_id TEXT NOT NULL,
+			scheduled_time BIGINT NOT NULL,
+			attempt INTEGER NOT NULL,
+			next_attempt BIGINT NOT NULL,
+			PRIMARY KEY (job_id, scheduled_time)
+		)`,
+		`CREATE INDEX IF NOT EXISTS pending_job_runs_next_attempt ON pending_job_runs (next_attempt)`,
+	}
+)
+
+// scheduledJob sends a template message, a customer service message or a broadcast, either once at run_at
+// or repeatedly following the cron spec
+type scheduledJob struct {
+	ID         string          `json:"id"`
+	Name       string          `json:"name"`
+	Kind       string          `json:"kind"`
+	Payload    json.RawMessage `json:"payload"`
+	RunAt      int64           `json:"run_at"`
+	Cron       string          `json:"cron"`
+	MaxRetries int             `json:"max_retries"`
+	Enabled    bool            `json:"enabled"`
+	NextRun    int64           `json:"next_run"`
+	LastRun    int64           `json:"last_run"`
+	CreateTime int64           `json:"create_time"`
+}
+
+// validate checks the payload and the schedule of a new job, and sets its first run time
+func (j *scheduledJob) validate(now time.Time) error {
+	switch j.Kind {
+	case templateJob:
+		err := json.Unmarshal(j.Payload, new(wechat.TemplateMessage))
+		if err != nil {
+			return fmt.Errorf("invalid template message: %s", err)
+		}
+	case customJob:
+		err := json.Unmarshal(j.Payload, new(wechat.CustomMessage))
+		if err != nil {
+			return fmt.Errorf("invalid custom message: %s", err)
+		}
+	case broadcastJob:
+		req := new(broadcastRequest)
+		err := json.Unmarshal(j.Payload, req)
+		if err != nil {
+			return fmt.Errorf("invalid broadcast: %s", err)
+		}
+		err = req.Target.validate()
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown job kind '%s'", j.Kind)
+	}
+
+	if j.MaxRetries < 0 || j.MaxRetries > maxJobMaxRetries {
+		return fmt.Errorf("max_retries must be between 0 and %d", maxJobMaxRetries)
+	}
+
+	if (j.RunAt > 0) == (len(j.Cron) > 0) {
+		return errors.New("job must have exactly one of run_at and cron")
+	}
+
+	if j.RunAt > 0 {
+		j.NextRun = j.RunAt
+		return nil
+	}
+
+	schedule, err := cron.ParseStandard(j.Cron)
+	if err != nil {
+		return fmt.Errorf("invalid cron spec '%s': %s", j.Cron, err)
+	}
+	j.NextRun = schedule.Next(now).Unix()
+	return nil
+}
+
+// next returns the run time after the given time, or 0 if it's a one-off job
+func (j *scheduledJob) next(after time.Time) int64 {
+	if len(j.Cron) == 0 {
+		return 0
+	}
+
+	schedule, err := cron.ParseStandard(j.Cron)
+	if err != nil {
+		log.Errorf("invalid cron spec '%s' of job %s: %s", j.Cron, j.ID, err)
+		return 0
+	}
+	return schedule.Next(after).Unix()
+}
+
+// jobRun is an attempt of running a job at its scheduled time
+type jobRun struct {
+	JobID         string `json:"job_id"`
+	ScheduledTime int64  `json:"scheduled_time"`
+	Attempt       int    `json:"attempt"`
+	StartTime     int64  `json:"start_time"`
+	EndTime       int64  `json:"end_time"`
+	Status        string `json:"status"`
+	Result        string `json:"result"`
+	Error         string `json:"error"`
+}
+
+// pendingRun is an occurrence of a job which hasn't succeeded or given up yet, it's kept in the database
+// so the occurrence is resumed after a restart
+type pendingRun struct {
+	JobID         string `json:"job_id"`
+	ScheduledTime int64  `json:"scheduled_time"`
+	Attempt       int    `json:"attempt"`
+	NextAttempt   int64  `json:"next_attempt"`
+}
+
+// jobStore persists the scheduled jobs and their execution history
+type jobStore interface {
+	create(j *scheduledJob) error
+	get(id string) (*scheduledJob, bool, error)
+	list(offset, limit int) ([]*scheduledJob, error)
+	delete(id string) (bool, error)
+	due(now int64) ([]*scheduledJob, error)
+
+	// reschedule moves the job to the next run time, a next run time of 0 disables it, and adds a pending run
+	// of the current occurrence
+	reschedule(j *scheduledJob, nextRun, now int64) (*pendingRun, error)
+
+	// pendingRuns returns the pending runs whose next attempt is due
+	pendingRuns(now int64) ([]*pendingRun, error)
+	pendingRun(jobID string, scheduledTime int64) (*pendingRun, bool, error)
+
+	// retry sets the number and the time of the next attempt of the pending run
+	retry(p *pendingRun, attempt int, nextAttempt int64) error
+	removePending(p *pendingRun) error
+
+	addRun(r *jobRun) error
+	runs(jobID string, limit int) ([]*jobRun, error)
+}
+
+/**
+* sql job store
+ */
+type sqlJobStore struct {
+	sqlStore
+}
+
+const jobColumns = `id, name, kind, payload, run_at, cron, max_retries, enabled, next_run, last_run, create_time`
+
+func (s *sqlJobStore) create(j *scheduledJob) error {
+	_, err := s.db.Exec(s.rebind(`INSERT INTO scheduled_jobs (`+jobColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		j.ID, j.Name, j.Kind, string(j.Payload), j.RunAt, j.Cron, j.MaxRetries, j.Enabled, j.NextRun, j.LastRun, j.CreateTime)
+	return err
+}
+
+func (s *sqlJobStore) get(id string) (*scheduledJob, bool, error) {
+	result, err := s.scan(s.db.Query(s.rebind(`SELECT `+jobColumns+` FROM scheduled_jobs WHERE id = ?`), id))
+	if err != nil || len(result) == 0 {
+		return nil, false, err
+	}
+	return result[0], true, nil
+}
+
+func (s *sqlJobStore) list(offset, limit int) ([]*scheduledJob, error) {
+	return s.scan(s.db.Query(s.rebind(`SELECT `+jobColumns+` FROM scheduled_jobs ORDER BY create_time DESC, id LIMIT ? OFFSET ?`),
+		limit, offset))
+}
+
+func (s *sqlJobStore) delete(id string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(s.rebind(`DELETE FROM scheduled_jobs WHERE id = ?`), id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(s.rebind(`DELETE FROM pending_job_runs WHERE job_id = ?`), id)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, tx.Commit()
+}
+
+func (s *sqlJobStore) due(now int64) ([]*scheduledJob, error) {
+	return s.scan(s.db.Query(s.rebind(`SELECT `+jobColumns+` FROM scheduled_jobs WHERE enabled = ? AND next_run <= ? ORDER BY next_run`),
+		true, now))
+}
+
+func (s *sqlJobStore) reschedule(j *scheduledJob, nextRun, now int64) (*pendingRun, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(s.rebind(`UPDATE scheduled_jobs SET last_run = ?, next_run = ?, enabled = ? WHERE id = ?`),
+		j.NextRun, nextRun, nextRun > 0, j.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pendingRun{
+		JobID:         j.ID,
+		ScheduledTime: j.NextRun,
+		NextAttempt:   now,
+	}
+	_, err = tx.Exec(s.rebind(`INSERT INTO pending_job_runs (job_id, scheduled_time, attempt, next_attempt) VALUES (?, ?, ?, ?)`),
+		p.JobID, p.ScheduledTime, p.Attempt, p.NextAttempt)
+	if err != nil {
+		return nil, err
+	}
+	return p, tx.Commit()
+}
+
+func (s *sqlJobStore) pendingRuns(now int64) ([]*pendingRun, error) {
+	return s.scanPending(s.db.Query(s.rebind(`SELECT job_id, scheduled_time, attempt, next_attempt
+		FROM pending_job_runs WHERE next_attempt <= ? ORDER BY next_attempt`), now))
+}
+
+func (s *sqlJobStore) pendingRun(jobID string, scheduledTime int64) (*pendingRun, bool, error) {
+	result, err := s.scanPending(s.db.Query(s.rebind(`SELECT job_id, scheduled_time, attempt, next_attempt
+		FROM pending_job_runs WHERE job_id = ? AND scheduled_time = ?`), jobID, scheduledTime))
+	if err != nil || len(result) == 0 {
+		return nil, false, err
+	}
+	return result[0], true, nil
+}
+
+func (s *sqlJobStore) retry(p *pendingRun, attempt int, nextAttempt int64) error {
+	_, err := s.db.Exec(s.rebind(`UPDATE pending_job_runs SET attempt = ?, next_attempt = ? WHERE job_id = ? AND scheduled_time = ?`),
+		attempt, nextAttempt, p.JobID, p.ScheduledTime)
+	return err
+}
+
+func (s *sqlJobStore) removePending(p *pendingRun) error {
+	_, err := s.db.Exec(s.rebind(`DELETE FROM pending_job_runs WHERE job_id = ? AND scheduled_time = ?`), p.JobID, p.ScheduledTime)
+	return err
+}
+
+func (s *sqlJobStore) addRun(r *jobRun) error {
+	_, err := s.db.Exec(s.rebind(`INSERT INTO job_runs (job_id, scheduled_time, attempt, start_time, end_time, status, result, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		r.JobID, r.ScheduledTime, r.Attempt, r.StartTime, r.EndTime, r.Status, r.Result, r.Error)
+	return err
+}
+
+func (s *sqlJobStore) runs(jobID string, limit int) ([]*jobRun, error) {
+	rows, err := s.db.Query(s.rebind(`SELECT job_id, scheduled_time, attempt, start_time, end_time, status, result, error
+		FROM job_runs WHERE job_id = ? ORDER BY scheduled_time DESC, attempt DESC LIMIT ?`), jobID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*jobRun
+	for rows.Next() {
+		r := new(jobRun)
+		err = rows.Scan(&r.JobID, &r.ScheduledTime, &r.Attempt, &r.StartTime, &r.EndTime, &r.Status, &r.Result, &r.Error)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+func (s *sqlJobStore) scan(rows *sql.Rows, err error) ([]*scheduledJob, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*scheduledJob
+	for rows.Next() {
+		var payload string
+		j := new(scheduledJob)
+		err = rows.Scan(&j.ID, &j.Name, &j.Kind, &payload, &j.RunAt, &j.Cron, &j.MaxRetries, &j.Enabled,
+			&j.NextRun, &j.LastRun, &j.CreateTime)
+		if err != nil {
+			return nil, err
+		}
+		j.Payload = json.RawMessage(payload)
+		result = append(result, j)
+	}
+	return result, rows.Err()
+}
+
+func (s *sqlJobStore) scanPending(rows *sql.Rows, err error) ([]*pendingRun, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*pendingRun
+	for rows.Next() {
+		p := new(pendingRun)
+		err = rows.Scan(&p.JobID, &p.ScheduledTime, &p.Attempt, &p.NextAttempt)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
+
+func newSqlJobStore(db *sql.DB, driver string) (jobStore, error) {
+	err := createTables(db, jobSchemas)
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(sqlJobStore)
+	s.db = db
+	s.driver = driver
+	return s, nil
+}
+
+/**
+* scheduler
+ */
+
+// jobScheduler polls the due jobs and the pending runs, every replica runs a scheduler and the lock in the cache
+// makes sure each occurrence of a job is only scheduled or run by one replica at a time. An occurrence is kept
+// as a pending run until it succeeds or gives up, so an occurrence interrupted by a restart or waiting for a retry
+// is resumed by any replica
+type jobScheduler struct {
+	store        jobStore
+	locks        kvCache
+	pollInterval time.Duration
+	retryDelay   time.Duration
+}
+
+func (s *jobScheduler) run() {
+	for {
+		s.poll(time.Now())
+		time.Sleep(s.pollInterval)
+	}
+}
+
+func (s *jobScheduler) poll(now time.Time) {
+	jobs, err := s.store.due(now.Unix())
+	if err != nil {
+		log.Errorf("failed to load due jobs: %s", err)
+		return
+	}
+
+	for _, j := range jobs {
+		s.schedule(j, now)
+	}
+
+	runs, err := s.store.pendingRuns(now.Unix())
+	if err != nil {
+		log.Errorf("failed to load pending job runs: %s", err)
+		return
+	}
+
+	for _, p := range runs {
+		s.resume(p, now)
+	}
+}
+
+// schedule moves the job to its next run time and runs the current occurrence
+func (s *jobScheduler) schedule(j *scheduledJob, now time.Time) {
+	key := jobLockKey(j.ID, j.NextRun)
+	if !s.locks.setNX(key, strconv.FormatInt(now.Unix(), 10), jobLockLifeTime) {
+		// taken by another replica
+		return
+	}
+
+	// the occurrence may have been scheduled by another replica since the job was loaded
+	current, ok, err := s.store.get(j.ID)
+	if err != nil || !ok || !current.Enabled || current.NextRun != j.NextRun {
+		logError(err)
+		logError(s.locks.del(key))
+		return
+	}
+
+	// schedule the next occurrence before running, so a slow run doesn't delay it
+	p, err := s.store.reschedule(current, current.next(now), now.Unix())
+	if err != nil {
+		log.Errorf("failed to reschedule job %s: %s", j.ID, err)
+		logError(s.locks.del(key))
+		return
+	}
+	go s.execute(p, key)
+}
+
+// resume makes the next attempt of a pending run
+func (s *jobScheduler) resume(p *pendingRun, now time.Time) {
+	key := jobLockKey(p.JobID, p.ScheduledTime)
+	if !s.locks.setNX(key, strconv.FormatInt(now.Unix(), 10), jobLockLifeTime) {
+		// running on another replica
+		return
+	}
+
+	// the attempt may have been made by another replica since the pending run was loaded
+	current, ok, err := s.store.pendingRun(p.JobID, p.ScheduledTime)
+	if err != nil || !ok || current.NextAttempt > now.Unix() {
+		logError(err)
+		logError(s.locks.del(key))
+		return
+	}
+	go s.execute(current, key)
+}
+
+func jobLockKey(jobID string, scheduledTime int64) string {
+	return fmt.Sprintf("job.%s.%d", jobID, scheduledTime)
+}
+
+// execute makes an attempt of the pending run with its lock held, a failed attempt is retried later
+// with a growing delay
+func (s *jobScheduler) execute(p *pendingRun, key string) {
+	defer func() {
+		logError(s.locks.del(key))
+	}()
+
+	// the occurrence of the job is correlated like a request, so are the api calls made by it
+	ctx := wechat.WithRequestID(context.Background(), fmt.Sprintf("job-%s-%d", p.JobID, p.ScheduledTime))
+	j, ok, err := s.store.get(p.JobID)
+	if err != nil {
+		// the run is attempted again at the next poll
+		logFor(ctx).Errorf("failed to load job %s: %s", p.JobID, err)
+		return
+	}
+
+	if !ok {
+		logError(s.store.removePending(p))
+		return
+	}
+
+	r := &jobRun{
+		JobID:         j.ID,
+		ScheduledTime: p.ScheduledTime,
+		Attempt:       p.Attempt,
+		StartTime:     time.Now().Unix(),
+	}
+
+	result, err := runJob(ctx, j)
+	r.EndTime = time.Now().Unix()
+	r.Result = result
+	if err == nil {
+		r.Status = jobRunSuccess
+	} else {
+		r.Status = jobRunFailed
+		r.Error = err.Error()
+	}
+
+	logError(s.store.addRun(r))
+	if err == nil {
+		logFor(ctx).Infof("job %s (%s) ran at attempt %d: %s", j.ID, j.Kind, p.Attempt, result)
+		logError(s.store.removePending(p))
+		return
+	}
+	logFor(ctx).Warningf("job %s (%s) failed at attempt %d: %s", j.ID, j.Kind, p.Attempt, err)
+
+	// e.g. an invalid template id or a user who unsubscribed, retrying won't help
+	if wechat.IsPermanent(err) {
+		logFor(ctx).Errorf("job %s (%s) scheduled at %d failed permanently: %s", j.ID, j.Kind, p.ScheduledTime, err)
+		logError(s.store.removePending(p))
+		return
+	}
+
+	if p.Attempt >= j.MaxRetries {
+		logFor(ctx).Errorf("job %s (%s) scheduled at %d failed after %d attempts", j.ID, j.Kind, p.ScheduledTime, j.MaxRetries+1)
+		logError(s.store.removePending(p))
+		return
+	}
+
+	attempt := p.Attempt + 1
+	logError(s.store.retry(p, attempt, time.Now().Add(time.Duration(attempt)*s.retryDelay).Unix()))
+}
+
+func newJobScheduler(store jobStore, locks kvCache, pollInterval time.Duration) *jobScheduler {
+	s := new(jobScheduler)
+	s.store = store
+	s.locks = locks
+	s.pollInterval = pollInterval
+	s.retryDelay = defaultJobRetryDelay
+	return s
+}
+
+// runJob sends the payload of the job, returns a description of the result
+func runJob(ctx context.Context, j *scheduledJob) (string, error) {
+	switch j.Kind {
+	case templateJob:
+		m := new(wechat.TemplateMessage)
+		err := json.Unmarshal(j.Payload, m)
+		if err != nil {
+			return "", err
+		}
+
+		token, err := server.AccessToken(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		msgID, err := wechat.SendTemplateMessage(ctx, token, m)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("template message %d sent to %s", msgID, m.ToUser), nil
+	case customJob:
+		m := new(wechat.CustomMessage)
+		err := json.Unmarshal(j.Payload, m)
+		if err != nil {
+			return "", err
+		}
+
+		token, err := server.AccessToken(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		err = wechat.SendCustomMessage(ctx, token, m)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("custom message sent to %s", m.ToUser), nil
+	case broadcastJob:
+		req := new(broadcastRequest)
+		err := json.Unmarshal(j.Payload, req)
+		if err != nil {
+			return "", err
+		}
+
+		b, err := sendBroadcast(ctx, broadcasts, req)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("broadcast %d sent", b.MsgID), nil
+	default:
+		return "", fmt.Errorf("unknown job kind '%s'", j.Kind)
+	}
+}
+
+/**
+* admin endpoints
+ */
+func jobCreateHandler(c *gin.Context) {
+	j := new(scheduledJob)
+	j.MaxRetries = defaultJobMaxRetries
+	err := c.BindJSON(j)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	err = j.validate(now)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	j.ID = newUUID()
+	j.Enabled = true
+	j.LastRun = 0
+	j.CreateTime = now.Unix()
+
+	err = scheduler.store.create(j)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, j)
+}
+
+func jobListHandler(c *gin.Context) {
+	offset, err := parseIntQuery(c, "offset", 0, 0, math.MaxInt32)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit, err := parseIntQuery(c, "limit", defaultBroadcastQueryLimit, 1, maxBroadcastQueryLimit)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := scheduler.store.list(offset, limit)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if result == nil {
+		result = []*scheduledJob{}
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"jobs":   result,
+		"offset": offset,
+		"count":  len(result),
+	})
+}
+
+// jobGetHandler returns the job along with its latest runs
+func jobGetHandler(id string, c *gin.Context) {
+	j, ok, err := scheduler.store.get(id)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if !ok {
+		c.String(http.StatusNotFound, "job not found")
+		return
+	}
+
+	limit, err := parseIntQuery(c, "runs", defaultBroadcastQueryLimit, 1, maxBroadcastQueryLimit)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	runs, err := scheduler.store.runs(id, limit)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if runs == nil {
+		runs = []*jobRun{}
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"job":  j,
+		"runs": runs,
+	})
+}
+
+func jobDeleteHandler(id string, c *gin.Context) {
+	ok, err := scheduler.store.delete(id)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	if !ok {
+		c.String(http.StatusNotFound, "job not found")
+		return
+	}
+	c.String(http.StatusOK, "job %s deleted", id)
+}
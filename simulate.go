@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/haowang1013/wechat-server/wechat"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+* webhook simulator
+ */
+
+const (
+	defaultSimulateUrl  = "http://localhost:8080/wechat"
+	defaultSimulateFrom = "simulated-user"
+	defaultSimulateTo   = "gh_simulated"
+)
+
+const simulateUsage = `usage: wechat-server simulate [flags] <msgtype> [Field=Value ...]
+       wechat-server simulate [flags] -script <file>
+
+Sends a signed message or event to the server as wechat would, and prints the reply.
+
+examples:
+  wechat-server simulate text Content=hello
+  wechat-server simulate image PicUrl=http://example.com/a.jpg MediaId=media-id
+  wechat-server simulate event Event=subscribe EventKey=qrscene_123
+  wechat-server simulate -script conversation.json
+
+flags:
+`
+
+// simMessage is a message to send, the fields are the xml elements besides the common ones
+type simMessage struct {
+	MsgType string            `json:"msgtype"`
+	Fields  map[string]string `json:"fields"`
+}
+
+func (this *simMessage) String() string {
+	keys := sortedKeys(this.Fields)
+	parts := []string{this.MsgType}
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%s", k, this.Fields[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// simExpect is the assertions on the reply of a step, the fields must match exactly and
+// the contains must be a substring of the field
+type simExpect struct {
+	Empty    bool              `json:"empty"`
+	Fields   map[string]string `json:"fields"`
+	Contains map[string]string `json:"contains"`
+}
+
+func (this *simExpect) check(r *simReply) []string {
+	var failures []string
+	if this.Empty && !r.empty() {
+		failures = append(failures, "expected an empty reply")
+	}
+
+	for _, k := range sortedKeys(this.Fields) {
+		v, ok := r.fields[k]
+		if !ok {
+			failures = append(failures, fmt.Sprintf("%s: missing, expected '%s'", k, this.Fields[k]))
+		} else if v != this.Fields[k] {
+			failures = append(failures, fmt.Sprintf("%s: got '%s', expected '%s'", k, v, this.Fields[k]))
+		}
+	}
+
+	for _, k := range sortedKeys(this.Contains) {
+		v, ok := r.fields[k]
+		if !ok {
+			failures = append(failures, fmt.Sprintf("%s: missing, expected to contain '%s'", k, this.Contains[k]))
+		} else if !strings.Contains(v, this.Contains[k]) {
+			failures = append(failures, fmt.Sprintf("%s: got '%s', expected to contain '%s'", k, v, this.Contains[k]))
+		}
+	}
+	return failures
+}
+
+type simStep struct {
+	simMessage
+	Name   string     `json:"name"`
+	From   string     `json:"from"`
+	Expect *simExpect `json:"expect"`
+}
+
+// simScript is a scripted conversation, the steps are sent in order and the script fails if any
+// of the assertions fails
+type simScript struct {
+	From  string    `json:"from"`
+	To    string    `json:"to"`
+	Steps []simStep `json:"steps"`
+}
+
+// simReply is the reply parsed into the leaf elements, the nested elements are named like 'TransInfo.KfAccount'
+type simReply struct {
+	raw    string
+	names  []string
+	fields map[string]string
+}
+
+func (this *simReply) empty() bool {
+	return len(this.names) == 0
+}
+
+func (this *simReply) print(w io.Writer) {
+	if this.empty() {
+		fmt.Fprintf(w, "  (empty reply) %s\n", this.raw)
+		return
+	}
+
+	for _, name := range this.names {
+		fmt.Fprintf(w, "  %s: %s\n", name, this.fields[name])
+	}
+}
+
+func parseSimReply(body []byte) (*simReply, error) {
+	r := new(simReply)
+	r.raw = strings.TrimSpace(string(body))
+	r.fields = make(map[string]string)
+	if len(r.raw) == 0 || r.raw == "success" {
+		return r, nil
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(body))
+	var path []string
+	var text string
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch v := t.(type) {
+		case xml.StartElement:
+			path = append(path, v.Name.Local)
+			text = ""
+
+		case xml.CharData:
+			text += string(v)
+
+		case xml.EndElement:
+			// the root element is skipped, and so are the elements with children
+			if len(path) > 1 && len(text) > 0 {
+				name := strings.Join(path[1:], ".")
+				r.names = append(r.names, name)
+				r.fields[name] = text
+			}
+			path = path[:len(path)-1]
+			text = ""
+		}
+	}
+	return r, nil
+}
+
+type simulator struct {
+	url     string
+	token   string
+	crypter *wechat.MessageCrypter
+	client  *http.Client
+}
+
+func newSimulator(serverUrl, token string, crypter *wechat.MessageCrypter) *simulator {
+	s := new(simulator)
+	s.url = serverUrl
+	s.token = token
+	s.crypter = crypter
+	s.client = &http.Client{Timeout: 10 * time.Second}
+	return s
+}
+
+// send posts the message to the server, signed and optionally encrypted, and returns the parsed reply
+func (this *simulator) send(m *simMessage, from, to string) (*simReply, error) {
+	now := time.Now()
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	nonce := strconv.FormatInt(now.UnixNano()%1000000000, 10)
+
+	body := buildSimMessage(m, from, to, now)
+	params := url.Values{}
+	params.Set("signature", wechat.SignLogin(timestamp, nonce, this.token))
+	params.Set("timestamp", timestamp)
+	params.Set("nonce", nonce)
+	params.Set("openid", from)
+
+	if this.crypter != nil {
+		encrypted, err := this.crypter.EncryptMessage(body, timestamp, nonce)
+		if err != nil {
+			return nil, err
+		}
+
+		_, msgSignature, _, _, err := wechat.UnwrapMessage(encrypted)
+		if err != nil {
+			return nil, err
+		}
+
+		params.Set("encrypt_type", "aes")
+		params.Set("msg_signature", msgSignature)
+		body = encrypted
+	}
+
+	u, err := url.Parse(this.url)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = params.Encode()
+
+	resp, err := this.client.Post(u.String(), "text/xml", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	reply, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(reply)))
+	}
+
+	if this.crypter != nil && bytes.HasPrefix(bytes.TrimSpace(reply), []byte("<xml>")) {
+		reply, err = this.decryptReply(reply)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt reply: %s", err)
+		}
+	}
+	return parseSimReply(reply)
+}
+
+func (this *simulator) decryptReply(reply []byte) ([]byte, error) {
+	encrypted, msgSignature, timestamp, nonce, err := wechat.UnwrapMessage(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	if this.crypter.Signature(timestamp, nonce, encrypted) != msgSignature {
+		return nil, wechat.ErrInvalidSignature
+	}
+	return this.crypter.Decrypt(encrypted)
+}
+
+// runScript sends the steps in the script and checks the replies, it returns the number of failed steps
+func (this *simulator) runScript(script *simScript, w io.Writer) int {
+	failed := 0
+	for i := range script.Steps {
+		step := &script.Steps[i]
+		name := step.Name
+		if len(name) == 0 {
+			name = step.simMessage.String()
+		}
+		fmt.Fprintf(w, "step %d: %s\n", i+1, name)
+
+		from := step.From
+		if len(from) == 0 {
+			from = script.From
+		}
+
+		r, err := this.send(&step.simMessage, from, script.To)
+		if err != nil {
+			fmt.Fprintf(w, "  FAIL: %s\n", err)
+			failed++
+			continue
+		}
+		r.print(w)
+
+		if step.Expect == nil {
+			continue
+		}
+
+		failures := step.Expect.check(r)
+		for _, f := range failures {
+			fmt.Fprintf(w, "  FAIL: %s\n", f)
+		}
+
+		if len(failures) > 0 {
+			failed++
+		} else {
+			fmt.Fprintln(w, "  PASS")
+		}
+	}
+
+	fmt.Fprintf(w, "%d of %d steps passed\n", len(script.Steps)-failed, len(script.Steps))
+	return failed
+}
+
+// buildSimMessage builds the xml of the message as wechat sends it, the fields are sorted to keep the output stable
+func buildSimMessage(m *simMessage, from, to string, now time.Time) []byte {
+	var b bytes.Buffer
+	b.WriteString("<xml>")
+	writeSimField(&b, "ToUserName", to)
+	writeSimField(&b, "FromUserName", from)
+	fmt.Fprintf(&b, "<CreateTime>%d</CreateTime>", now.Unix())
+	writeSimField(&b, "MsgType", m.MsgType)
+
+	_, hasMsgId := m.Fields["MsgId"]
+	if m.MsgType != "event" && !hasMsgId {
+		fmt.Fprintf(&b, "<MsgId>%d</MsgId>", now.UnixNano())
+	}
+
+	for _, k := range sortedKeys(m.Fields) {
+		writeSimField(&b, k, m.Fields[k])
+	}
+	b.WriteString("</xml>")
+	return b.Bytes()
+}
+
+func writeSimField(b *bytes.Buffer, name, value string) {
+	value = strings.Replace(value, "]]>", "]]]]><![CDATA[>", -1)
+	fmt.Fprintf(b, "<%s><![CDATA[%s]]></%s>", name, value, name)
+}
+
+func parseSimMessage(args []string) (*simMessage, error) {
+	if len(args) == 0 {
+		return nil, errors.New("message type is required")
+	}
+
+	m := new(simMessage)
+	m.MsgType = args[0]
+	m.Fields = make(map[string]string)
+	for _, arg := range args[1:] {
+		i := strings.Index(arg, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid field '%s', must be Field=Value", arg)
+		}
+		m.Fields[arg[:i]] = arg[i+1:]
+	}
+	return m, nil
+}
+
+func loadSimScript(path string) (*simScript, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	script := new(simScript)
+	err = json.Unmarshal(b, script)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(script.Steps) == 0 {
+		return nil, errors.New("no steps in the script")
+	}
+
+	for i, step := range script.Steps {
+		if len(step.MsgType) == 0 {
+			return nil, fmt.Errorf("step %d has no msgtype", i+1)
+		}
+	}
+	return script, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// runSimulator runs the simulate subcommand and returns the exit code
+func runSimulator(args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, simulateUsage)
+		flags.PrintDefaults()
+	}
+
+	serverUrl := flags.String("url", defaultSimulateUrl, "wechat url of the server")
+	token := flags.String("token", os.Getenv("WECHAT_APP_TOKEN"), "app token to sign the messages with")
+	appID := flags.String("app-id", os.Getenv("WECHAT_APP_ID"), "app id of the official account, required for encryption")
+	aesKey := flags.String("aes-key", os.Getenv("WECHAT_ENCODING_AES_KEY"), "EncodingAESKey for encryption")
+	encrypt := flags.Bool("encrypt", false, "encrypt the messages with the EncodingAESKey")
+	from := flags.String("from", defaultSimulateFrom, "open id of the user sending the messages")
+	to := flags.String("to", defaultSimulateTo, "user name of the official account")
+	scriptPath := flags.String("script", "", "json file with the conversation to run")
+	raw := flags.Bool("raw", false, "print the raw reply instead of the fields")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	if len(*token) == 0 {
+		fmt.Fprintln(os.Stderr, "app token is required, set it with -token or WECHAT_APP_TOKEN")
+		return 2
+	}
+
+	var crypter *wechat.MessageCrypter
+	if *encrypt {
+		if len(*appID) == 0 {
+			fmt.Fprintln(os.Stderr, "app id is required for encryption, set it with -app-id or WECHAT_APP_ID")
+			return 2
+		}
+
+		crypter, err = wechat.NewMessageCrypter(*token, *aesKey, *appID)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	s := newSimulator(*serverUrl, *token, crypter)
+	if len(*scriptPath) > 0 {
+		script, err := loadSimScript(*scriptPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load script '%s': %s\n", *scriptPath, err)
+			return 2
+		}
+
+		if len(script.From) == 0 {
+			script.From = *from
+		}
+		if len(script.To) == 0 {
+			script.To = *to
+		}
+
+		if s.runScript(script, os.Stdout) > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	m, err := parseSimMessage(flags.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flags.Usage()
+		return 2
+	}
+
+	r, err := s.send(m, *from, *to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *raw {
+		fmt.Println(r.raw)
+	} else {
+		r.print(os.Stdout)
+	}
+	return 0
+}
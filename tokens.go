@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/haowang1013/wechat-server/wechat"
+	"time"
+)
+
+const (
+	accessTokenKeyPrefix = "accesstoken."
+
+	// the lock is released once the token is saved, it expires in case the replica dies while refreshing
+	accessTokenLockLifeTime = 30 * time.Second
+)
+
+// accessTokenStore shares the access token between the replicas in the kv cache, keyed by the app id
+type accessTokenStore struct {
+	cache kvCache
+}
+
+type storedAccessToken struct {
+	Token      wechat.BaseAccessToken `json:"token"`
+	ExpireTime int64                  `json:"expire_time"`
+}
+
+func (a *accessTokenStore) LoadAccessToken(appID string) (*wechat.BaseAccessToken, time.Time, bool) {
+	value, ok := getJson(a.cache, accessTokenKeyPrefix+appID, func() interface{} {
+		return new(storedAccessToken)
+	})
+
+	stored, _ := value.(*storedAccessToken)
+	if !ok || stored == nil {
+		return nil, time.Time{}, false
+	}
+	return &stored.Token, time.Unix(stored.ExpireTime, 0), true
+}
+
+func (a *accessTokenStore) SaveAccessToken(appID string, token *wechat.BaseAccessToken, expireTime time.Time) error {
+	return setJson(a.cache, accessTokenKeyPrefix+appID, &storedAccessToken{
+		Token:      *token,
+		ExpireTime: expireTime.Unix(),
+	})
+}
+
+func (a *accessTokenStore) LockAccessToken(appID string) bool {
+	return a.cache.setNX(accessTokenKeyPrefix+appID+".lock", "", accessTokenLockLifeTime)
+}
+
+func (a *accessTokenStore) UnlockAccessToken(appID string) {
+	a.cache.del(accessTokenKeyPrefix + appID + ".lock")
+}
+
+func newAccessTokenStore(cache kvCache) *accessTokenStore {
+	a := new(accessTokenStore)
+	a.cache = cache
+	return a
+}
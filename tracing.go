@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+const (
+	tracerName = "github.com/haowang1013/wechat-server"
+
+	// the service name unless OTEL_SERVICE_NAME is set
+	defaultServiceName = "wechat-server"
+)
+
+// setupTracing exports the spans to the otlp endpoint, the returned function flushes the remaining spans.
+// The exporter is configured with the standard env variables, e.g. OTEL_EXPORTER_OTLP_ENDPOINT
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(
+		resource.NewSchemaless(attribute.String("service.name", defaultServiceName)),
+		resource.Environment())
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// tracing starts a server span for every request, which continues the trace in the traceparent header if any
+func tracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		name := c.Request.Method
+		if route := c.FullPath(); len(route) > 0 {
+			name += " " + route
+		}
+
+		ctx, span := startSpan(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("http.route", c.FullPath()),
+			))
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// traceParent returns the traceparent of the span in the context, to continue the trace later
+func traceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// startLinkedSpan starts a span linked to the span of the traceparent, e.g. the span of the request which created
+// the login, since the login completes in another request
+func startLinkedSpan(ctx context.Context, name, parent string) (context.Context, trace.Span) {
+	carrier := propagation.MapCarrier{"traceparent": parent}
+	linked := trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), carrier))
+	if !linked.IsValid() {
+		return startSpan(ctx, name)
+	}
+	return startSpan(ctx, name, trace.WithLinks(trace.Link{SpanContext: linked}))
+}
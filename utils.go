@@ -4,7 +4,6 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/haowang1013/wechat-server/wechat"
 	"github.com/satori/go.uuid"
-	"github.com/skip2/go-qrcode"
 	"net/http"
 	"net/url"
 )
@@ -16,18 +15,6 @@ func printUserInfo(c *gin.Context, u *wechat.UserInfo, state string) {
 	c.IndentedJSON(http.StatusOK, data)
 }
 
-func generateQRCode(str string, c *gin.Context, unescape bool) {
-	if unescape {
-		str, _ = url.QueryUnescape(str)
-	}
-	data, err := qrcode.Encode(str, qrcode.Medium, 256)
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
-		return
-	}
-	c.Data(http.StatusOK, "image/png", data)
-}
-
 func newUUID() string {
 	return uuid.NewV4().String()
 }
@@ -1,9 +1,19 @@
 package wechat
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"github.com/levigross/grequests"
+	"sync"
+	"time"
+)
+
+const (
+	// refresh the access token a bit earlier than it actually expires
+	accessTokenExpireMargin = 5 * time.Minute
+
+	// how often a process checks the store while the token is refreshed by another process
+	accessTokenLockWait = 100 * time.Millisecond
 )
 
 type BaseAccessToken struct {
@@ -19,77 +29,150 @@ type WebAccessToken struct {
 	UnionID      string `json:"unionid"`
 }
 
-func (this *WebAccessToken) Validate() error {
-	url := fmt.Sprintf("https://api.weixin.qq.com/sns/auth?access_token=%s&openid=%s", this.Token, this.OpenID)
-	resp, err := grequests.Get(url, nil)
-	if err != nil {
-		return err
-	}
-
-	we := new(WeChatError)
-	err = resp.JSON(we)
+func (this *WebAccessToken) Validate(ctx context.Context) error {
+	url := fmt.Sprintf("%s/sns/auth?access_token=%s&openid=%s", apiUrl(), this.Token, this.OpenID)
+	return apiGet(ctx, url, nil)
+}
 
+func GetAccessToken(ctx context.Context, appID, appSecret string) (*BaseAccessToken, error) {
+	url := fmt.Sprintf("%s/cgi-bin/token?grant_type=client_credential&appid=%s&secret=%s", apiUrl(), appID, appSecret)
+	token := new(BaseAccessToken)
+	err := apiGet(ctx, url, token)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if we.Code == 0 {
-		return nil
+	if len(token.Token) == 0 {
+		return nil, errors.New("empty access token in response")
 	}
+	return token, nil
+}
 
-	return we
+func GetWebAccessToken(ctx context.Context, appID, appSecret, code string) (*WebAccessToken, error) {
+	url := fmt.Sprintf("%s/sns/oauth2/access_token?appid=%s&secret=%s&code=%s&grant_type=authorization_code", apiUrl(), appID, appSecret, code)
+	return getWebAccessToken(ctx, url)
 }
 
-func GetAccessToken(appID, appSecret string) (*BaseAccessToken, error) {
-	url := fmt.Sprintf("https://api.weixin.qq.com/cgi-bin/token?grant_type=client_credential&appid=%s&secret=%s", appID, appSecret)
-	resp, err := grequests.Get(url, nil)
+func RefreshWebAccessToken(ctx context.Context, appID, refreshToken string) (*WebAccessToken, error) {
+	url := fmt.Sprintf("%s/sns/oauth2/refresh_token?appid=%s&grant_type=refresh_token&refresh_token=%s", apiUrl(), appID, refreshToken)
+	return getWebAccessToken(ctx, url)
+}
+
+func getWebAccessToken(ctx context.Context, url string) (*WebAccessToken, error) {
+	token := new(WebAccessToken)
+	err := apiGet(ctx, url, token)
 	if err != nil {
 		return nil, err
 	}
 
-	b := resp.Bytes()
-	token := new(BaseAccessToken)
-	err = json.Unmarshal(b, token)
-	if err != nil {
-		return nil, err
+	if len(token.Token) == 0 {
+		return nil, errors.New("empty web access token in response")
 	}
+	return token, nil
+}
 
-	if len(token.Token) > 0 {
-		return token, nil
+// AccessTokenStore shares the access token between the processes of the same app, e.g. in redis.
+// Every token obtained from wechat invalidates the previous one, so the processes must not refresh it
+// on their own, the refresh is done by the process holding the lock of the app
+type AccessTokenStore interface {
+	LoadAccessToken(appID string) (token *BaseAccessToken, expireTime time.Time, ok bool)
+	SaveAccessToken(appID string, token *BaseAccessToken, expireTime time.Time) error
+
+	// LockAccessToken returns false if the lock is held by another process, the lock should expire
+	// in case the process holding it dies
+	LockAccessToken(appID string) bool
+	UnlockAccessToken(appID string)
+}
+
+// accessTokenCache keeps the access token until shortly before it expires, the token is shared through
+// the store if it's set
+type accessTokenCache struct {
+	token      *BaseAccessToken
+	expireTime time.Time
+	store      AccessTokenStore
+	m          sync.Mutex
+}
+
+func (this *accessTokenCache) get(ctx context.Context, appID, appSecret string) (*BaseAccessToken, error) {
+	this.m.Lock()
+	defer this.m.Unlock()
+	return this.fetch(ctx, appID, appSecret, "")
+}
+
+// renew drops the stale token rejected by wechat if it's still cached and gets a new one,
+// the token may have been renewed already by another call or process which was rejected at the same time
+func (this *accessTokenCache) renew(ctx context.Context, appID, appSecret, stale string) (*BaseAccessToken, error) {
+	this.m.Lock()
+	defer this.m.Unlock()
+	return this.fetch(ctx, appID, appSecret, stale)
+}
+
+func (this *accessTokenCache) fetch(ctx context.Context, appID, appSecret, stale string) (*BaseAccessToken, error) {
+	if this.valid(this.token, this.expireTime, stale) {
+		return this.token, nil
 	}
 
-	we := new(WeChatError)
-	err = json.Unmarshal(b, we)
-	if err != nil {
-		return nil, err
+	if this.store == nil {
+		return this.refresh(ctx, appID, appSecret)
 	}
 
-	return nil, we
+	for {
+		token, expireTime, ok := this.store.LoadAccessToken(appID)
+		if ok && this.valid(token, expireTime, stale) {
+			this.token = token
+			this.expireTime = expireTime
+			return token, nil
+		}
+
+		if this.store.LockAccessToken(appID) {
+			return this.refreshLocked(ctx, appID, appSecret, stale)
+		}
+
+		// wait for the process holding the lock to save the new token
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(accessTokenLockWait):
+		}
+	}
 }
 
-func GetWebAccessToken(appID, appSecret, code string) (*WebAccessToken, error) {
-	url := fmt.Sprintf("https://api.weixin.qq.com/sns/oauth2/access_token?appid=%s&secret=%s&code=%s&grant_type=authorization_code", appID, appSecret, code)
-	resp, err := grequests.Get(url, nil)
-	if err != nil {
-		return nil, err
+// refreshLocked gets a new token with the lock of the store held, unless the token has been refreshed
+// by another process since it was loaded
+func (this *accessTokenCache) refreshLocked(ctx context.Context, appID, appSecret, stale string) (*BaseAccessToken, error) {
+	defer this.store.UnlockAccessToken(appID)
+
+	token, expireTime, ok := this.store.LoadAccessToken(appID)
+	if ok && this.valid(token, expireTime, stale) {
+		this.token = token
+		this.expireTime = expireTime
+		return token, nil
 	}
 
-	b := resp.Bytes()
-	token := new(WebAccessToken)
-	err = json.Unmarshal(b, token)
+	token, err := this.refresh(ctx, appID, appSecret)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(token.Token) > 0 {
-		return token, nil
+	err = this.store.SaveAccessToken(appID, token, this.expireTime)
+	if err != nil {
+		return nil, err
 	}
+	return token, nil
+}
 
-	we := new(WeChatError)
-	err = json.Unmarshal(b, we)
+func (this *accessTokenCache) refresh(ctx context.Context, appID, appSecret string) (*BaseAccessToken, error) {
+	token, err := GetAccessToken(ctx, appID, appSecret)
 	if err != nil {
 		return nil, err
 	}
+	observeTokenRefresh(AccessTokenRefresh)
+
+	this.token = token
+	this.expireTime = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - accessTokenExpireMargin)
+	return token, nil
+}
 
-	return nil, we
+func (this *accessTokenCache) valid(token *BaseAccessToken, expireTime time.Time, stale string) bool {
+	return token != nil && token.Token != stale && time.Now().Before(expireTime)
 }
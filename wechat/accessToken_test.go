@@ -0,0 +1,31 @@
+package wechat_test
+
+import (
+	"context"
+	"errors"
+	"github.com/haowang1013/wechat-server/wechat"
+	"testing"
+)
+
+func TestRefreshWebAccessToken(t *testing.T) {
+	s := newApiTest(t)
+	ctx := context.Background()
+
+	token, err := wechat.GetWebAccessToken(ctx, testAppID, testAppSecret, s.NewCode(testOpenID))
+	if err != nil {
+		t.Fatalf("failed to get the web access token: %s", err)
+	}
+
+	_, err = wechat.RefreshWebAccessToken(ctx, "wx-unknown-app", token.RefreshToken)
+	if !errors.Is(err, wechat.ErrInvalidAppID) {
+		t.Errorf("got %v refreshing with an unknown app, expected %s", err, wechat.ErrInvalidAppID)
+	}
+
+	refreshed, err := wechat.RefreshWebAccessToken(ctx, testAppID, token.RefreshToken)
+	if err != nil {
+		t.Fatalf("failed to refresh the web access token: %s", err)
+	}
+	if refreshed.OpenID != testOpenID || refreshed.Token == token.Token {
+		t.Errorf("unexpected refreshed token: %+v", refreshed)
+	}
+}
@@ -0,0 +1,478 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/time/rate"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultApiUrl  = "https://api.weixin.qq.com"
+	DefaultOpenUrl = "https://open.weixin.qq.com"
+
+	DefaultTimeout       = 30 * time.Second
+	DefaultMaxRetries    = 3
+	DefaultRetryDelay    = 200 * time.Millisecond
+	DefaultMaxRetryDelay = 5 * time.Second
+)
+
+// Client holds the base urls of the wechat api (api.weixin.qq.com) and the authorization pages (open.weixin.qq.com),
+// which can be pointed to a fake server for development and tests, and how the api calls are sent
+type Client struct {
+	BaseUrl string
+	OpenUrl string
+
+	// HTTPClient sends the api calls, its timeout applies to each attempt
+	HTTPClient *http.Client
+
+	// calls failed with errcode -1 (system busy) or 45011 (rate limited) are retried up to MaxRetries times, so are
+	// the GET calls failed with network errors or 5xx responses, but not the POST calls which may have been accepted,
+	// e.g. a broadcast. The delay starts from RetryDelay and doubles after each retry, up to MaxRetryDelay
+	MaxRetries    int
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+
+	// Limiter limits the rate of all the calls, Limiters limit the calls of each api by its path, e.g. /cgi-bin/token,
+	// the calls wait for their turn until the context is done
+	Limiter  *rate.Limiter
+	Limiters map[string]*rate.Limiter
+
+	// Quota counts the calls of the apis against their daily quotas, the calls aren't counted if it's nil
+	Quota *QuotaTracker
+
+	// Observer is notified of every attempt of the api calls and the refreshes of the tokens
+	Observer Observer
+
+	// Logger logs every attempt of the api calls along with the request id of the context
+	Logger Logger
+
+	// Recorder records the customer service messages sent to the followers
+	Recorder MessageRecorder
+
+	// AccessTokens renews the access token of a call rejected with an invalid token error, e.g. 40001,
+	// after which the call is sent once more. The calls with web access tokens (/sns/...) aren't renewed
+	AccessTokens AccessTokenSource
+}
+
+// AccessTokenSource renews the access token of the official account, which is implemented by the Server
+type AccessTokenSource interface {
+	RenewAccessToken(ctx context.Context, stale string) (*BaseAccessToken, error)
+}
+
+func NewClient(baseUrl, openUrl string) *Client {
+	c := new(Client)
+	c.BaseUrl = strings.TrimRight(baseUrl, "/")
+	c.OpenUrl = strings.TrimRight(openUrl, "/")
+	c.HTTPClient = &http.Client{Timeout: DefaultTimeout}
+	c.MaxRetries = DefaultMaxRetries
+	c.RetryDelay = DefaultRetryDelay
+	c.MaxRetryDelay = DefaultMaxRetryDelay
+	return c
+}
+
+// AuthorizeUrl returns the url of an authorization page on the open platform, e.g. /connect/oauth2/authorize
+func (this *Client) AuthorizeUrl(path string, params url.Values, fragment string) string {
+	u := this.OpenUrl + path + "?" + params.Encode()
+	if len(fragment) > 0 {
+		u += "#" + fragment
+	}
+	return u
+}
+
+// SetProxy sends the api calls through the http proxy, e.g. http://proxy:3128
+func (this *Client) SetProxy(proxyUrl string) error {
+	u, err := url.Parse(proxyUrl)
+	if err != nil {
+		return err
+	}
+
+	if len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return fmt.Errorf("invalid proxy url '%s'", proxyUrl)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(u)
+
+	client := *this.HTTPClient
+	client.Transport = transport
+	this.HTTPClient = &client
+	return nil
+}
+
+// call sends the request with the body as json if it's not nil, and returns the response body.
+// The call is retried on the temporary errors of the method, and sent once more with a renewed access token
+// if wechat rejects its token
+func (this *Client) call(ctx context.Context, method, url string, body interface{}) ([]byte, error) {
+	b, err := this.request(ctx, method, url, body)
+	if err != nil || this.AccessTokens == nil {
+		return b, err
+	}
+
+	if we := peekError(b); we == nil || !we.TokenInvalid() {
+		return b, nil
+	}
+
+	renewed, ok := this.renewToken(ctx, url)
+	if !ok {
+		return b, nil
+	}
+	return this.request(ctx, method, renewed, body)
+}
+
+// renewToken returns the url with a renewed access token, or false if the url has no access token
+// of the official account or the token can't be renewed
+func (this *Client) renewToken(ctx context.Context, rawUrl string) (string, bool) {
+	u, err := url.Parse(rawUrl)
+	if err != nil || strings.HasPrefix(u.Path, "/sns/") {
+		return "", false
+	}
+
+	q := u.Query()
+	stale := q.Get("access_token")
+	if len(stale) == 0 {
+		return "", false
+	}
+
+	token, err := this.AccessTokens.RenewAccessToken(ctx, stale)
+	if err != nil {
+		return "", false
+	}
+
+	q.Set("access_token", token.Token)
+	u.RawQuery = q.Encode()
+	return u.String(), true
+}
+
+// request sends the request, retrying on the temporary errors
+func (this *Client) request(ctx context.Context, method, url string, body interface{}) ([]byte, error) {
+	data, err := marshalBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	api := apiPath(url)
+	var b []byte
+	err = this.retry(ctx, method, func() error {
+		err := this.acquire(ctx, api)
+		if err != nil {
+			return err
+		}
+
+		a := this.begin(ctx, method, api)
+		resp, err := this.send(a.ctx, method, url, data)
+		if err != nil {
+			a.end(err)
+			return err
+		}
+		defer resp.Body.Close()
+
+		b, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			a.end(err)
+			return err
+		}
+
+		we := peekError(b)
+		if we == nil {
+			a.end(nil)
+			return nil
+		}
+
+		a.end(we)
+		if we.Retryable() {
+			return we
+		}
+		return nil
+	})
+	return b, err
+}
+
+// download is like call but returns the response as is, so that the caller can stream it
+func (this *Client) download(ctx context.Context, method, url string, body interface{}) (*http.Response, error) {
+	data, err := marshalBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	api := apiPath(url)
+	var resp *http.Response
+	err = this.retry(ctx, method, func() error {
+		err := this.acquire(ctx, api)
+		if err != nil {
+			return err
+		}
+
+		a := this.begin(ctx, method, api)
+		resp, err = this.send(a.ctx, method, url, data)
+		a.end(err)
+		return err
+	})
+	return resp, err
+}
+
+// send makes a single attempt of the request, a 5xx response is closed and returned as an error
+func (this *Client) send(ctx context.Context, method, url string, data []byte) (*http.Response, error) {
+	var r io.Reader
+	if data != nil {
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if id := RequestID(ctx); len(id) > 0 {
+		req.Header.Set(RequestIDHeader, id)
+	}
+
+	resp, err := this.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		resp.Body.Close()
+		return nil, httpStatusError(resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// retry calls f until it succeeds, fails with an error which isn't temporary, or runs out of retries
+func (this *Client) retry(ctx context.Context, method string, f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= this.MaxRetries || !isTemporary(ctx, method, err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(this.backoff(attempt)):
+		}
+	}
+}
+
+// acquire waits for the limiters of the api and counts the call, every attempt is a call to wechat
+func (this *Client) acquire(ctx context.Context, api string) error {
+	if this.Limiter != nil {
+		err := this.Limiter.Wait(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if l := this.Limiters[api]; l != nil {
+		err := l.Wait(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if this.Quota != nil {
+		this.Quota.count(api)
+	}
+	return nil
+}
+
+func (this *Client) backoff(attempt int) time.Duration {
+	d := this.RetryDelay << uint(attempt)
+	if d <= 0 || d > this.MaxRetryDelay {
+		d = this.MaxRetryDelay
+	}
+	return d
+}
+
+type httpStatusError int
+
+func (this httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected http status %d", int(this))
+}
+
+// isTemporary tells if the call failed with an error which may go away after a while,
+// nothing is retried once the context is done.
+// Only a GET call is safe to repeat after a network error or a 5xx response, wechat may have accepted
+// a POST call before the connection broke, while the retryable wechat errors mean the call was rejected
+func isTemporary(ctx context.Context, method string, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if method != http.MethodGet {
+		var we *WeChatError
+		return errors.As(err, &we) && we.Retryable()
+	}
+
+	// the context isn't done, so the deadline exceeded comes from the timeout of the attempt
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return IsRetryable(err)
+}
+
+var (
+	// DefaultClient is used by all the api functions
+	DefaultClient = NewClient(DefaultApiUrl, DefaultOpenUrl)
+)
+
+// SetBaseUrls points the api functions to the given urls, empty urls are reset to the defaults
+func SetBaseUrls(baseUrl, openUrl string) {
+	if len(baseUrl) == 0 {
+		baseUrl = DefaultApiUrl
+	}
+	if len(openUrl) == 0 {
+		openUrl = DefaultOpenUrl
+	}
+
+	c := *DefaultClient
+	c.BaseUrl = strings.TrimRight(baseUrl, "/")
+	c.OpenUrl = strings.TrimRight(openUrl, "/")
+	DefaultClient = &c
+}
+
+func apiUrl() string {
+	return DefaultClient.BaseUrl
+}
+
+func marshalBody(body interface{}) ([]byte, error) {
+	if body == nil {
+		return nil, nil
+	}
+	return json.Marshal(body)
+}
+
+// peekError returns the error in the body if it's a json object with a non-zero errcode
+func peekError(b []byte) *WeChatError {
+	we := new(WeChatError)
+	if json.Unmarshal(b, we) != nil || we.Code == 0 {
+		return nil
+	}
+	return we
+}
+
+// decodeResponse decodes the body of an api response into v,
+// a *WeChatError is returned if the body carries a non-zero errcode
+func decodeResponse(b []byte, v interface{}) error {
+	we := new(WeChatError)
+	err := json.Unmarshal(b, we)
+	if err != nil {
+		return err
+	}
+
+	if we.Code != 0 {
+		return we
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(b, v)
+}
+
+func apiGet(ctx context.Context, url string, v interface{}) error {
+	b, err := DefaultClient.call(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(b, v)
+}
+
+func apiPost(ctx context.Context, url string, body interface{}, v interface{}) error {
+	b, err := DefaultClient.call(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(b, v)
+}
+
+// apiUpload streams the file as the 'media' field of a multipart form, along with the extra fields.
+// The upload isn't retried since the file can only be read once
+func apiUpload(ctx context.Context, url, filename string, r io.Reader, fields map[string]string, v interface{}) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		var err error
+		for name, value := range fields {
+			err = mw.WriteField(name, value)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+
+		part, err := mw.CreateFormFile("media", filename)
+		if err == nil {
+			_, err = io.Copy(part, r)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, url, pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if id := RequestID(ctx); len(id) > 0 {
+		req.Header.Set(RequestIDHeader, id)
+	}
+
+	api := apiPath(url)
+	err = DefaultClient.acquire(ctx, api)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+
+	a := DefaultClient.begin(ctx, http.MethodPost, api)
+	resp, err := DefaultClient.HTTPClient.Do(req.WithContext(a.ctx))
+	if err != nil {
+		a.end(err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		a.end(err)
+		return err
+	}
+
+	err = decodeResponse(b, v)
+	a.end(err)
+	return err
+}
+
+// apiDownload makes a GET request, or a POST request if the body is not nil,
+// and returns the response as is so that the caller can stream it
+func apiDownload(ctx context.Context, url string, body interface{}) (*http.Response, error) {
+	if body == nil {
+		return DefaultClient.download(ctx, http.MethodGet, url, nil)
+	}
+	return DefaultClient.download(ctx, http.MethodPost, url, body)
+}
+
+// wechat responds with json instead of the file content when something goes wrong
+func isJsonResponse(resp *http.Response) bool {
+	contentType := resp.Header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "application/json") || strings.HasPrefix(contentType, "text/plain")
+}
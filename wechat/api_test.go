@@ -0,0 +1,197 @@
+package wechat_test
+
+import (
+	"context"
+	"errors"
+	"github.com/haowang1013/wechat-server/wechat"
+	"github.com/haowang1013/wechat-server/wechat/wechattest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const (
+	testAppID     = "wx-test-app"
+	testAppSecret = "test-secret"
+	testOpenID    = "test-user"
+
+	tokenPath = "/cgi-bin/token"
+	sendPath  = "/cgi-bin/message/custom/send"
+)
+
+// newApiTest points the api functions to a fake server, the retries are quick so that the tests don't wait
+func newApiTest(t *testing.T) *wechattest.Server {
+	s := wechattest.NewServer(testAppID, testAppSecret)
+	s.AddUser(wechat.UserInfo{OpenID: testOpenID, NickName: "alice"})
+
+	client := wechat.DefaultClient
+	wechat.SetBaseUrls(s.URL, s.URL)
+	wechat.DefaultClient.HTTPClient = &http.Client{Timeout: 100 * time.Millisecond}
+	wechat.DefaultClient.RetryDelay = time.Millisecond
+	wechat.DefaultClient.MaxRetryDelay = 4 * time.Millisecond
+
+	t.Cleanup(func() {
+		wechat.DefaultClient = client
+		s.Close()
+	})
+	return s
+}
+
+func getToken(t *testing.T) *wechat.BaseAccessToken {
+	token, err := wechat.GetAccessToken(context.Background(), testAppID, testAppSecret)
+	if err != nil {
+		t.Fatalf("failed to get the access token: %s", err)
+	}
+	return token
+}
+
+func sendText(token *wechat.BaseAccessToken) error {
+	return wechat.SendCustomMessage(context.Background(), token, &wechat.CustomMessage{
+		ToUser:  testOpenID,
+		MsgType: "text",
+		Content: "hello",
+	})
+}
+
+func expectRequests(t *testing.T, s *wechattest.Server, path string, n int) {
+	t.Helper()
+	if r := s.Requests(path); r != n {
+		t.Errorf("%s was requested %d times, expected %d", path, r, n)
+	}
+}
+
+// a response which takes longer than the timeout of the http client
+var slowResponse = wechattest.Response{Body: "{}", Delay: 300 * time.Millisecond}
+
+func TestGetRetry(t *testing.T) {
+	s := newApiTest(t)
+	s.Script(tokenPath,
+		wechattest.ErrorResponse(-1, "system busy"),
+		wechattest.Response{Status: http.StatusBadGateway},
+		slowResponse)
+
+	getToken(t)
+	expectRequests(t, s, tokenPath, 4)
+
+	// gives up after MaxRetries retries
+	for i := 0; i <= wechat.DefaultClient.MaxRetries; i++ {
+		s.InjectError(tokenPath, -1, "system busy")
+	}
+	_, err := wechat.GetAccessToken(context.Background(), testAppID, testAppSecret)
+	if !errors.Is(err, wechat.ErrSystemBusy) {
+		t.Errorf("got %v after running out of retries, expected %s", err, wechat.ErrSystemBusy)
+	}
+	expectRequests(t, s, tokenPath, 4+wechat.DefaultClient.MaxRetries+1)
+
+	// the errors which won't go away aren't retried
+	s.InjectError(tokenPath, 40013, "invalid appid")
+	_, err = wechat.GetAccessToken(context.Background(), testAppID, testAppSecret)
+	if err == nil {
+		t.Error("got no error with an invalid appid")
+	}
+	expectRequests(t, s, tokenPath, 4+wechat.DefaultClient.MaxRetries+2)
+}
+
+func TestPostRetry(t *testing.T) {
+	s := newApiTest(t)
+	token := getToken(t)
+
+	// wechat may have accepted the message before the connection broke
+	s.Script(sendPath, wechattest.Response{Status: http.StatusInternalServerError})
+	if err := sendText(token); err == nil {
+		t.Error("got no error with a 5xx response")
+	}
+	expectRequests(t, s, sendPath, 1)
+
+	s.Script(sendPath, slowResponse)
+	if err := sendText(token); err == nil {
+		t.Error("got no error with a timeout")
+	}
+	expectRequests(t, s, sendPath, 2)
+
+	// while the retryable wechat errors mean the message was rejected
+	s.Script(sendPath, wechattest.ErrorResponse(-1, "system busy"), wechattest.ErrorResponse(45011, "api minute-quota reach limit"))
+	if err := sendText(token); err != nil {
+		t.Errorf("failed to send the message after the retries: %s", err)
+	}
+	expectRequests(t, s, sendPath, 5)
+
+	if sent := s.Sent(); len(sent) != 1 {
+		t.Errorf("%d messages sent, expected 1", len(sent))
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	s := newApiTest(t)
+	wechat.DefaultClient.RetryDelay = time.Hour
+	wechat.DefaultClient.MaxRetryDelay = time.Hour
+	s.Script(tokenPath, wechattest.ErrorResponse(-1, "system busy"), wechattest.ErrorResponse(-1, "system busy"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := wechat.GetAccessToken(ctx, testAppID, testAppSecret)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v after the context is done, expected %s", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("the call returned after %s, expected it to stop waiting for the retry", d)
+	}
+	expectRequests(t, s, tokenPath, 1)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	s := newApiTest(t)
+
+	// the delay would be an hour without the cap
+	wechat.DefaultClient.RetryDelay = time.Hour
+	wechat.DefaultClient.MaxRetryDelay = 10 * time.Millisecond
+	s.Script(tokenPath, wechattest.ErrorResponse(-1, "system busy"), wechattest.ErrorResponse(-1, "system busy"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err := wechat.GetAccessToken(ctx, testAppID, testAppSecret)
+	if err != nil {
+		t.Fatalf("failed to get the access token after the retries: %s", err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("the retries took %s, expected at least 2 delays of 10ms", d)
+	}
+
+	// the delay doubles after each retry
+	wechat.DefaultClient.RetryDelay = 20 * time.Millisecond
+	wechat.DefaultClient.MaxRetryDelay = time.Hour
+	s.Script(tokenPath, wechattest.ErrorResponse(-1, "system busy"), wechattest.ErrorResponse(-1, "system busy"))
+
+	start = time.Now()
+	_, err = wechat.GetAccessToken(ctx, testAppID, testAppSecret)
+	if err != nil {
+		t.Fatalf("failed to get the access token after the retries: %s", err)
+	}
+	if d := time.Since(start); d < 60*time.Millisecond {
+		t.Errorf("the retries took %s, expected at least 20ms + 40ms", d)
+	}
+}
+
+func TestSetProxy(t *testing.T) {
+	s := newApiTest(t)
+
+	// the fake server serves the requests it proxies as well, so the calls to an unknown host end up there
+	wechat.SetBaseUrls("http://api.wechat.invalid", "http://open.wechat.invalid")
+	err := wechat.DefaultClient.SetProxy(s.URL)
+	if err != nil {
+		t.Fatalf("failed to set the proxy: %s", err)
+	}
+
+	getToken(t)
+	expectRequests(t, s, tokenPath, 1)
+
+	for _, u := range []string{"proxy:3128", "http://", "://proxy"} {
+		if err := wechat.DefaultClient.SetProxy(u); err == nil {
+			t.Errorf("invalid proxy url '%s' is accepted", u)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package wechat
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+)
+
+var (
+	ErrInvalidPadding = errors.New("invalid padding")
+)
+
+// aesDecrypt decrypts the data with AES-CBC, and removes the PKCS#7 padding
+func aesDecrypt(key, iv, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(iv) != block.BlockSize() {
+		return nil, errors.New("invalid iv size")
+	}
+
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("invalid data size")
+	}
+
+	result := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(result, data)
+	return pkcs7Unpad(result, block.BlockSize())
+}
+
+func pkcs7Unpad(data []byte, blockSize int) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, ErrInvalidPadding
+	}
+
+	n := int(data[len(data)-1])
+	if n == 0 || n > blockSize || n > len(data) {
+		return nil, ErrInvalidPadding
+	}
+
+	for _, b := range data[len(data)-n:] {
+		if int(b) != n {
+			return nil, ErrInvalidPadding
+		}
+	}
+	return data[:len(data)-n], nil
+}
+
+// MessageCrypter encrypts and decrypts the messages in the safe mode, where the messages and the replies are
+// encrypted with the EncodingAESKey configured for the official account
+type MessageCrypter struct {
+	token string
+	appID string
+	key   []byte
+}
+
+func NewMessageCrypter(token, encodingAESKey, appID string) (*MessageCrypter, error) {
+	key, err := base64.StdEncoding.DecodeString(encodingAESKey + "=")
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("invalid EncodingAESKey, must be 43 characters")
+	}
+
+	c := new(MessageCrypter)
+	c.token = token
+	c.appID = appID
+	c.key = key
+	return c, nil
+}
+
+// Encrypt encrypts the message as base64(aes(random(16) + length(4) + message + appID))
+func (this *MessageCrypter) Encrypt(message []byte) (string, error) {
+	plain := make([]byte, 20, 20+len(message)+len(this.appID)+32)
+	_, err := rand.Read(plain[:16])
+	if err != nil {
+		return "", err
+	}
+
+	binary.BigEndian.PutUint32(plain[16:20], uint32(len(message)))
+	plain = append(plain, message...)
+	plain = append(plain, this.appID...)
+
+	// the padding is based on 32 bytes instead of the aes block size
+	n := 32 - len(plain)%32
+	plain = append(plain, bytes.Repeat([]byte{byte(n)}, n)...)
+
+	block, err := aes.NewCipher(this.key)
+	if err != nil {
+		return "", err
+	}
+
+	result := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, this.key[:16]).CryptBlocks(result, plain)
+	return base64.StdEncoding.EncodeToString(result), nil
+}
+
+// Decrypt decrypts the message, and makes sure it's for the app
+func (this *MessageCrypter) Decrypt(encrypted string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(this.key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("invalid data size")
+	}
+
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, this.key[:16]).CryptBlocks(plain, data)
+	plain, err = pkcs7Unpad(plain, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(plain) < 20 {
+		return nil, errors.New("invalid message size")
+	}
+
+	n := int(binary.BigEndian.Uint32(plain[16:20]))
+	if n > len(plain)-20 {
+		return nil, errors.New("invalid message size")
+	}
+
+	if string(plain[20+n:]) != this.appID {
+		return nil, errors.New("message isn't for the app")
+	}
+	return plain[20 : 20+n], nil
+}
+
+// Signature returns the msg_signature of the encrypted message
+func (this *MessageCrypter) Signature(timestamp, nonce, encrypted string) string {
+	return sign(this.token, timestamp, nonce, encrypted)
+}
+
+// DecryptMessage verifies and decrypts the body of a message request
+func (this *MessageCrypter) DecryptMessage(body []byte, timestamp, nonce, msgSignature string) ([]byte, error) {
+	envelope := new(encryptedMessage)
+	err := xml.Unmarshal(body, envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	if this.Signature(timestamp, nonce, envelope.Encrypt.Text) != msgSignature {
+		return nil, ErrInvalidSignature
+	}
+	return this.Decrypt(envelope.Encrypt.Text)
+}
+
+// EncryptMessage encrypts a message or a reply into the xml envelope
+func (this *MessageCrypter) EncryptMessage(message []byte, timestamp, nonce string) ([]byte, error) {
+	encrypted, err := this.Encrypt(message)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := &encryptedMessage{
+		Encrypt:      cdata{encrypted},
+		MsgSignature: cdata{this.Signature(timestamp, nonce, encrypted)},
+		TimeStamp:    timestamp,
+		Nonce:        cdata{nonce},
+	}
+	return xml.Marshal(envelope)
+}
+
+// UnwrapMessage returns the encrypted message in the envelope without verifying it, e.g. to decrypt a reply
+func UnwrapMessage(body []byte) (encrypted, msgSignature, timestamp, nonce string, err error) {
+	envelope := new(encryptedMessage)
+	err = xml.Unmarshal(body, envelope)
+	return envelope.Encrypt.Text, envelope.MsgSignature.Text, envelope.TimeStamp, envelope.Nonce.Text, err
+}
+
+type cdata struct {
+	Text string `xml:",cdata"`
+}
+
+type encryptedMessage struct {
+	XMLName      xml.Name `xml:"xml"`
+	ToUserName   *cdata   `xml:"ToUserName,omitempty"`
+	Encrypt      cdata
+	MsgSignature cdata  `xml:"MsgSignature,omitempty"`
+	TimeStamp    string `xml:"TimeStamp,omitempty"`
+	Nonce        cdata  `xml:"Nonce,omitempty"`
+}
@@ -0,0 +1,128 @@
+package wechat
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// the parameters of the sample in the wechat documentation of the safe mode
+const (
+	sampleToken          = "spamtest"
+	sampleEncodingAESKey = "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFG"
+	sampleAppID          = "wx2c2769f8efd9abc2"
+	sampleTimestamp      = "1409304348"
+	sampleNonce          = "xxxxxx"
+
+	sampleMessage = "<xml><ToUserName><![CDATA[wx5823bf96d3bd56c7]]></ToUserName><FromUserName><![CDATA[mycreate]]></FromUserName>" +
+		"<CreateTime>1409659813</CreateTime><MsgType><![CDATA[text]]></MsgType><Content><![CDATA[hello]]></Content>" +
+		"<MsgId>4561255354251345929</MsgId><AgentID>218</AgentID></xml>"
+
+	// sampleMessage encrypted with the random bytes '0123456789abcdef', computed with openssl instead of Encrypt
+	sampleEncrypted = "Q3stYC6hdFzMh9T8HCvyDOijj+4zIgvMT9VuUUUXZ83uWV9cfs9MykO61TAWJaKcWvtYJeLrwtzo3SArfdhSQZCl0fmWGk81tzLBBiJ" +
+		"wpbis5UQAymyR2GLZjqWFGK62+lyMoWBsu/Zvs5vceRer11hGDIfalIp1p97Ft5svR3lNoM7LGZ5bSU3DJfsoJ1PKv/++sqTRpzjetRd8PPTEJzo/" +
+		"2vyedw1rpijtUVH3aX94PSv1N3y2MVpf/M+/qAHtvwAlX4E8HZPC0Zv9d1lBi3apFAo+i3g9pV7Q/Lggq7mzyrx2T2aJq6PWZCvTXcdwKFHjmlApF" +
+		"TLhcPYCb3fAhYbKyxykXkPiWWBJe6XcFvhJHbcwtzqL6CLvrIFWI/RKCWFXbJ/EQW9GpgS7oSqt0UVKRuxgMKQMNZH2juDmvOw="
+	sampleSignature = "c352efa5f01441f4738cc0cbaaa962c2b3fb121e"
+)
+
+func newSampleCrypter(t *testing.T, appID string) *MessageCrypter {
+	c, err := NewMessageCrypter(sampleToken, sampleEncodingAESKey, appID)
+	if err != nil {
+		t.Fatalf("failed to create the crypter: %s", err)
+	}
+	return c
+}
+
+func TestMessageCrypterSample(t *testing.T) {
+	c := newSampleCrypter(t, sampleAppID)
+
+	if s := c.Signature(sampleTimestamp, sampleNonce, sampleEncrypted); s != sampleSignature {
+		t.Errorf("got signature %s, expected %s", s, sampleSignature)
+	}
+
+	message, err := c.Decrypt(sampleEncrypted)
+	if err != nil {
+		t.Fatalf("failed to decrypt the sample: %s", err)
+	}
+	if string(message) != sampleMessage {
+		t.Errorf("got message %s, expected %s", message, sampleMessage)
+	}
+
+	body := []byte("<xml><ToUserName><![CDATA[wx5823bf96d3bd56c7]]></ToUserName><Encrypt><![CDATA[" + sampleEncrypted + "]]></Encrypt></xml>")
+	message, err = c.DecryptMessage(body, sampleTimestamp, sampleNonce, sampleSignature)
+	if err != nil {
+		t.Fatalf("failed to decrypt the sample envelope: %s", err)
+	}
+	if string(message) != sampleMessage {
+		t.Errorf("got message %s, expected %s", message, sampleMessage)
+	}
+
+	_, err = c.DecryptMessage(body, sampleTimestamp, "yyyyyy", sampleSignature)
+	if err != ErrInvalidSignature {
+		t.Errorf("got %v with a wrong nonce, expected %s", err, ErrInvalidSignature)
+	}
+
+	_, err = newSampleCrypter(t, "wx-another-app").Decrypt(sampleEncrypted)
+	if err == nil {
+		t.Error("the sample is decrypted by another app")
+	}
+}
+
+func TestMessageCrypterRoundTrip(t *testing.T) {
+	c := newSampleCrypter(t, sampleAppID)
+
+	// the lengths around the 32 bytes padding, including a message padded by a full block
+	messages := [][]byte{
+		{},
+		[]byte("hello"),
+		bytes.Repeat([]byte("a"), 64-20-len(sampleAppID)),
+		bytes.Repeat([]byte("b"), 64-20-len(sampleAppID)-1),
+		[]byte(sampleMessage),
+		[]byte(strings.Repeat("你好", 100)),
+	}
+
+	for _, m := range messages {
+		encrypted, err := c.Encrypt(m)
+		if err != nil {
+			t.Fatalf("failed to encrypt %d bytes: %s", len(m), err)
+		}
+
+		decrypted, err := c.Decrypt(encrypted)
+		if err != nil {
+			t.Fatalf("failed to decrypt %d bytes: %s", len(m), err)
+		}
+		if !bytes.Equal(decrypted, m) {
+			t.Errorf("got %q after the round trip, expected %q", decrypted, m)
+		}
+
+		again, err := c.Encrypt(m)
+		if err != nil {
+			t.Fatalf("failed to encrypt %d bytes: %s", len(m), err)
+		}
+		if again == encrypted {
+			t.Errorf("%d bytes encrypted to the same text twice", len(m))
+		}
+	}
+
+	envelope, err := c.EncryptMessage([]byte(sampleMessage), sampleTimestamp, sampleNonce)
+	if err != nil {
+		t.Fatalf("failed to encrypt the envelope: %s", err)
+	}
+
+	encrypted, signature, timestamp, nonce, err := UnwrapMessage(envelope)
+	if err != nil {
+		t.Fatalf("failed to unwrap the envelope: %s", err)
+	}
+	if timestamp != sampleTimestamp || nonce != sampleNonce || signature != c.Signature(timestamp, nonce, encrypted) {
+		t.Errorf("invalid envelope: %s", envelope)
+	}
+
+	message, err := c.DecryptMessage(envelope, timestamp, nonce, signature)
+	if err != nil {
+		t.Fatalf("failed to decrypt the envelope: %s", err)
+	}
+	if string(message) != sampleMessage {
+		t.Errorf("got message %s, expected %s", message, sampleMessage)
+	}
+}
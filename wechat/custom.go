@@ -0,0 +1,86 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// CustomMessage is a message sent to a follower by the customer service, which is only allowed within
+// 48 hours after the follower interacts with the official account.
+// The msgtype is one of text, image, voice, video, mpnews and wxcard
+type CustomMessage struct {
+	ToUser       string `json:"touser"`
+	MsgType      string `json:"msgtype"`
+	Content      string `json:"content,omitempty"`
+	MediaID      string `json:"media_id,omitempty"`
+	ThumbMediaID string `json:"thumb_media_id,omitempty"`
+	Title        string `json:"title,omitempty"`
+	Description  string `json:"description,omitempty"`
+	CardID       string `json:"card_id,omitempty"`
+
+	// the customer service account to send the message as, optional
+	KfAccount string `json:"kf_account,omitempty"`
+}
+
+func (this *CustomMessage) body() (map[string]interface{}, error) {
+	if len(this.ToUser) == 0 {
+		return nil, errors.New("custom message requires touser")
+	}
+
+	body := map[string]interface{}{
+		"touser":  this.ToUser,
+		"msgtype": this.MsgType,
+	}
+
+	switch this.MsgType {
+	case "text":
+		if len(this.Content) == 0 {
+			return nil, errors.New("text message requires content")
+		}
+		body["text"] = map[string]string{"content": this.Content}
+	case "image", "voice", "mpnews":
+		if len(this.MediaID) == 0 {
+			return nil, fmt.Errorf("%s message requires media id", this.MsgType)
+		}
+		body[this.MsgType] = map[string]string{"media_id": this.MediaID}
+	case "video":
+		if len(this.MediaID) == 0 {
+			return nil, errors.New("video message requires media id")
+		}
+		body["video"] = map[string]string{
+			"media_id":       this.MediaID,
+			"thumb_media_id": this.ThumbMediaID,
+			"title":          this.Title,
+			"description":    this.Description,
+		}
+	case "wxcard":
+		if len(this.CardID) == 0 {
+			return nil, errors.New("wxcard message requires card id")
+		}
+		body["wxcard"] = map[string]string{"card_id": this.CardID}
+	default:
+		return nil, fmt.Errorf("unsupported custom message type: '%s'", this.MsgType)
+	}
+
+	if len(this.KfAccount) > 0 {
+		body["customservice"] = map[string]string{"kf_account": this.KfAccount}
+	}
+	return body, nil
+}
+
+func SendCustomMessage(ctx context.Context, token *BaseAccessToken, m *CustomMessage) error {
+	body, err := m.body()
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/cgi-bin/message/custom/send?access_token=%s", apiUrl(), token.Token)
+	err = apiPost(ctx, url, body, nil)
+	if err != nil {
+		return err
+	}
+
+	recordCustomMessage(ctx, m)
+	return nil
+}
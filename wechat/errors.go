@@ -0,0 +1,124 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// WeChatError is the errcode and errmsg returned by the wechat api, use errors.Is to compare it with
+// the errors below, which matches the errcode regardless of the message
+type WeChatError struct {
+	Code    int    `json:"errcode"`
+	Message string `json:"errmsg"`
+}
+
+func (this *WeChatError) Error() string {
+	return fmt.Sprintf("Code: %d, Message: %s", this.Code, this.Message)
+}
+
+func (this *WeChatError) Is(target error) bool {
+	t, ok := target.(*WeChatError)
+	return ok && t.Code == this.Code
+}
+
+// Retryable tells if the call may succeed when repeated later, e.g. when wechat is busy
+func (this *WeChatError) Retryable() bool {
+	return matchError(this, retryableErrors)
+}
+
+// TokenInvalid tells if the call may succeed with a new access token
+func (this *WeChatError) TokenInvalid() bool {
+	return matchError(this, tokenErrors)
+}
+
+func NewError(code int, message string) *WeChatError {
+	err := new(WeChatError)
+	err.Code = code
+	err.Message = message
+	return err
+}
+
+// the known errcodes of the wechat api
+var (
+	ErrSystemBusy          = NewError(-1, "system busy")
+	ErrInvalidCredential   = NewError(40001, "invalid credential, access_token is invalid or not latest")
+	ErrInvalidOpenID       = NewError(40003, "invalid openid")
+	ErrInvalidAppID        = NewError(40013, "invalid appid")
+	ErrInvalidAccessToken  = NewError(40014, "invalid access_token")
+	ErrInvalidCode         = NewError(40029, "invalid code")
+	ErrInvalidRefreshToken = NewError(40030, "invalid refresh_token")
+	ErrInvalidTemplateID   = NewError(40037, "invalid template_id")
+	ErrInvalidAppSecret    = NewError(40125, "invalid appsecret")
+	ErrCodeUsed            = NewError(40163, "code been used")
+	ErrIPNotAllowed        = NewError(40164, "invalid ip, not in whitelist")
+	ErrAccessTokenExpired  = NewError(42001, "access_token expired")
+	ErrRefreshTokenExpired = NewError(42002, "refresh_token expired")
+	ErrCodeExpired         = NewError(42003, "code expired")
+	ErrUserNotSubscribed   = NewError(43004, "require subscribe")
+	ErrUserRefused         = NewError(43101, "user refuse to accept the msg")
+	ErrDailyQuotaExceeded  = NewError(45009, "reach max api daily quota limit")
+	ErrRateLimited         = NewError(45011, "api minute-quota reach limit")
+	ErrReplyTimeLimit      = NewError(45015, "response out of time limit or subscription is canceled")
+	ErrAPIUnauthorized     = NewError(48001, "api unauthorized")
+	ErrUserUnauthorized    = NewError(50001, "user unauthorized")
+)
+
+var (
+	// errors which may go away after a while
+	retryableErrors = []*WeChatError{
+		ErrSystemBusy,
+		ErrRateLimited,
+	}
+
+	// errors caused by an access token which has expired or been replaced by a newer one
+	tokenErrors = []*WeChatError{
+		ErrInvalidCredential,
+		ErrInvalidAccessToken,
+		ErrAccessTokenExpired,
+	}
+)
+
+func matchError(err *WeChatError, list []*WeChatError) bool {
+	for _, e := range list {
+		if err.Is(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRetryable tells if the call may succeed when repeated later, which is true for the retryable wechat errors,
+// the network errors and 5xx responses, but not when the context is done
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var we *WeChatError
+	if errors.As(err, &we) {
+		return we.Retryable()
+	}
+
+	var se httpStatusError
+	if errors.As(err, &se) {
+		return true
+	}
+
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// IsTokenInvalid tells if the call may succeed with a new access token
+func IsTokenInvalid(err error) bool {
+	var we *WeChatError
+	return errors.As(err, &we) && we.TokenInvalid()
+}
+
+// IsPermanent tells if the call failed with a wechat error which won't go away by repeating the call,
+// e.g. invalid arguments or missing permissions
+func IsPermanent(err error) bool {
+	var we *WeChatError
+	return errors.As(err, &we) && !we.Retryable() && !we.TokenInvalid()
+}
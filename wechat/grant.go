@@ -0,0 +1,68 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// a refresh token stays valid for 30 days after the user authorized the official account
+	WebRefreshTokenLifeTime = 30 * 24 * time.Hour
+)
+
+var (
+	ErrGrantNotFound = errors.New("web grant not found")
+	ErrGrantExpired  = errors.New("web grant expired")
+)
+
+// WebGrant keeps a web access token along with the time it was obtained,
+// so that it can be refreshed until the refresh token expires
+type WebGrant struct {
+	AppID         string         `json:"app_id"`
+	Token         WebAccessToken `json:"token"`
+	TokenTime     int64          `json:"token_time"`
+	AuthorizeTime int64          `json:"authorize_time"`
+}
+
+type GrantStore interface {
+	SaveGrant(g *WebGrant) error
+	LoadGrant(openID string) (*WebGrant, bool)
+}
+
+func (this *WebGrant) TokenExpired() bool {
+	expireTime := time.Unix(this.TokenTime, 0).Add(time.Duration(this.Token.ExpiresIn) * time.Second)
+	return time.Now().Add(accessTokenExpireMargin).After(expireTime)
+}
+
+func (this *WebGrant) RefreshExpired() bool {
+	expireTime := time.Unix(this.AuthorizeTime, 0).Add(WebRefreshTokenLifeTime)
+	return time.Now().After(expireTime)
+}
+
+func (this *WebGrant) Refresh(ctx context.Context) error {
+	token, err := RefreshWebAccessToken(ctx, this.AppID, this.Token.RefreshToken)
+	if err != nil {
+		return err
+	}
+	observeTokenRefresh(WebAccessTokenRefresh)
+
+	// the refresh response doesn't always carry the union id
+	if len(token.UnionID) == 0 {
+		token.UnionID = this.Token.UnionID
+	}
+
+	this.Token = *token
+	this.TokenTime = time.Now().Unix()
+	return nil
+}
+
+func NewWebGrant(appID string, token *WebAccessToken) *WebGrant {
+	now := time.Now().Unix()
+	g := new(WebGrant)
+	g.AppID = appID
+	g.Token = *token
+	g.TokenTime = now
+	g.AuthorizeTime = now
+	return g
+}
@@ -0,0 +1,94 @@
+package wechat
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type JSAPITicket struct {
+	Ticket    string `json:"ticket"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// JSSDKConfig is the payload of wx.config on the page of the url
+type JSSDKConfig struct {
+	AppID     string `json:"appId"`
+	Timestamp int64  `json:"timestamp"`
+	NonceStr  string `json:"nonceStr"`
+	Signature string `json:"signature"`
+	Url       string `json:"url"`
+}
+
+func GetJSAPITicket(ctx context.Context, token *BaseAccessToken) (*JSAPITicket, error) {
+	url := fmt.Sprintf("%s/cgi-bin/ticket/getticket?access_token=%s&type=jsapi", apiUrl(), token.Token)
+	ticket := new(JSAPITicket)
+	err := apiGet(ctx, url, ticket)
+	if err != nil {
+		return nil, err
+	}
+	return ticket, nil
+}
+
+// SignJSSDK returns the signature of wx.config, the fragment of the url is not signed
+func SignJSSDK(ticket, nonceStr string, timestamp int64, url string) string {
+	if i := strings.Index(url, "#"); i >= 0 {
+		url = url[:i]
+	}
+
+	s := fmt.Sprintf("jsapi_ticket=%s&noncestr=%s&timestamp=%d&url=%s", ticket, nonceStr, timestamp, url)
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewJSSDKConfig signs the url with a new nonce and the current time
+func NewJSSDKConfig(appID, ticket, url string) (*JSSDKConfig, error) {
+	nonce := make([]byte, 8)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	if i := strings.Index(url, "#"); i >= 0 {
+		url = url[:i]
+	}
+
+	config := new(JSSDKConfig)
+	config.AppID = appID
+	config.Timestamp = time.Now().Unix()
+	config.NonceStr = hex.EncodeToString(nonce)
+	config.Url = url
+	config.Signature = SignJSSDK(ticket, config.NonceStr, config.Timestamp, url)
+	return config, nil
+}
+
+// jsapiTicketCache keeps the jsapi ticket until shortly before it expires
+type jsapiTicketCache struct {
+	ticket     *JSAPITicket
+	expireTime time.Time
+	m          sync.Mutex
+}
+
+func (this *jsapiTicketCache) get(ctx context.Context, token *BaseAccessToken) (*JSAPITicket, error) {
+	this.m.Lock()
+	defer this.m.Unlock()
+
+	if this.ticket != nil && time.Now().Before(this.expireTime) {
+		return this.ticket, nil
+	}
+
+	ticket, err := GetJSAPITicket(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	observeTokenRefresh(JSAPITicketRefresh)
+
+	this.ticket = ticket
+	this.expireTime = time.Now().Add(time.Duration(ticket.ExpiresIn)*time.Second - accessTokenExpireMargin)
+	return ticket, nil
+}
@@ -0,0 +1,179 @@
+package wechat
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+)
+
+var (
+	kfAvatarLimit = mediaLimit{2 << 20, []string{".jpg"}}
+)
+
+// KfAccount is a customer service account, the account is in the form of 'name@official_account_id'
+type KfAccount struct {
+	Account          string `json:"kf_account"`
+	Nick             string `json:"kf_nick"`
+	ID               string `json:"kf_id"`
+	HeadImgUrl       string `json:"kf_headimgurl"`
+	WxAccount        string `json:"kf_wx"`
+	InviteWx         string `json:"invite_wx"`
+	InviteExpireTime int64  `json:"invite_expire_time"`
+	InviteStatus     string `json:"invite_status"`
+}
+
+// OnlineKfAccount is a customer service account which is online, the status is 1 for the web client
+type OnlineKfAccount struct {
+	Account      string `json:"kf_account"`
+	ID           string `json:"kf_id"`
+	Status       int    `json:"status"`
+	AcceptedCase int    `json:"accepted_case"`
+}
+
+// KfSession is a conversation between a follower and a customer service account
+type KfSession struct {
+	Account    string `json:"kf_account"`
+	OpenID     string `json:"openid"`
+	CreateTime int64  `json:"createtime"`
+}
+
+// KfWaitingSession is a follower waiting to be accepted by a customer service account
+type KfWaitingSession struct {
+	OpenID     string `json:"openid"`
+	LatestTime int64  `json:"latest_time"`
+}
+
+type KfWaitingList struct {
+	Count    int                `json:"count"`
+	Sessions []KfWaitingSession `json:"waitcaselist"`
+}
+
+func GetKfAccounts(ctx context.Context, token *BaseAccessToken) ([]KfAccount, error) {
+	url := fmt.Sprintf("%s/cgi-bin/customservice/getkflist?access_token=%s", apiUrl(), token.Token)
+	result := new(struct {
+		Accounts []KfAccount `json:"kf_list"`
+	})
+	err := apiGet(ctx, url, result)
+	if err != nil {
+		return nil, err
+	}
+	return result.Accounts, nil
+}
+
+func GetOnlineKfAccounts(ctx context.Context, token *BaseAccessToken) ([]OnlineKfAccount, error) {
+	url := fmt.Sprintf("%s/cgi-bin/customservice/getonlinekflist?access_token=%s", apiUrl(), token.Token)
+	result := new(struct {
+		Accounts []OnlineKfAccount `json:"kf_online_list"`
+	})
+	err := apiGet(ctx, url, result)
+	if err != nil {
+		return nil, err
+	}
+	return result.Accounts, nil
+}
+
+func AddKfAccount(ctx context.Context, token *BaseAccessToken, account, nick string) error {
+	url := fmt.Sprintf("%s/customservice/kfaccount/add?access_token=%s", apiUrl(), token.Token)
+	body := map[string]string{
+		"kf_account": account,
+		"nickname":   nick,
+	}
+	return apiPost(ctx, url, body, nil)
+}
+
+func UpdateKfAccount(ctx context.Context, token *BaseAccessToken, account, nick string) error {
+	url := fmt.Sprintf("%s/customservice/kfaccount/update?access_token=%s", apiUrl(), token.Token)
+	body := map[string]string{
+		"kf_account": account,
+		"nickname":   nick,
+	}
+	return apiPost(ctx, url, body, nil)
+}
+
+func DeleteKfAccount(ctx context.Context, token *BaseAccessToken, account string) error {
+	url := fmt.Sprintf("%s/customservice/kfaccount/del?access_token=%s&kf_account=%s", apiUrl(), token.Token, url.QueryEscape(account))
+	return apiGet(ctx, url, nil)
+}
+
+// InviteKfWorker invites the wechat user to bind the customer service account, the invitation expires in 7 days
+func InviteKfWorker(ctx context.Context, token *BaseAccessToken, account, wx string) error {
+	url := fmt.Sprintf("%s/customservice/kfaccount/inviteworker?access_token=%s", apiUrl(), token.Token)
+	body := map[string]string{
+		"kf_account": account,
+		"invite_wx":  wx,
+	}
+	return apiPost(ctx, url, body, nil)
+}
+
+// UploadKfAvatar uploads the avatar of the customer service account, which must be a jpg image
+func UploadKfAvatar(ctx context.Context, token *BaseAccessToken, account, filename string, r io.Reader, size int64) error {
+	err := kfAvatarLimit.validate(MediaImage, filename, size)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/customservice/kfaccount/uploadheadimg?access_token=%s&kf_account=%s",
+		apiUrl(), token.Token, url.QueryEscape(account))
+	return apiUpload(ctx, url, filename, kfAvatarLimit.reader(r), nil, nil)
+}
+
+// CreateKfSession assigns the follower to the customer service account, the account must be online
+func CreateKfSession(ctx context.Context, token *BaseAccessToken, account, openID string) error {
+	url := fmt.Sprintf("%s/customservice/kfsession/create?access_token=%s", apiUrl(), token.Token)
+	body := map[string]string{
+		"kf_account": account,
+		"openid":     openID,
+	}
+	return apiPost(ctx, url, body, nil)
+}
+
+func CloseKfSession(ctx context.Context, token *BaseAccessToken, account, openID string) error {
+	url := fmt.Sprintf("%s/customservice/kfsession/close?access_token=%s", apiUrl(), token.Token)
+	body := map[string]string{
+		"kf_account": account,
+		"openid":     openID,
+	}
+	return apiPost(ctx, url, body, nil)
+}
+
+// GetKfSession returns the session of the follower, the account is empty if the follower isn't in a session
+func GetKfSession(ctx context.Context, token *BaseAccessToken, openID string) (*KfSession, error) {
+	url := fmt.Sprintf("%s/customservice/kfsession/getsession?access_token=%s&openid=%s", apiUrl(), token.Token, openID)
+	session := new(KfSession)
+	err := apiGet(ctx, url, session)
+	if err != nil {
+		return nil, err
+	}
+	session.OpenID = openID
+	return session, nil
+}
+
+// GetKfSessions returns the sessions of the customer service account
+func GetKfSessions(ctx context.Context, token *BaseAccessToken, account string) ([]KfSession, error) {
+	url := fmt.Sprintf("%s/customservice/kfsession/getsessionlist?access_token=%s&kf_account=%s",
+		apiUrl(), token.Token, url.QueryEscape(account))
+	result := new(struct {
+		Sessions []KfSession `json:"sessionlist"`
+	})
+	err := apiGet(ctx, url, result)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range result.Sessions {
+		result.Sessions[i].Account = account
+	}
+	return result.Sessions, nil
+}
+
+// GetWaitingKfSessions returns the followers waiting for a customer service account
+func GetWaitingKfSessions(ctx context.Context, token *BaseAccessToken) (*KfWaitingList, error) {
+	url := fmt.Sprintf("%s/customservice/kfsession/getwaitcase?access_token=%s", apiUrl(), token.Token)
+	list := new(KfWaitingList)
+	err := apiGet(ctx, url, list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
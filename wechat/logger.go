@@ -1,5 +1,12 @@
 package wechat
 
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"regexp"
+)
+
 type LogType int
 
 const (
@@ -16,3 +23,81 @@ type Logger interface {
 	Log(t LogType, text string)
 	Logf(t LogType, format string, v ...interface{})
 }
+
+// Fields are the key/value pairs logged along with the text, e.g. the request id
+type Fields map[string]interface{}
+
+// FieldLogger is a Logger which also takes the fields, the fields are dropped by the loggers which don't implement it
+type FieldLogger interface {
+	Logger
+	LogFields(t LogType, text string, fields Fields)
+}
+
+const (
+	// the header carrying the request id, which is also sent along with the api calls made for the request
+	RequestIDHeader = "X-Request-ID"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the id of the request, which is logged by the server and the client
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the id of the request carried by the context, or empty if there is none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+var (
+	secretPattern     = regexp.MustCompile(`(?i)\b(appsecret|secret|access_token|refresh_token|code|session_key|ticket)=[^&\s,'"]+`)
+	jsonSecretPattern = regexp.MustCompile(`(?i)"(appsecret|secret|access_token|refresh_token|code|session_key|ticket)"\s*:\s*"(?:[^"\\]|\\.)*"`)
+)
+
+// Redact replaces the values of the secrets in the query strings and the json in the text,
+// e.g. access_token=xxx or "access_token":"xxx", so that the urls and the bodies can be logged
+func Redact(text string) string {
+	text = secretPattern.ReplaceAllString(text, "$1=REDACTED")
+	return jsonSecretPattern.ReplaceAllString(text, `"$1":"REDACTED"`)
+}
+
+// logContext logs the text with the request id of the context, if the logger takes fields
+func logContext(ctx context.Context, logger Logger, t LogType, text string, fields Fields) {
+	if logger == nil {
+		return
+	}
+
+	text = Redact(text)
+	fl, ok := logger.(FieldLogger)
+	if !ok {
+		logger.Log(t, text)
+		return
+	}
+
+	fl.LogFields(t, text, ContextFields(ctx, fields))
+}
+
+// ContextFields adds the request id and the trace of the context to the fields
+func ContextFields(ctx context.Context, fields Fields) Fields {
+	if fields == nil {
+		fields = make(Fields)
+	}
+
+	if id := RequestID(ctx); len(id) > 0 {
+		fields["request_id"] = id
+	}
+
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		fields["trace_id"] = sc.TraceID().String()
+		fields["span_id"] = sc.SpanID().String()
+	}
+	return fields
+}
+
+func logContextf(ctx context.Context, logger Logger, t LogType, format string, v ...interface{}) {
+	if logger != nil {
+		logContext(ctx, logger, t, fmt.Sprintf(format, v...), nil)
+	}
+}
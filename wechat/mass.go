@@ -0,0 +1,138 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+const (
+	// limits of the number of users for SendMassToUsers
+	MinMassUsers = 2
+	MaxMassUsers = 10000
+)
+
+// MassMessage is the content of a broadcast, msgtype is one of text, image, voice, mpvideo, mpnews and wxcard.
+// Text messages use the content, cards use the card id, others use the media id
+type MassMessage struct {
+	MsgType           string `json:"msgtype"`
+	Content           string `json:"content,omitempty"`
+	MediaID           string `json:"media_id,omitempty"`
+	CardID            string `json:"card_id,omitempty"`
+	SendIgnoreReprint bool   `json:"send_ignore_reprint,omitempty"`
+}
+
+type MassResult struct {
+	MsgID     int64 `json:"msg_id"`
+	MsgDataID int64 `json:"msg_data_id"`
+}
+
+func (this *MassMessage) validate() error {
+	switch this.MsgType {
+	case "text":
+		if len(this.Content) == 0 {
+			return errors.New("text broadcast requires content")
+		}
+	case "image", "voice", "mpvideo", "mpnews":
+		if len(this.MediaID) == 0 {
+			return fmt.Errorf("%s broadcast requires media id", this.MsgType)
+		}
+	case "wxcard":
+		if len(this.CardID) == 0 {
+			return errors.New("wxcard broadcast requires card id")
+		}
+	default:
+		return fmt.Errorf("unsupported broadcast type: '%s'", this.MsgType)
+	}
+	return nil
+}
+
+// body returns the request body of the message, along with the fields of the target
+func (this *MassMessage) body(target map[string]interface{}) map[string]interface{} {
+	body := target
+	body["msgtype"] = this.MsgType
+
+	switch this.MsgType {
+	case "text":
+		body["text"] = map[string]string{"content": this.Content}
+	case "wxcard":
+		body["wxcard"] = map[string]string{"card_id": this.CardID}
+	default:
+		body[this.MsgType] = map[string]string{"media_id": this.MediaID}
+	}
+
+	if this.MsgType == "mpnews" {
+		reprint := 0
+		if this.SendIgnoreReprint {
+			reprint = 1
+		}
+		body["send_ignore_reprint"] = reprint
+	}
+	return body
+}
+
+func SendMassToAll(ctx context.Context, token *BaseAccessToken, m *MassMessage) (*MassResult, error) {
+	filter := map[string]interface{}{
+		"is_to_all": true,
+	}
+	return sendMass(ctx, token, "sendall", m, map[string]interface{}{"filter": filter})
+}
+
+func SendMassToTag(ctx context.Context, token *BaseAccessToken, tagID int, m *MassMessage) (*MassResult, error) {
+	filter := map[string]interface{}{
+		"is_to_all": false,
+		"tag_id":    tagID,
+	}
+	return sendMass(ctx, token, "sendall", m, map[string]interface{}{"filter": filter})
+}
+
+func SendMassToUsers(ctx context.Context, token *BaseAccessToken, openIDs []string, m *MassMessage) (*MassResult, error) {
+	if len(openIDs) < MinMassUsers || len(openIDs) > MaxMassUsers {
+		return nil, fmt.Errorf("invalid number of users: %d", len(openIDs))
+	}
+	return sendMass(ctx, token, "send", m, map[string]interface{}{"touser": openIDs})
+}
+
+// PreviewMass sends the broadcast to a single user for testing
+func PreviewMass(ctx context.Context, token *BaseAccessToken, openID string, m *MassMessage) error {
+	_, err := sendMass(ctx, token, "preview", m, map[string]interface{}{"touser": openID})
+	return err
+}
+
+// DeleteMass deletes a sent broadcast, an article index of 0 deletes the whole news
+func DeleteMass(ctx context.Context, token *BaseAccessToken, msgID int64, articleIdx int) error {
+	url := fmt.Sprintf("%s/cgi-bin/message/mass/delete?access_token=%s", apiUrl(), token.Token)
+	body := map[string]interface{}{
+		"msg_id":      msgID,
+		"article_idx": articleIdx,
+	}
+	return apiPost(ctx, url, body, nil)
+}
+
+// GetMassStatus returns the status of a broadcast, e.g. SEND_SUCCESS, SENDING, SEND_FAIL or DELETE
+func GetMassStatus(ctx context.Context, token *BaseAccessToken, msgID int64) (string, error) {
+	url := fmt.Sprintf("%s/cgi-bin/message/mass/get?access_token=%s", apiUrl(), token.Token)
+	result := new(struct {
+		MsgStatus string `json:"msg_status"`
+	})
+	err := apiPost(ctx, url, map[string]int64{"msg_id": msgID}, result)
+	if err != nil {
+		return "", err
+	}
+	return result.MsgStatus, nil
+}
+
+func sendMass(ctx context.Context, token *BaseAccessToken, action string, m *MassMessage, target map[string]interface{}) (*MassResult, error) {
+	err := m.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/cgi-bin/message/mass/%s?access_token=%s", apiUrl(), action, token.Token)
+	result := new(MassResult)
+	err = apiPost(ctx, url, m.body(target), result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
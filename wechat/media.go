@@ -0,0 +1,437 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type MediaType string
+
+const (
+	MediaImage MediaType = "image"
+	MediaVoice MediaType = "voice"
+	MediaVideo MediaType = "video"
+	MediaThumb MediaType = "thumb"
+	MediaNews  MediaType = "news"
+
+	// media uploaded by UploadTempMedia is kept by wechat for 3 days
+	TempMediaLifeTimeSeconds = 3 * 24 * 60 * 60
+)
+
+var (
+	ErrMediaTooLarge = errors.New("media exceeds the size limit")
+
+	// limits of temporary media
+	tempMediaLimits = map[MediaType]mediaLimit{
+		MediaImage: {10 << 20, []string{".png", ".jpeg", ".jpg", ".gif"}},
+		MediaVoice: {2 << 20, []string{".amr", ".mp3"}},
+		MediaVideo: {10 << 20, []string{".mp4"}},
+		MediaThumb: {64 << 10, []string{".jpg"}},
+	}
+
+	// limits of permanent materials
+	materialLimits = map[MediaType]mediaLimit{
+		MediaImage: {10 << 20, []string{".bmp", ".png", ".jpeg", ".jpg", ".gif"}},
+		MediaVoice: {2 << 20, []string{".mp3", ".wma", ".wav", ".amr"}},
+		MediaVideo: {10 << 20, []string{".mp4"}},
+		MediaThumb: {64 << 10, []string{".jpg"}},
+	}
+
+	// limit of images used in the content of news articles
+	articleImageLimit = mediaLimit{1 << 20, []string{".jpg", ".png"}}
+)
+
+type mediaLimit struct {
+	maxSize    int64
+	extensions []string
+}
+
+func (this *mediaLimit) validate(t MediaType, filename string, size int64) error {
+	ext := strings.ToLower(filepath.Ext(filename))
+	supported := false
+	for _, e := range this.extensions {
+		if e == ext {
+			supported = true
+			break
+		}
+	}
+
+	if !supported {
+		return fmt.Errorf("%s media '%s' must be one of %s", t, filename, strings.Join(this.extensions, ", "))
+	}
+
+	if size > this.maxSize {
+		return fmt.Errorf("%s media '%s' has %d bytes, exceeds the limit of %d bytes", t, filename, size, this.maxSize)
+	}
+	return nil
+}
+
+// reader returns a reader which fails if the media turns out to be larger than the limit
+func (this *mediaLimit) reader(r io.Reader) io.Reader {
+	return &limitedReader{r: r, n: this.maxSize}
+}
+
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (this *limitedReader) Read(p []byte) (int, error) {
+	n, err := this.r.Read(p)
+	this.n -= int64(n)
+	if this.n < 0 {
+		return n, ErrMediaTooLarge
+	}
+	return n, err
+}
+
+type TempMedia struct {
+	Type         MediaType `json:"type"`
+	MediaID      string    `json:"media_id"`
+	ThumbMediaID string    `json:"thumb_media_id"`
+	CreatedAt    int64     `json:"created_at"`
+}
+
+type Material struct {
+	MediaID string `json:"media_id"`
+	Url     string `json:"url"`
+}
+
+type VideoDescription struct {
+	Title        string `json:"title"`
+	Introduction string `json:"introduction"`
+}
+
+type VideoMaterial struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	DownUrl     string `json:"down_url"`
+}
+
+type Article struct {
+	Title              string `json:"title"`
+	ThumbMediaID       string `json:"thumb_media_id"`
+	Author             string `json:"author,omitempty"`
+	Digest             string `json:"digest,omitempty"`
+	ShowCoverPic       int    `json:"show_cover_pic"`
+	Content            string `json:"content"`
+	ContentSourceUrl   string `json:"content_source_url,omitempty"`
+	NeedOpenComment    int    `json:"need_open_comment,omitempty"`
+	OnlyFansCanComment int    `json:"only_fans_can_comment,omitempty"`
+	Url                string `json:"url,omitempty"`
+	ThumbUrl           string `json:"thumb_url,omitempty"`
+}
+
+// MediaContent is a downloaded media, Body is nil if the media is a video or news,
+// which are described by the corresponding fields instead
+type MediaContent struct {
+	ContentType string
+	FileName    string
+	Size        int64
+	Body        io.ReadCloser
+	VideoUrl    string
+	Video       *VideoMaterial
+	News        []Article
+}
+
+type MaterialCount struct {
+	VoiceCount int `json:"voice_count"`
+	VideoCount int `json:"video_count"`
+	ImageCount int `json:"image_count"`
+	NewsCount  int `json:"news_count"`
+}
+
+type MaterialItem struct {
+	MediaID    string `json:"media_id"`
+	Name       string `json:"name"`
+	UpdateTime int64  `json:"update_time"`
+	Url        string `json:"url"`
+	Content    struct {
+		NewsItem []Article `json:"news_item"`
+	} `json:"content"`
+}
+
+type MaterialList struct {
+	TotalCount int            `json:"total_count"`
+	ItemCount  int            `json:"item_count"`
+	Items      []MaterialItem `json:"item"`
+}
+
+// UploadTempMedia uploads a media which is kept by wechat for 3 days
+func UploadTempMedia(ctx context.Context, token *BaseAccessToken, t MediaType, filename string, r io.Reader, size int64) (*TempMedia, error) {
+	limit, ok := tempMediaLimits[t]
+	if !ok {
+		return nil, fmt.Errorf("unsupported temporary media type: %s", t)
+	}
+
+	err := limit.validate(t, filename, size)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/cgi-bin/media/upload?access_token=%s&type=%s", apiUrl(), token.Token, t)
+	media := new(TempMedia)
+	err = apiUpload(ctx, url, filename, limit.reader(r), nil, media)
+	if err != nil {
+		return nil, err
+	}
+	return media, nil
+}
+
+func UploadTempMediaFile(ctx context.Context, token *BaseAccessToken, t MediaType, path string) (*TempMedia, error) {
+	f, size, err := openMediaFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return UploadTempMedia(ctx, token, t, filepath.Base(path), f, size)
+}
+
+// GetTempMedia downloads a temporary media, the caller is responsible for closing the body.
+// Videos are not downloaded, VideoUrl is set instead
+func GetTempMedia(ctx context.Context, token *BaseAccessToken, mediaID string) (*MediaContent, error) {
+	url := fmt.Sprintf("%s/cgi-bin/media/get?access_token=%s&media_id=%s", apiUrl(), token.Token, mediaID)
+	resp, err := apiDownload(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if isJsonResponse(resp) {
+		defer resp.Body.Close()
+		result := new(struct {
+			VideoUrl string `json:"video_url"`
+		})
+		err = decodeJsonMedia(resp, result)
+		if err != nil {
+			return nil, err
+		}
+
+		content := new(MediaContent)
+		content.ContentType = resp.Header.Get("Content-Type")
+		content.VideoUrl = result.VideoUrl
+		return content, nil
+	}
+
+	return newMediaContent(resp), nil
+}
+
+// GetHDVoice downloads the high definition version of a voice media in speex format,
+// the caller is responsible for closing the body
+func GetHDVoice(ctx context.Context, token *BaseAccessToken, mediaID string) (*MediaContent, error) {
+	url := fmt.Sprintf("%s/cgi-bin/media/get/jssdk?access_token=%s&media_id=%s", apiUrl(), token.Token, mediaID)
+	resp, err := apiDownload(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if isJsonResponse(resp) {
+		defer resp.Body.Close()
+		err = decodeJsonMedia(resp, nil)
+		if err == nil {
+			err = fmt.Errorf("unexpected json response for voice media '%s'", mediaID)
+		}
+		return nil, err
+	}
+
+	return newMediaContent(resp), nil
+}
+
+// AddMaterial uploads a permanent material, the description is required for videos
+func AddMaterial(ctx context.Context, token *BaseAccessToken, t MediaType, filename string, r io.Reader, size int64, video *VideoDescription) (*Material, error) {
+	limit, ok := materialLimits[t]
+	if !ok {
+		return nil, fmt.Errorf("unsupported material type: %s", t)
+	}
+
+	err := limit.validate(t, filename, size)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]string
+	if t == MediaVideo {
+		if video == nil {
+			return nil, errors.New("video material requires a description")
+		}
+
+		b, err := json.Marshal(video)
+		if err != nil {
+			return nil, err
+		}
+		fields = map[string]string{"description": string(b)}
+	}
+
+	url := fmt.Sprintf("%s/cgi-bin/material/add_material?access_token=%s&type=%s", apiUrl(), token.Token, t)
+	material := new(Material)
+	err = apiUpload(ctx, url, filename, limit.reader(r), fields, material)
+	if err != nil {
+		return nil, err
+	}
+	return material, nil
+}
+
+func AddMaterialFile(ctx context.Context, token *BaseAccessToken, t MediaType, path string, video *VideoDescription) (*Material, error) {
+	f, size, err := openMediaFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return AddMaterial(ctx, token, t, filepath.Base(path), f, size, video)
+}
+
+// GetMaterial downloads a permanent material, the caller is responsible for closing the body.
+// News and videos are returned in the News and Video fields instead of the body
+func GetMaterial(ctx context.Context, token *BaseAccessToken, mediaID string) (*MediaContent, error) {
+	url := fmt.Sprintf("%s/cgi-bin/material/get_material?access_token=%s", apiUrl(), token.Token)
+	resp, err := apiDownload(ctx, url, map[string]string{"media_id": mediaID})
+	if err != nil {
+		return nil, err
+	}
+
+	if isJsonResponse(resp) {
+		defer resp.Body.Close()
+		result := new(struct {
+			NewsItem []Article `json:"news_item"`
+			VideoMaterial
+		})
+		err = decodeJsonMedia(resp, result)
+		if err != nil {
+			return nil, err
+		}
+
+		content := new(MediaContent)
+		content.ContentType = resp.Header.Get("Content-Type")
+		if result.NewsItem != nil {
+			content.News = result.NewsItem
+		} else {
+			content.Video = &result.VideoMaterial
+		}
+		return content, nil
+	}
+
+	return newMediaContent(resp), nil
+}
+
+func DeleteMaterial(ctx context.Context, token *BaseAccessToken, mediaID string) error {
+	url := fmt.Sprintf("%s/cgi-bin/material/del_material?access_token=%s", apiUrl(), token.Token)
+	return apiPost(ctx, url, map[string]string{"media_id": mediaID}, nil)
+}
+
+func GetMaterialCount(ctx context.Context, token *BaseAccessToken) (*MaterialCount, error) {
+	url := fmt.Sprintf("%s/cgi-bin/material/get_materialcount?access_token=%s", apiUrl(), token.Token)
+	count := new(MaterialCount)
+	err := apiGet(ctx, url, count)
+	if err != nil {
+		return nil, err
+	}
+	return count, nil
+}
+
+// BatchGetMaterial lists the permanent materials of the type, count must be between 1 and 20
+func BatchGetMaterial(ctx context.Context, token *BaseAccessToken, t MediaType, offset, count int) (*MaterialList, error) {
+	if count < 1 || count > 20 {
+		return nil, fmt.Errorf("invalid material count: %d", count)
+	}
+
+	url := fmt.Sprintf("%s/cgi-bin/material/batchget_material?access_token=%s", apiUrl(), token.Token)
+	body := map[string]interface{}{
+		"type":   t,
+		"offset": offset,
+		"count":  count,
+	}
+
+	list := new(MaterialList)
+	err := apiPost(ctx, url, body, list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// AddNews adds a permanent news material of up to 8 articles, returns its media id
+func AddNews(ctx context.Context, token *BaseAccessToken, articles []Article) (string, error) {
+	if len(articles) == 0 || len(articles) > 8 {
+		return "", fmt.Errorf("invalid number of articles: %d", len(articles))
+	}
+
+	url := fmt.Sprintf("%s/cgi-bin/material/add_news?access_token=%s", apiUrl(), token.Token)
+	material := new(Material)
+	err := apiPost(ctx, url, map[string]interface{}{"articles": articles}, material)
+	if err != nil {
+		return "", err
+	}
+	return material.MediaID, nil
+}
+
+// UpdateNews replaces the article at the index of a news material
+func UpdateNews(ctx context.Context, token *BaseAccessToken, mediaID string, index int, article *Article) error {
+	url := fmt.Sprintf("%s/cgi-bin/material/update_news?access_token=%s", apiUrl(), token.Token)
+	body := map[string]interface{}{
+		"media_id": mediaID,
+		"index":    index,
+		"articles": article,
+	}
+	return apiPost(ctx, url, body, nil)
+}
+
+// UploadArticleImage uploads an image used in the content of articles, returns its url
+func UploadArticleImage(ctx context.Context, token *BaseAccessToken, filename string, r io.Reader, size int64) (string, error) {
+	err := articleImageLimit.validate(MediaImage, filename, size)
+	if err != nil {
+		return "", err
+	}
+
+	url := fmt.Sprintf("%s/cgi-bin/media/uploadimg?access_token=%s", apiUrl(), token.Token)
+	material := new(Material)
+	err = apiUpload(ctx, url, filename, articleImageLimit.reader(r), nil, material)
+	if err != nil {
+		return "", err
+	}
+	return material.Url, nil
+}
+
+func openMediaFile(path string) (*os.File, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func decodeJsonMedia(resp *http.Response, v interface{}) error {
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(b, v)
+}
+
+func newMediaContent(resp *http.Response) *MediaContent {
+	content := new(MediaContent)
+	content.ContentType = resp.Header.Get("Content-Type")
+	content.Size = resp.ContentLength
+	content.Body = resp.Body
+
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err == nil {
+		content.FileName = params["filename"]
+	}
+	return content
+}
@@ -5,14 +5,19 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"strings"
+	"time"
 )
 
 const (
-	textResponseTemplate = "<xml><ToUserName><![CDATA[%s]]></ToUserName><FromUserName><![CDATA[%s]]></FromUserName><CreateTime>%d</CreateTime><MsgType><![CDATA[text]]></MsgType><Content><![CDATA[%s]]></Content></xml>"
+	textResponseTemplate     = "<xml><ToUserName><![CDATA[%s]]></ToUserName><FromUserName><![CDATA[%s]]></FromUserName><CreateTime>%d</CreateTime><MsgType><![CDATA[text]]></MsgType><Content><![CDATA[%s]]></Content></xml>"
+	transferResponseTemplate = "<xml><ToUserName><![CDATA[%s]]></ToUserName><FromUserName><![CDATA[%s]]></FromUserName><CreateTime>%d</CreateTime><MsgType><![CDATA[transfer_customer_service]]></MsgType>%s</xml>"
+	transferInfoTemplate     = "<TransInfo><KfAccount><![CDATA[%s]]></KfAccount></TransInfo>"
 )
 
 var (
 	messageFactory = make(map[string]func() UserMessage)
+	eventFactory   = make(map[string]func() UserMessage)
 )
 
 func init() {
@@ -43,13 +48,40 @@ func init() {
 	messageFactory["event"] = func() UserMessage {
 		return new(BaseEvent)
 	}
+
+	eventFactory["subscribe"] = func() UserMessage {
+		return new(SceneEvent)
+	}
+
+	eventFactory["SCAN"] = func() UserMessage {
+		return new(SceneEvent)
+	}
+
+	eventFactory["MASSSENDJOBFINISH"] = func() UserMessage {
+		return new(MassSendJobFinishEvent)
+	}
+
+	eventFactory["kf_create_session"] = func() UserMessage {
+		return new(KfSessionEvent)
+	}
+
+	eventFactory["kf_close_session"] = func() UserMessage {
+		return new(KfSessionEvent)
+	}
+
+	eventFactory["kf_switch_session"] = func() UserMessage {
+		return new(KfSessionEvent)
+	}
 }
 
 type UserMessage interface {
 	MessageType() string
 	To() string
 	From() string
+	MessageID() int64
+	Time() int64
 	ReplyText(c *gin.Context, content string)
+	ReplyTransferCustomerService(c *gin.Context, kfAccount string)
 }
 
 type UserEvent interface {
@@ -77,11 +109,32 @@ func (this *BaseMessage) From() string {
 	return this.FromUserName
 }
 
+// MessageID returns the id of the message, the events don't have one
+func (this *BaseMessage) MessageID() int64 {
+	return this.MsgId
+}
+
+// Time returns when the message was sent as a unix timestamp
+func (this *BaseMessage) Time() int64 {
+	return this.CreateTime
+}
+
 func (this *BaseMessage) ReplyText(c *gin.Context, content string) {
 	text := fmt.Sprintf(textResponseTemplate, this.FromUserName, this.ToUserName, 0, content)
 	c.String(http.StatusOK, text)
 }
 
+// ReplyTransferCustomerService transfers the message to the customer service, either to the given account
+// or to any online account if it's empty
+func (this *BaseMessage) ReplyTransferCustomerService(c *gin.Context, kfAccount string) {
+	info := ""
+	if len(kfAccount) > 0 {
+		info = fmt.Sprintf(transferInfoTemplate, kfAccount)
+	}
+	text := fmt.Sprintf(transferResponseTemplate, this.FromUserName, this.ToUserName, time.Now().Unix(), info)
+	c.String(http.StatusOK, text)
+}
+
 type UserTextMessage struct {
 	BaseMessage
 	Content string
@@ -101,7 +154,7 @@ type UserVoiceMessage struct {
 
 type UserVideoMessage struct {
 	BaseMessage
-	MediaID      string
+	MediaID      string `xml:"MediaId"`
 	ThumbMediaId string
 }
 
@@ -121,14 +174,60 @@ func (this *BaseEvent) EventType() string {
 	return this.Event
 }
 
+// SceneEvent is sent when a user scans a parametric qr code, either to follow the official account (subscribe)
+// or as an existing follower (SCAN). A subscribe event not triggered by a qr code has an empty scene
+type SceneEvent struct {
+	BaseEvent
+	EventKey string
+	Ticket   string
+}
+
+// Scene returns the scene the qr code was created with
+func (this *SceneEvent) Scene() string {
+	// the event key of a subscribe event is prefixed with 'qrscene_'
+	return strings.TrimPrefix(this.EventKey, "qrscene_")
+}
+
+// MassSendJobFinishEvent is sent when a broadcast finishes, the counts are the number of followers targeted,
+// the number after filtering, and the number of successful and failed sends
+type MassSendJobFinishEvent struct {
+	BaseEvent
+	MsgID       int64 `xml:"MsgID"`
+	Status      string
+	TotalCount  int
+	FilterCount int
+	SentCount   int
+	ErrorCount  int
+}
+
+// KfSessionEvent is sent when a customer service session is created (kf_create_session), closed (kf_close_session)
+// or switched to another account (kf_switch_session)
+type KfSessionEvent struct {
+	BaseEvent
+	KfAccount     string
+	FromKfAccount string
+	ToKfAccount   string
+}
+
+// Account returns the customer service account the follower is talking to after the event
+func (this *KfSessionEvent) Account() string {
+	if this.Event == "kf_switch_session" {
+		return this.ToKfAccount
+	}
+	return this.KfAccount
+}
+
 func LoadUserMessage(content []byte) (UserMessage, error) {
-	var base BaseMessage
+	var base BaseEvent
 	err := xml.Unmarshal(content, &base)
 	if err != nil {
 		return nil, err
 	}
 
 	factory := messageFactory[base.MsgType]
+	if base.MsgType == "event" && eventFactory[base.Event] != nil {
+		factory = eventFactory[base.Event]
+	}
 	if factory == nil {
 		return nil, fmt.Errorf("Unknown message type: %s", base.MsgType)
 	}
@@ -0,0 +1,146 @@
+package wechat
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrInvalidWatermark = errors.New("watermark doesn't match the app id")
+)
+
+// MiniProgramSession is the result of code2Session, the session key is used to decrypt the data
+// from the mini-program and should never be sent to the client
+type MiniProgramSession struct {
+	OpenID     string `json:"openid"`
+	SessionKey string `json:"session_key"`
+	UnionID    string `json:"unionid"`
+}
+
+// Watermark is attached to the encrypted data to tell which app it was encrypted for
+type Watermark struct {
+	AppID     string `json:"appid"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// MiniProgramUserInfo is the decrypted user info from wx.getUserInfo
+type MiniProgramUserInfo struct {
+	OpenID    string    `json:"openId"`
+	NickName  string    `json:"nickName"`
+	Gender    int       `json:"gender"`
+	City      string    `json:"city"`
+	Province  string    `json:"province"`
+	Country   string    `json:"country"`
+	Language  string    `json:"language"`
+	AvatarUrl string    `json:"avatarUrl"`
+	UnionID   string    `json:"unionId"`
+	Watermark Watermark `json:"watermark"`
+}
+
+// UserInfo converts the user info into the same form as the other logins
+func (this *MiniProgramUserInfo) UserInfo() *UserInfo {
+	u := new(UserInfo)
+	u.OpenID = this.OpenID
+	u.NickName = this.NickName
+	u.Gender = this.Gender
+	u.City = this.City
+	u.Province = this.Province
+	u.Country = this.Country
+	u.Language = this.Language
+	u.IconUrl = this.AvatarUrl
+	u.UnionID = this.UnionID
+	return u
+}
+
+// PhoneNumber is the decrypted phone number from getPhoneNumber
+type PhoneNumber struct {
+	PhoneNumber     string    `json:"phoneNumber"`
+	PurePhoneNumber string    `json:"purePhoneNumber"`
+	CountryCode     string    `json:"countryCode"`
+	Watermark       Watermark `json:"watermark"`
+}
+
+// Code2Session exchanges the code from wx.login for the session of the user
+func Code2Session(ctx context.Context, appID, appSecret, code string) (*MiniProgramSession, error) {
+	url := fmt.Sprintf("%s/sns/jscode2session?appid=%s&secret=%s&js_code=%s&grant_type=authorization_code",
+		apiUrl(), appID, appSecret, code)
+	session := new(MiniProgramSession)
+	err := apiGet(ctx, url, session)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(session.OpenID) == 0 || len(session.SessionKey) == 0 {
+		return nil, errors.New("no session returned for the code")
+	}
+	return session, nil
+}
+
+// CheckRawDataSignature verifies the raw data from wx.getUserInfo, which is signed with sha1(rawData + sessionKey)
+func CheckRawDataSignature(rawData, sessionKey, signature string) bool {
+	sum := sha1.Sum([]byte(rawData + sessionKey))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(signature)) == 1
+}
+
+// DecryptUserInfo decrypts the user info from wx.getUserInfo
+func DecryptUserInfo(appID, sessionKey, encryptedData, iv string) (*MiniProgramUserInfo, error) {
+	u := new(MiniProgramUserInfo)
+	err := decryptMiniProgramData(sessionKey, encryptedData, iv, u)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Watermark.AppID != appID {
+		return nil, ErrInvalidWatermark
+	}
+	return u, nil
+}
+
+// DecryptPhoneNumber decrypts the phone number from getPhoneNumber
+func DecryptPhoneNumber(appID, sessionKey, encryptedData, iv string) (*PhoneNumber, error) {
+	p := new(PhoneNumber)
+	err := decryptMiniProgramData(sessionKey, encryptedData, iv, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Watermark.AppID != appID {
+		return nil, ErrInvalidWatermark
+	}
+	return p, nil
+}
+
+// decryptMiniProgramData decrypts the data with AES-128-CBC, the key, data and iv are all base64 encoded
+func decryptMiniProgramData(sessionKey, encryptedData, iv string, v interface{}) error {
+	key, err := base64.StdEncoding.DecodeString(sessionKey)
+	if err != nil {
+		return fmt.Errorf("invalid session key: %s", err)
+	}
+
+	if len(key) != 16 {
+		return errors.New("invalid session key size")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encryptedData)
+	if err != nil {
+		return fmt.Errorf("invalid encrypted data: %s", err)
+	}
+
+	ivBytes, err := base64.StdEncoding.DecodeString(iv)
+	if err != nil {
+		return fmt.Errorf("invalid iv: %s", err)
+	}
+
+	b, err := aesDecrypt(key, ivBytes, data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -3,37 +3,26 @@ package wechat
 import (
 	"crypto/sha1"
 	"encoding/hex"
-	"fmt"
 	"sort"
 	"strings"
 )
 
-type WeChatError struct {
-	Code    int    `json:"errcode"`
-	Message string `json:"errmsg"`
-}
-
-func (this *WeChatError) Error() string {
-	return fmt.Sprintf("Code: %d, Message: %s", this.Code, this.Message)
+func ValidateLogin(timestamp, nonce, appToken, signature string) bool {
+	return SignLogin(timestamp, nonce, appToken) == signature
 }
 
-func NewError(code int, message string) *WeChatError {
-	err := new(WeChatError)
-	err.Code = code
-	err.Message = message
-	return err
+// SignLogin returns the signature wechat sends along with the requests to the server
+func SignLogin(timestamp, nonce, appToken string) string {
+	return sign(timestamp, nonce, appToken)
 }
 
-func ValidateLogin(timestamp, nonce, appToken, signature string) bool {
-	a := []string{
-		timestamp,
-		nonce,
-		appToken,
-	}
+// sign returns the sha1 of the sorted and concatenated parts
+func sign(parts ...string) string {
+	a := make([]string, len(parts))
+	copy(a, parts)
 	sort.Strings(a)
 	combined := strings.Join(a, "")
 
 	hash := sha1.Sum([]byte(combined))
-	h := hex.EncodeToString(hash[:])
-	return h == signature
+	return hex.EncodeToString(hash[:])
 }
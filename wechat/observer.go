@@ -0,0 +1,35 @@
+package wechat
+
+import (
+	"time"
+)
+
+// the tokens reported by ObserveTokenRefresh
+const (
+	AccessTokenRefresh    = "access_token"
+	JSAPITicketRefresh    = "jsapi_ticket"
+	WebAccessTokenRefresh = "web_access_token"
+)
+
+// Observer is notified of the messages handled by the server and the api calls, e.g. to collect metrics.
+// The methods are called synchronously, so they should return quickly
+type Observer interface {
+	// ObserveMessage is called after the handler returns, the event is empty if the message isn't an event
+	ObserveMessage(msgType, event string, duration time.Duration)
+
+	// ObserveSignatureFailure is called when a request fails the signature check, and thus isn't from wechat
+	ObserveSignatureFailure()
+
+	// ObserveApiCall is called after every attempt of an api call by its path, e.g. /cgi-bin/token,
+	// the error is a *WeChatError if the response carries a non-zero errcode
+	ObserveApiCall(api string, duration time.Duration, err error)
+
+	// ObserveTokenRefresh is called when a new token is obtained, e.g. AccessTokenRefresh
+	ObserveTokenRefresh(token string)
+}
+
+func observeTokenRefresh(token string) {
+	if o := DefaultClient.Observer; o != nil {
+		o.ObserveTokenRefresh(token)
+	}
+}
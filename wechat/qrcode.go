@@ -0,0 +1,85 @@
+package wechat
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+)
+
+const (
+	// temporary qr codes live for at most 30 days
+	QRCodeMaxExpireSeconds = 30 * 24 * 60 * 60
+
+	// the max scene id allowed for permanent qr codes
+	QRCodeMaxPermanentSceneID = 100000
+
+	QRCodeMaxSceneLength = 64
+
+	qrcodeShowUrl = "https://mp.weixin.qq.com/cgi-bin/showqrcode"
+)
+
+type QRCodeTicket struct {
+	Ticket        string `json:"ticket"`
+	ExpireSeconds int    `json:"expire_seconds"`
+	Url           string `json:"url"`
+}
+
+type qrcodeScene struct {
+	SceneID  int    `json:"scene_id,omitempty"`
+	SceneStr string `json:"scene_str,omitempty"`
+}
+
+type qrcodeRequest struct {
+	ExpireSeconds int    `json:"expire_seconds,omitempty"`
+	ActionName    string `json:"action_name"`
+	ActionInfo    struct {
+		Scene qrcodeScene `json:"scene"`
+	} `json:"action_info"`
+}
+
+// CreateTempQRCode creates a qr code carrying the scene which expires after the given seconds,
+// scanning it sends a subscribe or SCAN event with the scene to the server
+func CreateTempQRCode(ctx context.Context, token *BaseAccessToken, scene string, expireSeconds int) (*QRCodeTicket, error) {
+	if expireSeconds <= 0 || expireSeconds > QRCodeMaxExpireSeconds {
+		return nil, fmt.Errorf("invalid qr code expire seconds: %d", expireSeconds)
+	}
+	return createQRCode(ctx, token, scene, expireSeconds, "QR_SCENE", "QR_STR_SCENE", math.MaxInt32)
+}
+
+// CreatePermanentQRCode creates a qr code carrying the scene which never expires,
+// note that the number of permanent qr codes is limited
+func CreatePermanentQRCode(ctx context.Context, token *BaseAccessToken, scene string) (*QRCodeTicket, error) {
+	return createQRCode(ctx, token, scene, 0, "QR_LIMIT_SCENE", "QR_LIMIT_STR_SCENE", QRCodeMaxPermanentSceneID)
+}
+
+// QRCodeImageUrl returns the url of the qr code image hosted by wechat
+func QRCodeImageUrl(ticket string) string {
+	return fmt.Sprintf("%s?ticket=%s", qrcodeShowUrl, url.QueryEscape(ticket))
+}
+
+// scenes which are positive integers are sent as scene ids, other scenes are sent as strings
+func createQRCode(ctx context.Context, token *BaseAccessToken, scene string, expireSeconds int, idAction, strAction string, maxSceneID int) (*QRCodeTicket, error) {
+	if len(scene) == 0 || len(scene) > QRCodeMaxSceneLength {
+		return nil, fmt.Errorf("invalid qr code scene: '%s'", scene)
+	}
+
+	req := new(qrcodeRequest)
+	req.ExpireSeconds = expireSeconds
+	if id, err := strconv.Atoi(scene); err == nil && id > 0 && id <= maxSceneID {
+		req.ActionName = idAction
+		req.ActionInfo.Scene.SceneID = id
+	} else {
+		req.ActionName = strAction
+		req.ActionInfo.Scene.SceneStr = scene
+	}
+
+	url := fmt.Sprintf("%s/cgi-bin/qrcode/create?access_token=%s", apiUrl(), token.Token)
+	ticket := new(QRCodeTicket)
+	err := apiPost(ctx, url, req, ticket)
+	if err != nil {
+		return nil, err
+	}
+	return ticket, nil
+}
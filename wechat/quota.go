@@ -0,0 +1,171 @@
+package wechat
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// DefaultQuotas are the daily quotas of the apis of an official account by their paths,
+// the actual quotas of the account are shown in the admin console and can be raised after verification
+var DefaultQuotas = map[string]int64{
+	"/cgi-bin/token":                 2000,
+	"/cgi-bin/ticket/getticket":      100000,
+	"/cgi-bin/user/info":             5000000,
+	"/cgi-bin/user/info/batchget":    5000000,
+	"/cgi-bin/user/get":              1000,
+	"/cgi-bin/qrcode/create":         100000,
+	"/cgi-bin/media/upload":          100000,
+	"/cgi-bin/media/get":             200000,
+	"/cgi-bin/message/custom/send":   500000,
+	"/cgi-bin/message/template/send": 100000,
+	"/cgi-bin/message/mass/sendall":  100,
+	"/cgi-bin/message/mass/send":     100,
+	"/cgi-bin/message/mass/preview":  100,
+	"/cgi-bin/menu/create":           1000,
+	"/cgi-bin/menu/get":              10000,
+	"/sns/oauth2/access_token":       5000000,
+	"/sns/oauth2/refresh_token":      5000000,
+	"/sns/userinfo":                  5000000,
+}
+
+var (
+	// a warning is logged when the calls of an api reach these fractions of its daily quota
+	DefaultQuotaWarnings = []float64{0.8, 0.9, 0.95}
+
+	// the quotas are reset at midnight in beijing time
+	quotaLocation = time.FixedZone("CST", 8*60*60)
+)
+
+// QuotaStore keeps the number of calls of each api by day, so that the replicas share the same counters
+type QuotaStore interface {
+	// IncrCalls adds a call of the api on the day and returns the number of calls so far
+	IncrCalls(api, day string) (int64, error)
+	Calls(api, day string) (int64, error)
+	ResetCalls(api, day string) error
+}
+
+// QuotaUsage is the number of calls of an api today against its daily quota
+type QuotaUsage struct {
+	Api     string  `json:"api"`
+	Calls   int64   `json:"calls"`
+	Quota   int64   `json:"quota"`
+	Percent float64 `json:"percent"`
+}
+
+// QuotaTracker counts the calls of the apis with a quota, and warns as the calls approach the quota
+type QuotaTracker struct {
+	Store    QuotaStore
+	Quotas   map[string]int64
+	Warnings []float64
+	Logger   Logger
+}
+
+func NewQuotaTracker(store QuotaStore, logger Logger) *QuotaTracker {
+	t := new(QuotaTracker)
+	t.Store = store
+	t.Quotas = make(map[string]int64)
+	for api, quota := range DefaultQuotas {
+		t.Quotas[api] = quota
+	}
+	t.Warnings = DefaultQuotaWarnings
+	t.Logger = logger
+	return t
+}
+
+// count adds a call of the api if it has a quota, every warning is only logged once a day
+// because the counter passes each number only once, even with multiple replicas
+func (this *QuotaTracker) count(api string) {
+	quota, ok := this.Quotas[api]
+	if !ok || quota <= 0 {
+		return
+	}
+
+	calls, err := this.Store.IncrCalls(api, quotaDay(time.Now()))
+	if err != nil {
+		this.logf(Error, "failed to count the call of %s: %s", api, err)
+		return
+	}
+
+	if calls == quota {
+		this.logf(Error, "%s has used up its daily quota of %d calls", api, quota)
+	}
+
+	// with a small quota a warning may round up to the quota itself, it's still logged along with the error above
+	for _, w := range this.Warnings {
+		if calls == int64(math.Ceil(w*float64(quota))) {
+			this.logf(Warning, "%s has used %d of its daily quota of %d calls (%.0f%%)", api, calls, quota, w*100)
+		}
+	}
+}
+
+// Usage returns the calls of today of all the apis with a quota, sorted by the api path
+func (this *QuotaTracker) Usage() ([]*QuotaUsage, error) {
+	day := quotaDay(time.Now())
+	apis := make([]string, 0, len(this.Quotas))
+	for api := range this.Quotas {
+		apis = append(apis, api)
+	}
+	sort.Strings(apis)
+
+	usage := make([]*QuotaUsage, 0, len(apis))
+	for _, api := range apis {
+		calls, err := this.Store.Calls(api, day)
+		if err != nil {
+			return nil, err
+		}
+
+		u := new(QuotaUsage)
+		u.Api = api
+		u.Calls = calls
+		u.Quota = this.Quotas[api]
+		if u.Quota > 0 {
+			u.Percent = math.Round(float64(calls)*10000/float64(u.Quota)) / 100
+		}
+		usage = append(usage, u)
+	}
+	return usage, nil
+}
+
+// Reset sets the calls of today back to zero, which should follow ClearQuota
+func (this *QuotaTracker) Reset() error {
+	day := quotaDay(time.Now())
+	for api := range this.Quotas {
+		err := this.Store.ResetCalls(api, day)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *QuotaTracker) logf(t LogType, format string, v ...interface{}) {
+	if this.Logger != nil {
+		this.Logger.Logf(t, format, v...)
+	}
+}
+
+func quotaDay(t time.Time) string {
+	return t.In(quotaLocation).Format("20060102")
+}
+
+// apiPath returns the path of the api url which identifies the api in the quotas and limiters
+func apiPath(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl
+	}
+	return u.Path
+}
+
+// ClearQuota resets the daily quotas of all the apis of the app, which can only be done 10 times a month
+func ClearQuota(ctx context.Context, token *BaseAccessToken, appID string) error {
+	url := fmt.Sprintf("%s/cgi-bin/clear_quota?access_token=%s", apiUrl(), token.Token)
+	body := map[string]string{
+		"appid": appID,
+	}
+	return apiPost(ctx, url, body, nil)
+}
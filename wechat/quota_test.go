@@ -0,0 +1,122 @@
+package wechat
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+type memQuotaStore struct {
+	m     sync.Mutex
+	calls map[string]int64
+}
+
+func (this *memQuotaStore) IncrCalls(api, day string) (int64, error) {
+	this.m.Lock()
+	defer this.m.Unlock()
+	this.calls[api+"."+day]++
+	return this.calls[api+"."+day], nil
+}
+
+func (this *memQuotaStore) Calls(api, day string) (int64, error) {
+	this.m.Lock()
+	defer this.m.Unlock()
+	return this.calls[api+"."+day], nil
+}
+
+func (this *memQuotaStore) ResetCalls(api, day string) error {
+	this.m.Lock()
+	defer this.m.Unlock()
+	delete(this.calls, api+"."+day)
+	return nil
+}
+
+// quotaLogger keeps the texts logged at each level
+type quotaLogger struct {
+	logs map[LogType][]string
+}
+
+func (this *quotaLogger) Log(t LogType, text string) {
+	this.logs[t] = append(this.logs[t], text)
+}
+
+func (this *quotaLogger) Logf(t LogType, format string, v ...interface{}) {
+	this.Log(t, fmt.Sprintf(format, v...))
+}
+
+func newQuotaTest() (*QuotaTracker, *quotaLogger) {
+	logger := &quotaLogger{logs: make(map[LogType][]string)}
+	tracker := NewQuotaTracker(&memQuotaStore{calls: make(map[string]int64)}, logger)
+	tracker.Quotas = map[string]int64{
+		"/cgi-bin/menu/create": 10,
+		"/cgi-bin/menu/get":    100,
+	}
+	return tracker, logger
+}
+
+func TestQuotaWarnings(t *testing.T) {
+	tracker, logger := newQuotaTest()
+
+	// the warnings of the small quota are at 8, 9 and 10 calls, the last one is the quota itself
+	for i := 0; i < 15; i++ {
+		tracker.count("/cgi-bin/menu/create")
+	}
+	tracker.count("/cgi-bin/user/get")
+
+	expected := []string{
+		"/cgi-bin/menu/create has used 8 of its daily quota of 10 calls (80%)",
+		"/cgi-bin/menu/create has used 9 of its daily quota of 10 calls (90%)",
+		"/cgi-bin/menu/create has used 10 of its daily quota of 10 calls (95%)",
+	}
+	if warnings := logger.logs[Warning]; fmt.Sprint(warnings) != fmt.Sprint(expected) {
+		t.Errorf("got warnings %q, expected %q", warnings, expected)
+	}
+
+	if logged := logger.logs[Error]; len(logged) != 1 || logged[0] != "/cgi-bin/menu/create has used up its daily quota of 10 calls" {
+		t.Errorf("got errors %q, expected the quota to be used up once", logged)
+	}
+}
+
+func TestQuotaReset(t *testing.T) {
+	tracker, logger := newQuotaTest()
+	for i := 0; i < 9; i++ {
+		tracker.count("/cgi-bin/menu/create")
+		tracker.count("/cgi-bin/menu/get")
+	}
+
+	usage, err := tracker.Usage()
+	if err != nil {
+		t.Fatalf("failed to get the usage: %s", err)
+	}
+	if len(usage) != 2 {
+		t.Fatalf("got the usage of %d apis, expected 2", len(usage))
+	}
+	if usage[0].Api != "/cgi-bin/menu/create" || usage[0].Calls != 9 || usage[0].Percent != 90 ||
+		usage[1].Api != "/cgi-bin/menu/get" || usage[1].Calls != 9 || usage[1].Percent != 9 {
+		t.Errorf("unexpected usage: %+v, %+v", usage[0], usage[1])
+	}
+
+	err = tracker.Reset()
+	if err != nil {
+		t.Fatalf("failed to reset the calls: %s", err)
+	}
+
+	usage, err = tracker.Usage()
+	if err != nil {
+		t.Fatalf("failed to get the usage: %s", err)
+	}
+	for _, u := range usage {
+		if u.Calls != 0 || u.Percent != 0 {
+			t.Errorf("%s has %d calls after the reset", u.Api, u.Calls)
+		}
+	}
+
+	// the warnings are logged again as the calls count up from zero
+	logger.logs = make(map[LogType][]string)
+	for i := 0; i < 8; i++ {
+		tracker.count("/cgi-bin/menu/create")
+	}
+	if warnings := logger.logs[Warning]; len(warnings) != 1 {
+		t.Errorf("got warnings %q after the reset, expected the one at 80%%", warnings)
+	}
+}
@@ -0,0 +1,52 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"github.com/gin-gonic/gin"
+)
+
+// MessageRecorder keeps the conversations with the followers, e.g. in a database.
+// The methods are called synchronously, so they should return quickly
+type MessageRecorder interface {
+	// RecordMessage is called before the message is handled, raw is the xml of the message after decryption
+	RecordMessage(ctx context.Context, m UserMessage, raw []byte)
+
+	// RecordReply is called after the handler returns with the passive reply to the message,
+	// the empty reply and 'success' aren't recorded
+	RecordReply(ctx context.Context, m UserMessage, reply []byte)
+
+	// RecordCustomMessage is called after a customer service message is sent by SendCustomMessage
+	RecordCustomMessage(ctx context.Context, m *CustomMessage)
+}
+
+func recordCustomMessage(ctx context.Context, m *CustomMessage) {
+	if r := DefaultClient.Recorder; r != nil {
+		r.RecordCustomMessage(ctx, m)
+	}
+}
+
+// recordWriter keeps a copy of the reply written by the handler so it can be recorded,
+// it wraps the replyWriter in safe mode so the reply is recorded before encryption
+type recordWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (this *recordWriter) Write(data []byte) (int, error) {
+	this.body.Write(data)
+	return this.ResponseWriter.Write(data)
+}
+
+func (this *recordWriter) WriteString(s string) (int, error) {
+	this.body.WriteString(s)
+	return this.ResponseWriter.WriteString(s)
+}
+
+func (this *recordWriter) reply() []byte {
+	reply := this.body.Bytes()
+	if len(reply) == 0 || string(reply) == "success" {
+		return nil
+	}
+	return reply
+}
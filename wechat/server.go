@@ -1,18 +1,31 @@
 package wechat
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io/ioutil"
 	"net/http"
+	"time"
 )
 
 type Server struct {
-	appID     string
-	appSecret string
-	token     string
-	handler   ServerHandler
-	logger    Logger
+	appID            string
+	appSecret        string
+	token            string
+	websiteAppID     string
+	websiteAppSecret string
+	handler          ServerHandler
+	logger           Logger
+	grants           GrantStore
+	accessToken      accessTokenCache
+	jsapiTicket      jsapiTicketCache
+	crypter          *MessageCrypter
+	observer         Observer
+	recorder         MessageRecorder
 }
 
 type ServerHandler interface {
@@ -25,6 +38,20 @@ type ServerHandler interface {
 	HandleWebLogin(u *UserInfo, state string, c *gin.Context)
 }
 
+// WebLoginHandler can be implemented by a ServerHandler to be called with the login the callback belongs to,
+// i.e. OfficialAccountLogin or WebsiteLogin, and to handle the users who refuse to login.
+// Otherwise HandleWebLogin is called for both logins and the refusals are answered with "login denied".
+type WebLoginHandler interface {
+	HandleLogin(u *UserInfo, login, state string, c *gin.Context)
+	HandleLoginDenied(login, state string, c *gin.Context)
+}
+
+// the web logins handled by the server
+const (
+	OfficialAccountLogin = "official_account"
+	WebsiteLogin         = "website"
+)
+
 func (s *Server) SetHandler(h ServerHandler) {
 	s.handler = h
 }
@@ -33,6 +60,48 @@ func (s *Server) SetLogger(logger Logger) {
 	s.logger = logger
 }
 
+// SetWebsiteApp configures the open platform website app used by HandleWebsiteLogin,
+// which has its own app id and secret
+func (s *Server) SetWebsiteApp(appID, appSecret string) {
+	s.websiteAppID = appID
+	s.websiteAppSecret = appSecret
+}
+
+// SetObserver reports the messages and the signature failures to the observer,
+// the api calls are reported to the observer of the DefaultClient
+func (s *Server) SetObserver(o Observer) {
+	s.observer = o
+}
+
+// SetRecorder records the messages received by the server and the replies to them,
+// the customer service messages are recorded by the recorder of the DefaultClient
+func (s *Server) SetRecorder(r MessageRecorder) {
+	s.recorder = r
+}
+
+func (s *Server) SetGrantStore(store GrantStore) {
+	s.grants = store
+}
+
+// SetAccessTokenStore shares the access token with the other processes of the app through the store,
+// otherwise the token is kept by the server itself
+func (s *Server) SetAccessTokenStore(store AccessTokenStore) {
+	s.accessToken.m.Lock()
+	defer s.accessToken.m.Unlock()
+	s.accessToken.store = store
+}
+
+// SetEncodingAESKey enables the safe mode, the messages with encrypt_type=aes are decrypted
+// and the replies to them are encrypted
+func (s *Server) SetEncodingAESKey(key string) error {
+	crypter, err := NewMessageCrypter(s.token, key, s.appID)
+	if err != nil {
+		return err
+	}
+	s.crypter = crypter
+	return nil
+}
+
 func (s *Server) SetupRouter(router *gin.Engine, url string) {
 	router.GET(url, func(c *gin.Context) {
 		signature := c.Query("signature")
@@ -41,10 +110,11 @@ func (s *Server) SetupRouter(router *gin.Engine, url string) {
 			nonce := c.Query("nonce")
 			echostr := c.Query("echostr")
 			if ValidateLogin(timestamp, nonce, s.token, signature) {
-				s.log(Debug, "validated wechat login request")
+				s.log(c.Request.Context(), Debug, "validated wechat login request")
 				c.String(http.StatusOK, echostr)
 			} else {
-				s.log(Error, "failed to validate wechat login request")
+				s.log(c.Request.Context(), Error, "failed to validate wechat login request")
+				s.observeSignatureFailure()
 				c.AbortWithError(http.StatusBadRequest, errors.New("Signature doesn't match"))
 				return
 			}
@@ -61,25 +131,68 @@ func (s *Server) SetupRouter(router *gin.Engine, url string) {
 }
 
 func (s *Server) HandleWebLogin(c *gin.Context) {
+	s.handleWebLogin(OfficialAccountLogin, s.appID, s.appSecret, c)
+}
+
+// HandleWebsiteLogin handles the redirect of the open platform website login (snsapi_login)
+func (s *Server) HandleWebsiteLogin(c *gin.Context) {
+	if len(s.websiteAppID) == 0 {
+		s.log(c.Request.Context(), Error, "website login is not configured")
+		c.AbortWithError(http.StatusNotFound, errors.New("Website login not configured"))
+		return
+	}
+	s.handleWebLogin(WebsiteLogin, s.websiteAppID, s.websiteAppSecret, c)
+}
+
+func (s *Server) handleWebLogin(login, appID, appSecret string, c *gin.Context) {
+	ctx, span := startSpan(c.Request.Context(), "wechat.web_login", trace.WithAttributes(
+		attribute.String("wechat.login", login), attribute.String("wechat.app_id", appID)))
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
+
 	code := c.Query("code")
 	state := c.Query("state")
-	s.logf(Debug, "handling web login, code=%s, state=%s", code, state)
+	s.logf(c.Request.Context(), Debug, "handling web login, app=%s, code=%s, state=%s", appID, code, state)
 
-	token, err := GetWebAccessToken(s.appID, s.appSecret, code)
+	// the code param is removed if the user refuses to login
+	if len(code) == 0 {
+		s.logf(c.Request.Context(), Debug, "web login denied, state=%s", state)
+		if h, ok := s.handler.(WebLoginHandler); ok {
+			h.HandleLoginDenied(login, state, c)
+		} else {
+			c.String(http.StatusOK, "login denied")
+		}
+		return
+	}
+
+	token, err := GetWebAccessToken(c.Request.Context(), appID, appSecret, code)
 	if err != nil {
-		s.logf(Error, "failed to get web access token with code '%s': %s", code, err.Error())
+		s.logf(c.Request.Context(), Error, "failed to get web access token, state=%s: %s", state, err.Error())
+		if errors.Is(err, ErrInvalidCode) || errors.Is(err, ErrCodeUsed) || errors.Is(err, ErrCodeExpired) {
+			c.String(http.StatusBadRequest, "invalid code")
+			return
+		}
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 
-	user, err := GetUserInfoWithWebToken(token)
+	if s.grants != nil {
+		err = s.grants.SaveGrant(NewWebGrant(appID, token))
+		if err != nil {
+			s.logf(c.Request.Context(), Error, "failed to save web grant for '%s': %s", token.OpenID, err.Error())
+		}
+	}
+
+	user, err := GetUserInfoWithWebToken(c.Request.Context(), token)
 	if err != nil {
-		s.logf(Error, "failed to user info with web access token: %s", err.Error())
+		s.logf(c.Request.Context(), Error, "failed to user info with web access token: %s", err.Error())
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 
-	if s.handler != nil {
+	if h, ok := s.handler.(WebLoginHandler); ok {
+		h.HandleLogin(user, login, state, c)
+	} else if s.handler != nil {
 		s.handler.HandleWebLogin(user, state, c)
 	} else {
 		c.String(http.StatusOK, "login succeed")
@@ -87,21 +200,156 @@ func (s *Server) HandleWebLogin(c *gin.Context) {
 	}
 }
 
+// AccessToken returns the access token of the official account, which is cached until it expires
+func (s *Server) AccessToken(ctx context.Context) (*BaseAccessToken, error) {
+	token, err := s.accessToken.get(ctx, s.appID, s.appSecret)
+	if err != nil {
+		s.logf(ctx, Error, "failed to get access token: %s", err.Error())
+	}
+	return token, err
+}
+
+// RenewAccessToken gets a new access token after wechat rejects the stale one, e.g. when another process
+// has refreshed the token of the app, which invalidates the cached one before it expires
+func (s *Server) RenewAccessToken(ctx context.Context, stale string) (*BaseAccessToken, error) {
+	s.log(ctx, Warning, "access token rejected by wechat, renewing it")
+	token, err := s.accessToken.renew(ctx, s.appID, s.appSecret, stale)
+	if err != nil {
+		s.logf(ctx, Error, "failed to renew access token: %s", err.Error())
+	}
+	return token, err
+}
+
+// JSAPITicket returns the jsapi ticket of the official account, which is cached until it expires
+func (s *Server) JSAPITicket(ctx context.Context) (*JSAPITicket, error) {
+	token, err := s.AccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ticket, err := s.jsapiTicket.get(ctx, token)
+	if err != nil {
+		s.logf(ctx, Error, "failed to get jsapi ticket: %s", err.Error())
+	}
+	return ticket, err
+}
+
+// JSSDKConfig returns the payload of wx.config for the page of the url
+func (s *Server) JSSDKConfig(ctx context.Context, url string) (*JSSDKConfig, error) {
+	ticket, err := s.JSAPITicket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSSDKConfig(s.appID, ticket.Ticket, url)
+}
+
+// GetWebUserInfo returns the latest info of a user who has logged in via web before,
+// the web access token is refreshed if it has expired
+func (s *Server) GetWebUserInfo(ctx context.Context, openID string) (*UserInfo, error) {
+	if s.grants == nil {
+		return nil, ErrGrantNotFound
+	}
+
+	g, ok := s.grants.LoadGrant(openID)
+	if !ok {
+		return nil, ErrGrantNotFound
+	}
+
+	if g.TokenExpired() {
+		if g.RefreshExpired() {
+			return nil, ErrGrantExpired
+		}
+
+		err := g.Refresh(ctx)
+		if err != nil {
+			s.logf(ctx, Error, "failed to refresh web access token for '%s': %s", openID, err.Error())
+			return nil, err
+		}
+
+		err = s.grants.SaveGrant(g)
+		if err != nil {
+			s.logf(ctx, Error, "failed to save web grant for '%s': %s", openID, err.Error())
+		}
+	}
+
+	return GetUserInfoWithWebToken(ctx, &g.Token)
+}
+
 func (s *Server) handleMessage(c *gin.Context) {
+	ctx, span := startSpan(c.Request.Context(), "wechat.webhook")
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
+
+	timestamp := c.Query("timestamp")
+	nonce := c.Query("nonce")
+	_, sigSpan := startSpan(ctx, "wechat.verify_signature")
+	valid := ValidateLogin(timestamp, nonce, s.token, c.Query("signature"))
+	sigSpan.SetAttributes(attribute.Bool("wechat.signature_valid", valid))
+	sigSpan.End()
+	if !valid {
+		s.log(c.Request.Context(), Error, "failed to validate wechat message request")
+		s.observeSignatureFailure()
+		c.AbortWithError(http.StatusBadRequest, errors.New("Signature doesn't match"))
+		return
+	}
+
 	content, err := ioutil.ReadAll(c.Request.Body)
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
 
+	if c.Query("encrypt_type") == "aes" {
+		if s.crypter == nil {
+			s.log(c.Request.Context(), Error, "received encrypted message but the EncodingAESKey is not configured")
+			c.AbortWithError(http.StatusBadRequest, errors.New("Encryption not configured"))
+			return
+		}
+
+		_, decryptSpan := startSpan(ctx, "wechat.decrypt")
+		content, err = s.crypter.DecryptMessage(content, timestamp, nonce, c.Query("msg_signature"))
+		endSpan(decryptSpan, err)
+		if err != nil {
+			s.logf(c.Request.Context(), Error, "failed to decrypt message: %s", err.Error())
+			if err == ErrInvalidSignature {
+				s.observeSignatureFailure()
+			}
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+
+		w := &replyWriter{ResponseWriter: c.Writer, status: http.StatusOK}
+		c.Writer = w
+		defer s.encryptReply(c.Request.Context(), w, timestamp, nonce)
+	}
+
+	s.dispatchMessage(content, c)
+}
+
+func (s *Server) dispatchMessage(content []byte, c *gin.Context) {
 	if s.handler == nil {
 		c.String(http.StatusOK, "")
 		return
 	}
 
+	_, decodeSpan := startSpan(c.Request.Context(), "wechat.decode_message")
 	m, err := LoadUserMessage(content)
+	endSpan(decodeSpan, err)
 	if err == nil {
-		s.logf(Debug, "message received: %+v", m)
+		s.logf(c.Request.Context(), Debug, "message received: %+v", m)
+		defer s.observeMessage(m, time.Now())
+
+		ctx, span := startSpan(c.Request.Context(), "wechat.dispatch", trace.WithAttributes(messageAttributes(m)...))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		if s.recorder != nil {
+			s.recorder.RecordMessage(ctx, m, content)
+			w := &recordWriter{ResponseWriter: c.Writer}
+			c.Writer = w
+			defer s.recordReply(ctx, m, w)
+		}
+
 		if event, ok := m.(UserEvent); ok {
 			s.handler.HandleEvent(event, c)
 			return
@@ -124,24 +372,91 @@ func (s *Server) handleMessage(c *gin.Context) {
 			s.handler.HandleLink(v, c)
 		}
 	} else {
-		s.logf(Error, "failed to load user message: %s", err.Error())
+		s.logf(c.Request.Context(), Error, "failed to load user message: %s", err.Error())
 		c.String(http.StatusOK, "")
 		return
 	}
 }
 
-func (s *Server) log(t LogType, text string) {
-	if s.logger != nil {
-		s.logger.Log(t, text)
+// encryptReply writes the reply buffered by the handler, the empty reply and 'success' are sent as they are
+func (s *Server) encryptReply(ctx context.Context, w *replyWriter, timestamp, nonce string) {
+	reply := w.body.Bytes()
+	if w.status == http.StatusOK && len(reply) > 0 && string(reply) != "success" {
+		encrypted, err := s.crypter.EncryptMessage(reply, timestamp, nonce)
+		if err != nil {
+			s.logf(ctx, Error, "failed to encrypt reply: %s", err.Error())
+			w.ResponseWriter.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		reply = encrypted
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(reply)
+}
+
+// replyWriter buffers the reply so it can be encrypted after the handler returns
+type replyWriter struct {
+	gin.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (this *replyWriter) WriteHeader(code int) {
+	this.status = code
+}
+
+func (this *replyWriter) Write(data []byte) (int, error) {
+	return this.body.Write(data)
+}
+
+func (this *replyWriter) WriteString(s string) (int, error) {
+	return this.body.WriteString(s)
+}
+
+func messageAttributes(m UserMessage) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("wechat.msg_type", m.MessageType()),
 	}
+	if e, ok := m.(UserEvent); ok {
+		attrs = append(attrs, attribute.String("wechat.event", e.EventType()))
+	}
+	return attrs
+}
+
+func (s *Server) observeMessage(m UserMessage, start time.Time) {
+	if s.observer == nil {
+		return
+	}
+
+	event := ""
+	if e, ok := m.(UserEvent); ok {
+		event = e.EventType()
+	}
+	s.observer.ObserveMessage(m.MessageType(), event, time.Since(start))
 }
 
-func (s *Server) logf(t LogType, format string, v ...interface{}) {
-	if s.logger != nil {
-		s.logger.Logf(t, format, v...)
+func (s *Server) recordReply(ctx context.Context, m UserMessage, w *recordWriter) {
+	if reply := w.reply(); reply != nil {
+		s.recorder.RecordReply(ctx, m, reply)
 	}
 }
 
+func (s *Server) observeSignatureFailure() {
+	if s.observer != nil {
+		s.observer.ObserveSignatureFailure()
+	}
+}
+
+// log logs the text along with the request id of the context, the secrets in the text are redacted
+func (s *Server) log(ctx context.Context, t LogType, text string) {
+	logContext(ctx, s.logger, t, text, nil)
+}
+
+func (s *Server) logf(ctx context.Context, t LogType, format string, v ...interface{}) {
+	logContextf(ctx, s.logger, t, format, v...)
+}
+
 func NewServer(appID, appSecret, token string) *Server {
 	s := new(Server)
 	s.appID = appID
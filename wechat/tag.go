@@ -0,0 +1,144 @@
+package wechat
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	// max number of users for TagUsers and UntagUsers
+	MaxTagUsers = 50
+
+	// max number of users for BlacklistUsers and UnblacklistUsers
+	MaxBlacklistUsers = 20
+)
+
+type Tag struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func CreateTag(ctx context.Context, token *BaseAccessToken, name string) (*Tag, error) {
+	url := fmt.Sprintf("%s/cgi-bin/tags/create?access_token=%s", apiUrl(), token.Token)
+	body := map[string]interface{}{
+		"tag": map[string]string{"name": name},
+	}
+
+	result := new(struct {
+		Tag Tag `json:"tag"`
+	})
+	err := apiPost(ctx, url, body, result)
+	if err != nil {
+		return nil, err
+	}
+	return &result.Tag, nil
+}
+
+func GetTags(ctx context.Context, token *BaseAccessToken) ([]Tag, error) {
+	url := fmt.Sprintf("%s/cgi-bin/tags/get?access_token=%s", apiUrl(), token.Token)
+	result := new(struct {
+		Tags []Tag `json:"tags"`
+	})
+	err := apiGet(ctx, url, result)
+	if err != nil {
+		return nil, err
+	}
+	return result.Tags, nil
+}
+
+func UpdateTag(ctx context.Context, token *BaseAccessToken, tagID int, name string) error {
+	url := fmt.Sprintf("%s/cgi-bin/tags/update?access_token=%s", apiUrl(), token.Token)
+	body := map[string]interface{}{
+		"tag": map[string]interface{}{
+			"id":   tagID,
+			"name": name,
+		},
+	}
+	return apiPost(ctx, url, body, nil)
+}
+
+func DeleteTag(ctx context.Context, token *BaseAccessToken, tagID int) error {
+	url := fmt.Sprintf("%s/cgi-bin/tags/delete?access_token=%s", apiUrl(), token.Token)
+	body := map[string]interface{}{
+		"tag": map[string]int{"id": tagID},
+	}
+	return apiPost(ctx, url, body, nil)
+}
+
+// GetTagFollowers returns up to 10000 followers with the tag after the given open id
+func GetTagFollowers(ctx context.Context, token *BaseAccessToken, tagID int, nextOpenID string) (*FollowerList, error) {
+	url := fmt.Sprintf("%s/cgi-bin/user/tag/get?access_token=%s", apiUrl(), token.Token)
+	body := map[string]interface{}{
+		"tagid":       tagID,
+		"next_openid": nextOpenID,
+	}
+
+	list := new(FollowerList)
+	err := apiPost(ctx, url, body, list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func TagUsers(ctx context.Context, token *BaseAccessToken, tagID int, openIDs []string) error {
+	return tagMembers(ctx, token, "batchtagging", tagID, openIDs)
+}
+
+func UntagUsers(ctx context.Context, token *BaseAccessToken, tagID int, openIDs []string) error {
+	return tagMembers(ctx, token, "batchuntagging", tagID, openIDs)
+}
+
+func tagMembers(ctx context.Context, token *BaseAccessToken, action string, tagID int, openIDs []string) error {
+	if len(openIDs) == 0 || len(openIDs) > MaxTagUsers {
+		return fmt.Errorf("invalid number of users: %d", len(openIDs))
+	}
+
+	url := fmt.Sprintf("%s/cgi-bin/tags/members/%s?access_token=%s", apiUrl(), action, token.Token)
+	body := map[string]interface{}{
+		"openid_list": openIDs,
+		"tagid":       tagID,
+	}
+	return apiPost(ctx, url, body, nil)
+}
+
+func GetUserTags(ctx context.Context, token *BaseAccessToken, openID string) ([]int, error) {
+	url := fmt.Sprintf("%s/cgi-bin/tags/getidlist?access_token=%s", apiUrl(), token.Token)
+	result := new(struct {
+		TagIDList []int `json:"tagid_list"`
+	})
+	err := apiPost(ctx, url, map[string]string{"openid": openID}, result)
+	if err != nil {
+		return nil, err
+	}
+	return result.TagIDList, nil
+}
+
+// GetBlacklist returns up to 10000 blacklisted users after the given open id, or from the beginning if it's empty
+func GetBlacklist(ctx context.Context, token *BaseAccessToken, beginOpenID string) (*FollowerList, error) {
+	url := fmt.Sprintf("%s/cgi-bin/tags/members/getblacklist?access_token=%s", apiUrl(), token.Token)
+	list := new(FollowerList)
+	err := apiPost(ctx, url, map[string]string{"begin_openid": beginOpenID}, list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func BlacklistUsers(ctx context.Context, token *BaseAccessToken, openIDs []string) error {
+	return blacklistMembers(ctx, token, "batchblacklist", openIDs)
+}
+
+func UnblacklistUsers(ctx context.Context, token *BaseAccessToken, openIDs []string) error {
+	return blacklistMembers(ctx, token, "batchunblacklist", openIDs)
+}
+
+func blacklistMembers(ctx context.Context, token *BaseAccessToken, action string, openIDs []string) error {
+	if len(openIDs) == 0 || len(openIDs) > MaxBlacklistUsers {
+		return fmt.Errorf("invalid number of users: %d", len(openIDs))
+	}
+
+	url := fmt.Sprintf("%s/cgi-bin/tags/members/%s?access_token=%s", apiUrl(), action, token.Token)
+	return apiPost(ctx, url, map[string]interface{}{"openid_list": openIDs}, nil)
+}
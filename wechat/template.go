@@ -0,0 +1,43 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+type TemplateValue struct {
+	Value string `json:"value"`
+	Color string `json:"color,omitempty"`
+}
+
+type TemplateMiniProgram struct {
+	AppID    string `json:"appid"`
+	PagePath string `json:"pagepath,omitempty"`
+}
+
+// TemplateMessage is a message built from a template, the data is keyed by the fields of the template
+type TemplateMessage struct {
+	ToUser      string                   `json:"touser"`
+	TemplateID  string                   `json:"template_id"`
+	Url         string                   `json:"url,omitempty"`
+	MiniProgram *TemplateMiniProgram     `json:"miniprogram,omitempty"`
+	Data        map[string]TemplateValue `json:"data"`
+}
+
+// SendTemplateMessage sends a template message to a follower, returns the message id
+func SendTemplateMessage(ctx context.Context, token *BaseAccessToken, m *TemplateMessage) (int64, error) {
+	if len(m.ToUser) == 0 || len(m.TemplateID) == 0 {
+		return 0, errors.New("template message requires touser and template_id")
+	}
+
+	url := fmt.Sprintf("%s/cgi-bin/message/template/send?access_token=%s", apiUrl(), token.Token)
+	result := new(struct {
+		MsgID int64 `json:"msgid"`
+	})
+	err := apiPost(ctx, url, m, result)
+	if err != nil {
+		return 0, err
+	}
+	return result.MsgID, nil
+}
@@ -0,0 +1,78 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+const (
+	tracerName = "github.com/haowang1013/wechat-server/wechat"
+)
+
+// startSpan starts a span with the global tracer provider, which traces nothing unless the application sets one up
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// endSpan records the error if it's not nil and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		var we *WeChatError
+		if errors.As(err, &we) {
+			span.SetAttributes(attribute.Int("wechat.errcode", we.Code))
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, Redact(err.Error()))
+	}
+	span.End()
+}
+
+// attempt is an attempt of an api call, which is traced, reported to the observer and logged when it ends
+type attempt struct {
+	client *Client
+	ctx    context.Context
+	span   trace.Span
+	api    string
+	start  time.Time
+}
+
+func (this *Client) begin(ctx context.Context, method, api string) *attempt {
+	a := new(attempt)
+	a.client = this
+	a.api = api
+	a.ctx, a.span = startSpan(ctx, "wechat.api "+api,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", method),
+			attribute.String("url.path", api),
+		))
+	a.start = time.Now()
+	return a
+}
+
+func (this *attempt) end(err error) {
+	duration := time.Since(this.start)
+	endSpan(this.span, err)
+
+	if o := this.client.Observer; o != nil {
+		o.ObserveApiCall(this.api, duration, err)
+	}
+
+	if this.client.Logger != nil {
+		fields := Fields{
+			"api":      this.api,
+			"duration": duration.String(),
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+			logContext(this.ctx, this.client.Logger, Warning, "wechat api call failed", fields)
+		} else {
+			logContext(this.ctx, this.client.Logger, Debug, "wechat api call", fields)
+		}
+	}
+}
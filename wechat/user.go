@@ -1,8 +1,8 @@
 package wechat
 
 import (
+	"context"
 	"fmt"
-	"github.com/levigross/grequests"
 )
 
 type UserInfo struct {
@@ -18,37 +18,92 @@ type UserInfo struct {
 	SubscribeTime int    `json:"subscribe_time"`
 	UnionID       string `json:"unionid"`
 	Remark        string `json:"remark"`
-	GroupID       int    `json:"groupid"`
+
+	// Deprecated: groups have been replaced by tags, use TagIDList instead
+	GroupID int `json:"groupid"`
+
+	TagIDList      []int    `json:"tagid_list"`
+	SubscribeScene string   `json:"subscribe_scene"`
+	QRScene        int      `json:"qr_scene"`
+	QRSceneStr     string   `json:"qr_scene_str"`
+	Privilege      []string `json:"privilege"`
+}
+
+const (
+	// max number of users for BatchGetUserInfo
+	MaxBatchUserInfo = 100
+)
+
+// FollowerList is a page of open ids, pass NextOpenID to get the next page
+type FollowerList struct {
+	Total int `json:"total"`
+	Count int `json:"count"`
+	Data  struct {
+		OpenIDs []string `json:"openid"`
+	} `json:"data"`
+	NextOpenID string `json:"next_openid"`
 }
 
-func GetUserInfo(token *BaseAccessToken, openID string) (*UserInfo, error) {
-	url := fmt.Sprintf("https://api.weixin.qq.com/cgi-bin/user/info?access_token=%s&openid=%s&lang=zh_CN", token.Token, openID)
-	resp, err := grequests.Get(url, nil)
+func GetUserInfo(ctx context.Context, token *BaseAccessToken, openID string) (*UserInfo, error) {
+	url := fmt.Sprintf("%s/cgi-bin/user/info?access_token=%s&openid=%s&lang=zh_CN", apiUrl(), token.Token, openID)
+	user := new(UserInfo)
+	err := apiGet(ctx, url, user)
 	if err != nil {
 		return nil, err
 	}
+	return user, nil
+}
 
+func GetUserInfoWithWebToken(ctx context.Context, token *WebAccessToken) (*UserInfo, error) {
+	url := fmt.Sprintf("%s/sns/userinfo?access_token=%s&openid=%s&lang=zh_CN", apiUrl(), token.Token, token.OpenID)
 	user := new(UserInfo)
-	err = resp.JSON(user)
+	err := apiGet(ctx, url, user)
 	if err != nil {
 		return nil, err
 	}
-
 	return user, nil
 }
 
-func GetUserInfoWithWebToken(token *WebAccessToken) (*UserInfo, error) {
-	url := fmt.Sprintf("https://api.weixin.qq.com/sns/userinfo?access_token=%s&openid=%s&lang=zh_CN", token.Token, token.OpenID)
-	resp, err := grequests.Get(url, nil)
+// GetFollowers returns up to 10000 followers after the given open id, or from the beginning if it's empty
+func GetFollowers(ctx context.Context, token *BaseAccessToken, nextOpenID string) (*FollowerList, error) {
+	url := fmt.Sprintf("%s/cgi-bin/user/get?access_token=%s&next_openid=%s", apiUrl(), token.Token, nextOpenID)
+	list := new(FollowerList)
+	err := apiGet(ctx, url, list)
 	if err != nil {
 		return nil, err
 	}
+	return list, nil
+}
 
-	user := new(UserInfo)
-	err = resp.JSON(user)
+func BatchGetUserInfo(ctx context.Context, token *BaseAccessToken, openIDs []string) ([]UserInfo, error) {
+	if len(openIDs) == 0 || len(openIDs) > MaxBatchUserInfo {
+		return nil, fmt.Errorf("invalid number of users: %d", len(openIDs))
+	}
+
+	users := make([]map[string]string, len(openIDs))
+	for i, openID := range openIDs {
+		users[i] = map[string]string{
+			"openid": openID,
+			"lang":   "zh_CN",
+		}
+	}
+
+	url := fmt.Sprintf("%s/cgi-bin/user/info/batchget?access_token=%s", apiUrl(), token.Token)
+	result := new(struct {
+		Users []UserInfo `json:"user_info_list"`
+	})
+	err := apiPost(ctx, url, map[string]interface{}{"user_list": users}, result)
 	if err != nil {
 		return nil, err
 	}
+	return result.Users, nil
+}
 
-	return user, nil
+func UpdateRemark(ctx context.Context, token *BaseAccessToken, openID, remark string) error {
+	url := fmt.Sprintf("%s/cgi-bin/user/info/updateremark?access_token=%s", apiUrl(), token.Token)
+	body := map[string]string{
+		"openid": openID,
+		"remark": remark,
+	}
+	return apiPost(ctx, url, body, nil)
 }
@@ -0,0 +1,638 @@
+// Package wechattest provides a fake wechat api server for development and tests.
+//
+// It serves the access token, web authorization (sns oauth), user info, menu, messaging and jsapi ticket
+// endpoints from memory, and the responses can be scripted per path to inject errors:
+//
+//	s := wechattest.NewServer("app-id", "app-secret")
+//	defer s.Close()
+//	wechat.SetBaseUrls(s.URL, s.URL)
+//	s.AddUser(wechat.UserInfo{OpenID: "user-1", NickName: "alice"})
+//	s.InjectError("/cgi-bin/user/info", 40003, "invalid openid")
+package wechattest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/haowang1013/wechat-server/wechat"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// life time of the tokens issued by the server, in seconds
+	TokenExpiresIn = 7200
+)
+
+// Response is a scripted response of an endpoint, a zero status is sent as 200
+type Response struct {
+	Status int
+	Body   string
+	Delay  time.Duration
+}
+
+// ErrorResponse returns a response carrying the wechat error code
+func ErrorResponse(code int, message string) Response {
+	b, _ := json.Marshal(wechat.NewError(code, message))
+	return Response{Body: string(b)}
+}
+
+// SentMessage is a message sent through one of the messaging endpoints
+type SentMessage struct {
+	Path string
+	Body map[string]interface{}
+	Time time.Time
+}
+
+type Server struct {
+	// URL is the base url of the server started by NewServer, for both the api and the authorization pages
+	URL string
+
+	m             sync.Mutex
+	apps          map[string]string
+	users         map[string]*wechat.UserInfo
+	authorizeUser string
+	accessTokens  map[string]bool
+	webTokens     map[string]string
+	refreshTokens map[string]string
+	codes         map[string]string
+	scripts       map[string][]Response
+	requests      map[string]int
+	sent          []SentMessage
+	menu          json.RawMessage
+	nextMsgID     int64
+	mux           *http.ServeMux
+	httpServer    *httptest.Server
+}
+
+// New creates a server for the app, which can be served as a http.Handler
+func New(appID, appSecret string) *Server {
+	s := new(Server)
+	s.apps = map[string]string{appID: appSecret}
+	s.users = make(map[string]*wechat.UserInfo)
+	s.accessTokens = make(map[string]bool)
+	s.webTokens = make(map[string]string)
+	s.refreshTokens = make(map[string]string)
+	s.codes = make(map[string]string)
+	s.scripts = make(map[string][]Response)
+	s.requests = make(map[string]int)
+	s.nextMsgID = 1000
+
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/cgi-bin/token", s.handleToken)
+	s.mux.HandleFunc("/sns/oauth2/access_token", s.handleWebToken)
+	s.mux.HandleFunc("/sns/oauth2/refresh_token", s.handleRefreshToken)
+	s.mux.HandleFunc("/sns/auth", s.handleWebTokenAuth)
+	s.mux.HandleFunc("/sns/userinfo", s.handleWebUserInfo)
+	s.mux.HandleFunc("/cgi-bin/user/info", s.handleUserInfo)
+	s.mux.HandleFunc("/cgi-bin/user/info/batchget", s.handleBatchUserInfo)
+	s.mux.HandleFunc("/cgi-bin/user/get", s.handleFollowers)
+	s.mux.HandleFunc("/cgi-bin/menu/create", s.handleMenuCreate)
+	s.mux.HandleFunc("/cgi-bin/menu/get", s.handleMenuGet)
+	s.mux.HandleFunc("/cgi-bin/menu/delete", s.handleMenuDelete)
+	s.mux.HandleFunc("/cgi-bin/message/custom/send", s.handleSend)
+	s.mux.HandleFunc("/cgi-bin/message/template/send", s.handleSend)
+	s.mux.HandleFunc("/cgi-bin/message/mass/send", s.handleSend)
+	s.mux.HandleFunc("/cgi-bin/message/mass/sendall", s.handleSend)
+	s.mux.HandleFunc("/cgi-bin/message/mass/preview", s.handleSend)
+	s.mux.HandleFunc("/cgi-bin/ticket/getticket", s.handleTicket)
+	s.mux.HandleFunc("/cgi-bin/clear_quota", s.handleClearQuota)
+	s.mux.HandleFunc("/connect/oauth2/authorize", s.handleAuthorize)
+	s.mux.HandleFunc("/connect/qrconnect", s.handleAuthorize)
+	return s
+}
+
+// NewServer creates and starts a server for the app, the caller should call Close when finished
+func NewServer(appID, appSecret string) *Server {
+	s := New(appID, appSecret)
+	s.httpServer = httptest.NewServer(s)
+	s.URL = s.httpServer.URL
+	return s
+}
+
+func (s *Server) Close() {
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+}
+
+// AddApp allows another app to request tokens, e.g. the website app of the open platform
+func (s *Server) AddApp(appID, appSecret string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.apps[appID] = appSecret
+}
+
+// AddUser adds a follower, which is also the user authorizing the logins if it's the first one
+func (s *Server) AddUser(u wechat.UserInfo) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if len(s.users) == 0 {
+		s.authorizeUser = u.OpenID
+	}
+	s.users[u.OpenID] = &u
+}
+
+// SetAuthorizeUser sets the user approving the authorization pages, an empty open id denies the authorization
+func (s *Server) SetAuthorizeUser(openID string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.authorizeUser = openID
+}
+
+// NewCode returns an authorization code of the user, which can be exchanged for a web access token once
+func (s *Server) NewCode(openID string) string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	code := newToken()
+	s.codes[code] = openID
+	return code
+}
+
+// Script queues the responses of the path, each request to the path takes one response from the queue
+// until it's empty, then the path is served as usual
+func (s *Server) Script(path string, responses ...Response) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.scripts[path] = append(s.scripts[path], responses...)
+}
+
+// InjectError makes the next request to the path fail with the wechat error code
+func (s *Server) InjectError(path string, code int, message string) {
+	s.Script(path, ErrorResponse(code, message))
+}
+
+// ExpireAccessTokens invalidates all the access tokens issued so far, as if they have expired
+func (s *Server) ExpireAccessTokens() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.accessTokens = make(map[string]bool)
+	s.webTokens = make(map[string]string)
+}
+
+// Requests returns the number of requests to the path
+func (s *Server) Requests(path string) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.requests[path]
+}
+
+// Sent returns the messages sent through the messaging endpoints
+func (s *Server) Sent() []SentMessage {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]SentMessage(nil), s.sent...)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	s.requests[r.URL.Path]++
+	var script *Response
+	if queue := s.scripts[r.URL.Path]; len(queue) > 0 {
+		script = &queue[0]
+		s.scripts[r.URL.Path] = queue[1:]
+	}
+	s.m.Unlock()
+
+	if script == nil {
+		s.mux.ServeHTTP(w, r)
+		return
+	}
+
+	time.Sleep(script.Delay)
+	status := script.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(script.Body))
+}
+
+/**
+* tokens
+ */
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if !s.checkApp(w, q.Get("appid"), q.Get("secret")) {
+		return
+	}
+
+	s.m.Lock()
+	token := newToken()
+	s.accessTokens[token] = true
+	s.m.Unlock()
+
+	writeJson(w, map[string]interface{}{
+		"access_token": token,
+		"expires_in":   TokenExpiresIn,
+	})
+}
+
+func (s *Server) handleWebToken(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if !s.checkApp(w, q.Get("appid"), q.Get("secret")) {
+		return
+	}
+
+	s.m.Lock()
+	openID, ok := s.codes[q.Get("code")]
+	delete(s.codes, q.Get("code"))
+	s.m.Unlock()
+
+	if !ok {
+		writeError(w, 40029, "invalid code")
+		return
+	}
+	s.writeWebToken(w, openID)
+}
+
+func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	// refreshing doesn't take the secret, but the app must be known
+	s.m.Lock()
+	_, known := s.apps[q.Get("appid")]
+	openID, ok := s.refreshTokens[q.Get("refresh_token")]
+	s.m.Unlock()
+
+	if !known {
+		writeError(w, 40013, "invalid appid")
+		return
+	}
+
+	if !ok {
+		writeError(w, 40030, "invalid refresh_token")
+		return
+	}
+	s.writeWebToken(w, openID)
+}
+
+func (s *Server) writeWebToken(w http.ResponseWriter, openID string) {
+	s.m.Lock()
+	token := newToken()
+	refreshToken := newToken()
+	s.webTokens[token] = openID
+	s.refreshTokens[refreshToken] = openID
+	unionID := ""
+	if u := s.users[openID]; u != nil {
+		unionID = u.UnionID
+	}
+	s.m.Unlock()
+
+	writeJson(w, map[string]interface{}{
+		"access_token":  token,
+		"expires_in":    TokenExpiresIn,
+		"refresh_token": refreshToken,
+		"openid":        openID,
+		"scope":         "snsapi_userinfo",
+		"unionid":       unionID,
+	})
+}
+
+func (s *Server) handleWebTokenAuth(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.checkWebToken(w, r); ok {
+		writeError(w, 0, "ok")
+	}
+}
+
+func (s *Server) handleTicket(w http.ResponseWriter, r *http.Request) {
+	if !s.checkToken(w, r) {
+		return
+	}
+
+	writeJson(w, map[string]interface{}{
+		"errcode":    0,
+		"errmsg":     "ok",
+		"ticket":     newToken(),
+		"expires_in": TokenExpiresIn,
+	})
+}
+
+/**
+* authorization pages
+ */
+
+// handleAuthorize redirects back with a code if the authorize user is set, or without it as if the user denied
+func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s.m.Lock()
+	_, ok := s.apps[q.Get("appid")]
+	openID := s.authorizeUser
+	s.m.Unlock()
+
+	if !ok {
+		http.Error(w, "invalid appid", http.StatusBadRequest)
+		return
+	}
+
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || len(redirect.Host) == 0 {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	params := redirect.Query()
+	if len(openID) > 0 {
+		params.Set("code", s.NewCode(openID))
+	}
+	params.Set("state", q.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+/**
+* users
+ */
+func (s *Server) handleUserInfo(w http.ResponseWriter, r *http.Request) {
+	if !s.checkToken(w, r) {
+		return
+	}
+
+	u, ok := s.user(r.URL.Query().Get("openid"))
+	if !ok {
+		writeError(w, 40003, "invalid openid")
+		return
+	}
+	writeJson(w, u)
+}
+
+func (s *Server) handleWebUserInfo(w http.ResponseWriter, r *http.Request) {
+	openID, ok := s.checkWebToken(w, r)
+	if !ok {
+		return
+	}
+
+	u, ok := s.user(openID)
+	if !ok {
+		writeError(w, 40003, "invalid openid")
+		return
+	}
+	writeJson(w, u)
+}
+
+func (s *Server) handleBatchUserInfo(w http.ResponseWriter, r *http.Request) {
+	if !s.checkToken(w, r) {
+		return
+	}
+
+	req := new(struct {
+		UserList []struct {
+			OpenID string `json:"openid"`
+		} `json:"user_list"`
+	})
+	if !readJson(w, r, req) {
+		return
+	}
+
+	users := []wechat.UserInfo{}
+	for _, item := range req.UserList {
+		u, ok := s.user(item.OpenID)
+		if !ok {
+			writeError(w, 40003, "invalid openid")
+			return
+		}
+		users = append(users, *u)
+	}
+	writeJson(w, map[string]interface{}{
+		"user_info_list": users,
+	})
+}
+
+// handleFollowers returns all the followers in a single page
+func (s *Server) handleFollowers(w http.ResponseWriter, r *http.Request) {
+	if !s.checkToken(w, r) {
+		return
+	}
+
+	s.m.Lock()
+	openIDs := []string{}
+	for openID := range s.users {
+		openIDs = append(openIDs, openID)
+	}
+	s.m.Unlock()
+	sort.Strings(openIDs)
+
+	total := len(openIDs)
+	if len(r.URL.Query().Get("next_openid")) > 0 {
+		openIDs = []string{}
+	}
+
+	next := ""
+	if len(openIDs) > 0 {
+		next = openIDs[len(openIDs)-1]
+	}
+	writeJson(w, map[string]interface{}{
+		"total":       total,
+		"count":       len(openIDs),
+		"data":        map[string]interface{}{"openid": openIDs},
+		"next_openid": next,
+	})
+}
+
+func (s *Server) user(openID string) (*wechat.UserInfo, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	u, ok := s.users[openID]
+	return u, ok
+}
+
+/**
+* menu
+ */
+func (s *Server) handleMenuCreate(w http.ResponseWriter, r *http.Request) {
+	if !s.checkToken(w, r) {
+		return
+	}
+
+	var menu json.RawMessage
+	if !readJson(w, r, &menu) {
+		return
+	}
+
+	s.m.Lock()
+	s.menu = menu
+	s.m.Unlock()
+	writeError(w, 0, "ok")
+}
+
+func (s *Server) handleMenuGet(w http.ResponseWriter, r *http.Request) {
+	if !s.checkToken(w, r) {
+		return
+	}
+
+	s.m.Lock()
+	menu := s.menu
+	s.m.Unlock()
+
+	if menu == nil {
+		writeError(w, 46003, "menu no exist")
+		return
+	}
+	writeJson(w, map[string]interface{}{
+		"menu": menu,
+	})
+}
+
+func (s *Server) handleMenuDelete(w http.ResponseWriter, r *http.Request) {
+	if !s.checkToken(w, r) {
+		return
+	}
+
+	s.m.Lock()
+	s.menu = nil
+	s.m.Unlock()
+	writeError(w, 0, "ok")
+}
+
+// handleClearQuota accepts clear_quota of the app, there is no quota to clear
+func (s *Server) handleClearQuota(w http.ResponseWriter, r *http.Request) {
+	if !s.checkToken(w, r) {
+		return
+	}
+
+	body := new(struct {
+		AppID string `json:"appid"`
+	})
+	err := json.NewDecoder(r.Body).Decode(body)
+	if err != nil {
+		writeError(w, 47001, "data format error")
+		return
+	}
+
+	s.m.Lock()
+	_, ok := s.apps[body.AppID]
+	s.m.Unlock()
+
+	if !ok {
+		writeError(w, 40013, "invalid appid")
+		return
+	}
+	writeError(w, 0, "ok")
+}
+
+/**
+* messaging
+ */
+
+// handleSend records the message, and returns a message id
+func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
+	if !s.checkToken(w, r) {
+		return
+	}
+
+	body := make(map[string]interface{})
+	if !readJson(w, r, &body) {
+		return
+	}
+
+	if touser, ok := body["touser"].(string); ok {
+		if _, ok := s.user(touser); !ok {
+			writeError(w, 40003, "invalid openid")
+			return
+		}
+	}
+
+	s.m.Lock()
+	s.sent = append(s.sent, SentMessage{
+		Path: r.URL.Path,
+		Body: body,
+		Time: time.Now(),
+	})
+	s.nextMsgID++
+	msgID := s.nextMsgID
+	s.m.Unlock()
+
+	writeJson(w, map[string]interface{}{
+		"errcode":     0,
+		"errmsg":      "ok",
+		"msgid":       msgID,
+		"msg_id":      msgID,
+		"msg_data_id": msgID,
+	})
+}
+
+/**
+* helpers
+ */
+func (s *Server) checkApp(w http.ResponseWriter, appID, appSecret string) bool {
+	s.m.Lock()
+	secret, ok := s.apps[appID]
+	s.m.Unlock()
+
+	if !ok {
+		writeError(w, 40013, "invalid appid")
+		return false
+	}
+
+	if secret != appSecret {
+		writeError(w, 40125, "invalid appsecret")
+		return false
+	}
+	return true
+}
+
+func (s *Server) checkToken(w http.ResponseWriter, r *http.Request) bool {
+	s.m.Lock()
+	ok := s.accessTokens[r.URL.Query().Get("access_token")]
+	s.m.Unlock()
+
+	if !ok {
+		writeError(w, 40001, "invalid credential, access_token is invalid or not latest")
+	}
+	return ok
+}
+
+func (s *Server) checkWebToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	s.m.Lock()
+	openID, ok := s.webTokens[r.URL.Query().Get("access_token")]
+	s.m.Unlock()
+
+	if !ok {
+		writeError(w, 40001, "invalid credential, access_token is invalid or not latest")
+		return "", false
+	}
+
+	if q := r.URL.Query().Get("openid"); len(q) > 0 && q != openID {
+		writeError(w, 40003, "invalid openid")
+		return "", false
+	}
+	return openID, true
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func readJson(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	b, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(b, v)
+	}
+
+	if err != nil {
+		writeError(w, 47001, fmt.Sprintf("data format error: %s", err))
+		return false
+	}
+	return true
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJson(w, wechat.NewError(code, message))
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}